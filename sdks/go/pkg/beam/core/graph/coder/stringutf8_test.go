@@ -120,3 +120,27 @@ func TestEncodeDecodeStringUTF8LP(t *testing.T) {
 		})
 	}
 }
+
+// TestEncodeStringUTF8LengthPrefix validates that the length prefix
+// counts the encoded bytes of the string, and not its runes.
+func TestEncodeStringUTF8LengthPrefix(t *testing.T) {
+	for _, s := range testValues {
+		s := s
+		t.Run(s, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := EncodeStringUTF8(s, &buf); err != nil {
+				t.Fatal(err)
+			}
+			l, err := DecodeVarInt(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := l, int64(len(s)); got != want {
+				t.Errorf("EncodeStringUTF8(%q) length prefix = %v, want %v", s, got, want)
+			}
+			if got, want := buf.String(), s; got != want {
+				t.Errorf("EncodeStringUTF8(%q) content = %q, want %q", s, got, want)
+			}
+		})
+	}
+}
@@ -74,6 +74,24 @@ func dumperExtractor(store *Store, p func(format string, args ...interface{})) {
 		GaugeInt64: func(l Labels, v int64, t time.Time) {
 			m[l] = &gauge{v: v, t: t}
 		},
+		GaugeString: func(l Labels, v string, t time.Time) {
+			m[l] = &stringGauge{v: v, t: t}
+		},
+		MinMaxInt64: func(l Labels, min, max int64) {
+			m[l] = &minMax{min: min, max: max}
+		},
+		SumFixed: func(l Labels, mantissa int64, scale int32) {
+			m[l] = &fixedCounter{counter: counter{value: mantissa}, scale: scale}
+		},
+		IntTable: func(l Labels, rows map[int64]int64) {
+			m[l] = newIntTable(rows)
+		},
+		CategoryCount: func(l Labels, counts map[string]int64) {
+			m[l] = newCategoryTable(counts)
+		},
+		PreEncoded: func(l Labels, urn string, payload []byte) {
+			m[l] = &preEncoded{urn: urn, payload: payload}
+		},
 	}
 	e.ExtractFrom(store)
 	dumpTo(m, p)
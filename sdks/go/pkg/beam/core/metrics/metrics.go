@@ -48,8 +48,12 @@ package metrics
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"hash/fnv"
+	"math"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -68,6 +72,8 @@ type ctxKey string
 const (
 	counterSetKey ctxKey = "beam:counterset"
 	storeKey      ctxKey = "beam:bundlestore"
+	tenantKey     ctxKey = "beam:tenant"
+	namespaceKey  ctxKey = "beam:namespace"
 )
 
 // beamCtx is a caching context for IDs necessary to place metric updates.
@@ -76,6 +82,7 @@ const (
 type beamCtx struct {
 	context.Context
 	bundleID, ptransformID string
+	namespace              string
 	store                  *Store
 	cs                     *ptCounterSet
 }
@@ -90,13 +97,25 @@ func (ctx *beamCtx) Value(key interface{}) interface{} {
 			if cs := ctx.Context.Value(key); cs != nil {
 				ctx.cs = cs.(*ptCounterSet)
 			} else {
-				// It's not created previously
+				// It's not created previously. Metrics updated outside
+				// of a transform are attributed to a pseudo transform, so
+				// they have a well defined, non-empty transform.
+				pid := ctx.ptransformID
+				if pid == "" {
+					pid = ptransformIDUnset
+				}
 				ctx.store.mu.Lock()
 				cs := &ptCounterSet{
-					pid:           ctx.ptransformID,
+					pid:           pid,
 					counters:      make(map[nameHash]*counter),
 					distributions: make(map[nameHash]*distribution),
 					gauges:        make(map[nameHash]*gauge),
+					stringGauges:  make(map[nameHash]*stringGauge),
+					preEncoded:    make(map[nameHash]*preEncoded),
+					minMaxes:      make(map[nameHash]*minMax),
+					fixedCounters: make(map[fixedKey]*fixedCounter),
+					intTables:     make(map[nameHash]*sumTable),
+					categories:    make(map[nameHash]*sumTable),
 				}
 				ctx.store.css = append(ctx.store.css, cs)
 				ctx.cs = cs
@@ -119,14 +138,64 @@ func (ctx *beamCtx) String() string {
 	return fmt.Sprintf("beamCtx[%s;%s]", ctx.bundleID, ctx.ptransformID)
 }
 
+// SetTenant sets the tenant of the bundles processed with the context, for
+// workers serving bundles from several logical tenants. Stores populated by
+// SetBundleID on the returned context are associated with the tenant.
+func SetTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey, tenant)
+}
+
+// WithNamespace returns a context under which metric updates are reported
+// in the given namespace, rather than the namespace the metric was declared
+// with. This avoids repeating the namespace for a block of related metrics.
+func WithNamespace(ctx context.Context, ns string) context.Context {
+	if len(ns) == 0 {
+		panic("namespace is required to be non-empty")
+	}
+	// The namespace is also cached on beamCtxs, to avoid a context lookup
+	// on every metric update.
+	if bctx, ok := ctx.(*beamCtx); ok {
+		return &beamCtx{Context: context.WithValue(bctx.Context, namespaceKey, ns), bundleID: bctx.bundleID, store: bctx.store, ptransformID: bctx.ptransformID, cs: bctx.cs, namespace: ns}
+	}
+	return context.WithValue(ctx, namespaceKey, ns)
+}
+
+// contextNamespace returns the namespace set on the context by WithNamespace.
+func contextNamespace(ctx context.Context) string {
+	ns, _ := ctx.Value(namespaceKey).(string)
+	return ns
+}
+
+// scopedName returns the name and hash of a metric updated with the
+// context, applying any namespace set by WithNamespace.
+func scopedName(ctx context.Context, n name, h nameHash) (name, nameHash) {
+	var ns string
+	if bctx, ok := ctx.(*beamCtx); ok {
+		ns = bctx.namespace
+	} else {
+		ns = contextNamespace(ctx)
+	}
+	if ns == "" || ns == n.namespace {
+		return n, h
+	}
+	return name{namespace: ns, name: n.name}, hashName(ns, n.name)
+}
+
 // SetBundleID sets the id of the current Bundle, and populates the store.
+// Metrics updated with the context before a PTransform is set with
+// SetPTransformID are attributed to the "(ptransform id unset)" pseudo
+// transform.
 func SetBundleID(ctx context.Context, id string) context.Context {
+	store := newStore()
+	if t, ok := ctx.Value(tenantKey).(string); ok {
+		store.tenant = t
+	}
 	// Checking for *beamCtx is an optimization, so we don't dig deeply
 	// for ids if not necessary.
 	if bctx, ok := ctx.(*beamCtx); ok {
-		return &beamCtx{Context: bctx.Context, bundleID: id, store: newStore(), ptransformID: bctx.ptransformID}
+		return &beamCtx{Context: bctx.Context, bundleID: id, store: store, ptransformID: bctx.ptransformID, namespace: bctx.namespace}
 	}
-	return &beamCtx{Context: ctx, bundleID: id, store: newStore()}
+	return &beamCtx{Context: ctx, bundleID: id, store: store, namespace: contextNamespace(ctx)}
 }
 
 // SetPTransformID sets the id of the current PTransform.
@@ -135,10 +204,10 @@ func SetPTransformID(ctx context.Context, id string) context.Context {
 	// Checking for *beamCtx is an optimization, so we don't dig deeply
 	// for ids if not necessary.
 	if bctx, ok := ctx.(*beamCtx); ok {
-		return &beamCtx{Context: bctx.Context, bundleID: bctx.bundleID, store: bctx.store, ptransformID: id}
+		return &beamCtx{Context: bctx.Context, bundleID: bctx.bundleID, store: bctx.store, ptransformID: id, namespace: bctx.namespace}
 	}
 	// Avoid breaking if the bundle is unset in testing.
-	return &beamCtx{Context: ctx, bundleID: bundleIDUnset, store: newStore(), ptransformID: id}
+	return &beamCtx{Context: ctx, bundleID: bundleIDUnset, store: newStore(), ptransformID: id, namespace: contextNamespace(ctx)}
 }
 
 // GetStore extracts the metrics Store for the given context for a bundle.
@@ -178,6 +247,12 @@ const (
 	kindSumCounter
 	kindDistribution
 	kindGauge
+	kindStringGauge
+	kindPreEncoded
+	kindMinMax
+	kindSumFixed
+	kindIntTable
+	kindCategoryCount
 )
 
 func (t kind) String() string {
@@ -188,6 +263,18 @@ func (t kind) String() string {
 		return "Distribution"
 	case kindGauge:
 		return "Gauge"
+	case kindStringGauge:
+		return "StringGauge"
+	case kindPreEncoded:
+		return "PreEncoded"
+	case kindMinMax:
+		return "MinMax"
+	case kindSumFixed:
+		return "FixedCounter"
+	case kindIntTable:
+		return "IntTable"
+	case kindCategoryCount:
+		return "CategoryCounter"
 	default:
 		panic(fmt.Sprintf("Unknown metric type value: %v", uint8(t)))
 	}
@@ -247,6 +334,16 @@ func hashString(s string, b []byte) {
 	ioutilx.WriteUnsafe(hasher, b[:n])
 }
 
+// CountError counts an error the PTransform of the context handled without
+// failing the bundle, such as one a DoFn retried or skipped. Runners receive
+// the count as the transform's error count, along with any errors the
+// transform failed with.
+func CountError(ctx context.Context) {
+	if cs := getCounterSet(ctx); cs != nil {
+		atomic.AddInt64(&cs.errors, 1)
+	}
+}
+
 // Counter is a simple counter for incrementing and decrementing a value.
 type Counter struct {
 	name name
@@ -271,7 +368,8 @@ func (m *Counter) Inc(ctx context.Context, v int64) {
 	if cs == nil {
 		return
 	}
-	if c, ok := cs.counters[m.hash]; ok {
+	mn, h := scopedName(ctx, m.name, m.hash)
+	if c, ok := cs.counters[h]; ok {
 		c.inc(v)
 		return
 	}
@@ -279,8 +377,8 @@ func (m *Counter) Inc(ctx context.Context, v int64) {
 	c := &counter{
 		value: v,
 	}
-	cs.counters[m.hash] = c
-	GetStore(ctx).storeMetric(cs.pid, m.name, c)
+	cs.counters[h] = c
+	GetStore(ctx).storeMetric(cs.pid, mn, c)
 }
 
 // Dec decrements the counter within the given PTransform context by v.
@@ -288,13 +386,110 @@ func (m *Counter) Dec(ctx context.Context, v int64) {
 	m.Inc(ctx, -v)
 }
 
+// FixedCounter is a fixed point decimal sum metric, for exact aggregation of
+// values like currency amounts, which float64 sums would round. Values are
+// integer mantissas, scaled by the counter's decimal scale.
+type FixedCounter struct {
+	name  name
+	hash  nameHash
+	scale int32
+}
+
+func (m *FixedCounter) String() string {
+	return fmt.Sprintf("FixedCounter metric %s scale %d", m.name, m.scale)
+}
+
+// NewFixedCounter returns the FixedCounter with the given namespace and
+// name, whose value is its sum * 10^-scale. For example, a counter of cents
+// has scale 2. Counters with the same name but different scales are
+// distinct metrics.
+func NewFixedCounter(ns, n string, scale int32) *FixedCounter {
+	return &FixedCounter{
+		name:  newName(ns, n),
+		hash:  hashName(ns, n),
+		scale: scale,
+	}
+}
+
+// Inc increments the counter within the given PTransform context by the
+// mantissa v, so by v * 10^-scale.
+func (m *FixedCounter) Inc(ctx context.Context, v int64) {
+	cs := getCounterSet(ctx)
+	if cs == nil {
+		return
+	}
+	mn, h := scopedName(ctx, m.name, m.hash)
+	k := fixedKey{h, m.scale}
+	if c, ok := cs.fixedCounters[k]; ok {
+		c.inc(v)
+		return
+	}
+	// We're the first to create this metric!
+	c := &fixedCounter{counter: counter{value: v}, scale: m.scale}
+	cs.fixedCounters[k] = c
+	l := Labels{transform: cs.pid, namespace: mn.namespace, name: mn.name, scale: m.scale}
+	GetStore(ctx).storeLabeledMetric(l, c)
+}
+
+// Dec decrements the counter within the given PTransform context by the
+// mantissa v.
+func (m *FixedCounter) Dec(ctx context.Context, v int64) {
+	m.Inc(ctx, -v)
+}
+
+// fixedKey identifies a FixedCounter's cell in a counter set, since
+// counters with the same name but different scales are distinct.
+type fixedKey struct {
+	hash  nameHash
+	scale int32
+}
+
+// fixedCounter is a metric cell for fixed point sums, which saturate like
+// counters.
+type fixedCounter struct {
+	counter
+	scale int32
+}
+
+func (m *fixedCounter) String() string {
+	return fmt.Sprintf("value: %d scale: %d", m.value, m.scale)
+}
+
+func (m *fixedCounter) kind() kind {
+	return kindSumFixed
+}
+
+// ErrCounterOverflow indicates a counter's sum overflowed int64. The counter
+// saturates at math.MaxInt64 or math.MinInt64 rather than wrapping around.
+var ErrCounterOverflow = errors.New("counter overflow")
+
 // counter is a metric cell for counter values.
 type counter struct {
-	value int64
+	value    int64
+	overflow int32 // Non-zero if the value saturated. Accessed atomically.
 }
 
 func (m *counter) inc(v int64) {
-	atomic.AddInt64(&m.value, v)
+	for {
+		old := atomic.LoadInt64(&m.value)
+		n, saturated := old+v, false
+		switch {
+		case v > 0 && n < old:
+			n, saturated = math.MaxInt64, true
+		case v < 0 && n > old:
+			n, saturated = math.MinInt64, true
+		}
+		if atomic.CompareAndSwapInt64(&m.value, old, n) {
+			if saturated {
+				atomic.StoreInt32(&m.overflow, 1)
+			}
+			return
+		}
+	}
+}
+
+func (m *counter) overflowed() bool {
+	return atomic.LoadInt32(&m.overflow) != 0
 }
 
 func (m *counter) String() string {
@@ -311,8 +506,9 @@ func (m *counter) get() int64 {
 
 // Distribution is a simple distribution of values.
 type Distribution struct {
-	name name
-	hash nameHash
+	name  name
+	hash  nameHash
+	stats bool
 }
 
 func (m *Distribution) String() string {
@@ -327,13 +523,25 @@ func NewDistribution(ns, n string) *Distribution {
 	}
 }
 
+// NewDistributionWithStats returns the Distribution with the given namespace
+// and name, which also tracks the sum of the squares of its values, so the
+// variance and standard deviation of the values can be computed. Whether
+// the sum of squares is tracked is fixed by the first use of the
+// distribution in each bundle.
+func NewDistributionWithStats(ns, n string) *Distribution {
+	m := NewDistribution(ns, n)
+	m.stats = true
+	return m
+}
+
 // Update updates the distribution within the given PTransform context with v.
 func (m *Distribution) Update(ctx context.Context, v int64) {
 	cs := getCounterSet(ctx)
 	if cs == nil {
 		return
 	}
-	if d, ok := cs.distributions[m.hash]; ok {
+	mn, h := scopedName(ctx, m.name, m.hash)
+	if d, ok := cs.distributions[h]; ok {
 		d.update(v)
 		return
 	}
@@ -343,15 +551,24 @@ func (m *Distribution) Update(ctx context.Context, v int64) {
 		sum:   v,
 		min:   v,
 		max:   v,
+		stats: m.stats,
 	}
-	cs.distributions[m.hash] = d
-	GetStore(ctx).storeMetric(cs.pid, m.name, d)
+	if m.stats {
+		d.sumSq = square(v)
+	}
+	cs.distributions[h] = d
+	GetStore(ctx).storeMetric(cs.pid, mn, d)
 }
 
 // distribution is a metric cell for distribution values.
 type distribution struct {
 	count, sum, min, max int64
 	mu                   sync.Mutex
+
+	// sumSq is the sum of the squares of the values, if stats is set.
+	// It saturates at math.MaxInt64 rather than wrapping around.
+	sumSq int64
+	stats bool
 }
 
 func (m *distribution) update(v int64) {
@@ -364,9 +581,39 @@ func (m *distribution) update(v int64) {
 	}
 	m.count++
 	m.sum += v
+	if m.stats {
+		if sq := square(v); m.sumSq > math.MaxInt64-sq {
+			m.sumSq = math.MaxInt64
+		} else {
+			m.sumSq += sq
+		}
+	}
 	m.mu.Unlock()
 }
 
+// addSaturating returns a+b, saturating at math.MaxInt64 or math.MinInt64.
+func addSaturating(a, b int64) int64 {
+	n := a + b
+	switch {
+	case b > 0 && n < a:
+		return math.MaxInt64
+	case b < 0 && n > a:
+		return math.MinInt64
+	}
+	return n
+}
+
+// maxSquareRoot is the largest value whose square fits in an int64.
+const maxSquareRoot = 3037000499
+
+// square returns v*v, saturating at math.MaxInt64.
+func square(v int64) int64 {
+	if v > maxSquareRoot || v < -maxSquareRoot {
+		return math.MaxInt64
+	}
+	return v * v
+}
+
 func (m *distribution) String() string {
 	return fmt.Sprintf("count: %d sum: %d min: %d max: %d", m.count, m.sum, m.min, m.max)
 }
@@ -381,12 +628,279 @@ func (m *distribution) get() (count, sum, min, max int64) {
 	return m.count, m.sum, m.min, m.max
 }
 
-// Gauge is a time, value pair metric.
-type Gauge struct {
+// getStats is like get, and also returns the sum of squares.
+func (m *distribution) getStats() (count, sum, min, max, sumSq int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.count, m.sum, m.min, m.max, m.sumSq
+}
+
+// MinMax tracks only the minimum and maximum of its values. It's cheaper
+// to report than a Distribution for high volume metrics.
+type MinMax struct {
 	name name
 	hash nameHash
 }
 
+func (m *MinMax) String() string {
+	return fmt.Sprintf("MinMax metric %s", m.name)
+}
+
+// NewMinMax returns the MinMax with the given namespace and name.
+func NewMinMax(ns, n string) *MinMax {
+	return &MinMax{
+		name: newName(ns, n),
+		hash: hashName(ns, n),
+	}
+}
+
+// Update updates the minimum and maximum within the given PTransform context with v.
+func (m *MinMax) Update(ctx context.Context, v int64) {
+	cs := getCounterSet(ctx)
+	if cs == nil {
+		return
+	}
+	mn, h := scopedName(ctx, m.name, m.hash)
+	if mm, ok := cs.minMaxes[h]; ok {
+		mm.update(v)
+		return
+	}
+	// We're the first to create this metric!
+	mm := &minMax{
+		min: v,
+		max: v,
+	}
+	cs.minMaxes[h] = mm
+	GetStore(ctx).storeMetric(cs.pid, mn, mm)
+}
+
+// minMax is a metric cell for minimum and maximum values.
+type minMax struct {
+	min, max int64
+	mu       sync.Mutex
+}
+
+func (m *minMax) update(v int64) {
+	m.mu.Lock()
+	if v < m.min {
+		m.min = v
+	}
+	if v > m.max {
+		m.max = v
+	}
+	m.mu.Unlock()
+}
+
+func (m *minMax) String() string {
+	return fmt.Sprintf("min: %d max: %d", m.min, m.max)
+}
+
+func (m *minMax) kind() kind {
+	return kindMinMax
+}
+
+func (m *minMax) get() (min, max int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.min, m.max
+}
+
+// IntTable is a table of sums keyed by integers, such as counts per bucket.
+// Each distinct key adds a row, so keys should be drawn from a small range.
+type IntTable struct {
+	name name
+	hash nameHash
+}
+
+func (m *IntTable) String() string {
+	return fmt.Sprintf("IntTable metric %s", m.name)
+}
+
+// NewIntTable returns the IntTable with the given namespace and name.
+func NewIntTable(ns, n string) *IntTable {
+	return &IntTable{
+		name: newName(ns, n),
+		hash: hashName(ns, n),
+	}
+}
+
+// Add adds v to the row with the given key, within the given PTransform
+// context.
+func (m *IntTable) Add(ctx context.Context, key, v int64) {
+	cs := getCounterSet(ctx)
+	if cs == nil {
+		return
+	}
+	mn, h := scopedName(ctx, m.name, m.hash)
+	if t, ok := cs.intTables[h]; ok {
+		t.add(tableKey{i: key}, v)
+		return
+	}
+	// We're the first to create this metric!
+	t := newIntTable(map[int64]int64{key: v})
+	cs.intTables[h] = t
+	GetStore(ctx).storeMetric(cs.pid, mn, t)
+}
+
+// OtherCategory is the category CategoryCounters count the occurrences of
+// categories outside their set under.
+const OtherCategory = "other"
+
+// CategoryCounter counts occurrences of each of a fixed set of categories,
+// such as the values of an enum, as a single metric rather than a counter
+// per category. Occurrences of any other category are counted under
+// OtherCategory, so a CategoryCounter reports at most one more row than its
+// set has categories.
+type CategoryCounter struct {
+	name       name
+	hash       nameHash
+	categories map[string]bool
+}
+
+func (m *CategoryCounter) String() string {
+	return fmt.Sprintf("CategoryCounter metric %s", m.name)
+}
+
+// NewCategoryCounter returns the CategoryCounter with the given namespace
+// and name, counting the given set of categories.
+func NewCategoryCounter(ns, n string, categories []string) *CategoryCounter {
+	if len(categories) == 0 {
+		panic(fmt.Sprintf("category counter %s:%s requires at least one category", ns, n))
+	}
+	set := make(map[string]bool, len(categories))
+	for _, c := range categories {
+		set[c] = true
+	}
+	return &CategoryCounter{
+		name:       newName(ns, n),
+		hash:       hashName(ns, n),
+		categories: set,
+	}
+}
+
+// Inc increments the count of the category by v, within the given
+// PTransform context. Categories outside the counter's set are counted
+// under OtherCategory.
+func (m *CategoryCounter) Inc(ctx context.Context, category string, v int64) {
+	cs := getCounterSet(ctx)
+	if cs == nil {
+		return
+	}
+	if !m.categories[category] {
+		category = OtherCategory
+	}
+	mn, h := scopedName(ctx, m.name, m.hash)
+	if c, ok := cs.categories[h]; ok {
+		c.add(tableKey{s: category}, v)
+		return
+	}
+	// We're the first to create this metric!
+	c := newCategoryTable(map[string]int64{category: v})
+	cs.categories[h] = c
+	GetStore(ctx).storeMetric(cs.pid, mn, c)
+}
+
+// sumTable is a metric cell for keyed sums, backing both IntTables, keyed
+// by integers, and CategoryCounters, keyed by strings. Rows saturate at
+// math.MaxInt64 or math.MinInt64 rather than wrapping around.
+type sumTable struct {
+	k    kind // kindIntTable or kindCategoryCount.
+	mu   sync.Mutex
+	rows map[tableKey]int64
+}
+
+// tableKey is the key of a sumTable row. Only i is set for IntTables, and
+// only s for CategoryCounters.
+type tableKey struct {
+	i int64
+	s string
+}
+
+// newIntTable returns an IntTable cell with a copy of the rows.
+func newIntTable(rows map[int64]int64) *sumTable {
+	t := &sumTable{k: kindIntTable, rows: make(map[tableKey]int64, len(rows))}
+	for k, v := range rows {
+		t.rows[tableKey{i: k}] = v
+	}
+	return t
+}
+
+// newCategoryTable returns a CategoryCounter cell with a copy of the counts.
+func newCategoryTable(counts map[string]int64) *sumTable {
+	t := &sumTable{k: kindCategoryCount, rows: make(map[tableKey]int64, len(counts))}
+	for c, v := range counts {
+		t.rows[tableKey{s: c}] = v
+	}
+	return t
+}
+
+func (m *sumTable) add(key tableKey, v int64) {
+	m.mu.Lock()
+	m.rows[key] = addSaturating(m.rows[key], v)
+	m.mu.Unlock()
+}
+
+func (m *sumTable) String() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := make([]tableKey, 0, len(m.rows))
+	for k := range m.rows {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].i != keys[j].i {
+			return keys[i].i < keys[j].i
+		}
+		return keys[i].s < keys[j].s
+	})
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		if m.k == kindIntTable {
+			pairs = append(pairs, fmt.Sprintf("%d: %d", k.i, m.rows[k]))
+		} else {
+			pairs = append(pairs, fmt.Sprintf("%q: %d", k.s, m.rows[k]))
+		}
+	}
+	if m.k == kindIntTable {
+		return "rows: {" + strings.Join(pairs, ", ") + "}"
+	}
+	return "counts: {" + strings.Join(pairs, ", ") + "}"
+}
+
+func (m *sumTable) kind() kind {
+	return m.k
+}
+
+// intRows returns a copy of the rows of an IntTable cell.
+func (m *sumTable) intRows() map[int64]int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rows := make(map[int64]int64, len(m.rows))
+	for k, v := range m.rows {
+		rows[k.i] = v
+	}
+	return rows
+}
+
+// stringRows returns a copy of the counts of a CategoryCounter cell.
+func (m *sumTable) stringRows() map[string]int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	counts := make(map[string]int64, len(m.rows))
+	for k, v := range m.rows {
+		counts[k.s] = v
+	}
+	return counts
+}
+
+// Gauge is a time, value pair metric.
+type Gauge struct {
+	name      name
+	hash      nameHash
+	history   int
+	summarize bool
+}
+
 func (m *Gauge) String() string {
 	return fmt.Sprintf("Guage metric %s", m.name)
 }
@@ -399,6 +913,29 @@ func NewGauge(ns, n string) *Gauge {
 	}
 }
 
+// NewGaugeWithHistory returns the Gauge with the given namespace and name,
+// which also keeps the last k values it was set to, extractable as its
+// history. The history size is fixed by the first use of the gauge in
+// each bundle.
+func NewGaugeWithHistory(ns, n string, k int) *Gauge {
+	if k <= 0 {
+		panic(fmt.Sprintf("gauge history size must be positive, got %d", k))
+	}
+	m := NewGauge(ns, n)
+	m.history = k
+	return m
+}
+
+// NewGaugeWithSummary returns the Gauge with the given namespace and name,
+// which also reports the smallest and largest values it was set to in each
+// bundle alongside its latest value, extractable as its summary. Whether a
+// gauge is summarized is fixed by its first use in each bundle.
+func NewGaugeWithSummary(ns, n string) *Gauge {
+	m := NewGauge(ns, n)
+	m.summarize = true
+	return m
+}
+
 // TODO(lostluck): 2018/03/05 Use a common internal beam now() instead, once that exists.
 var now = time.Now
 
@@ -408,17 +945,31 @@ func (m *Gauge) Set(ctx context.Context, v int64) {
 	if cs == nil {
 		return
 	}
-	if g, ok := cs.gauges[m.hash]; ok {
+	mn, h := scopedName(ctx, m.name, m.hash)
+	if g, ok := cs.gauges[h]; ok {
 		g.set(v)
 		return
 	}
 	// We're the first to create this metric!
 	g := &gauge{
-		t: now(),
-		v: v,
+		t:         now(),
+		v:         v,
+		min:       v,
+		max:       v,
+		summarize: m.summarize,
+	}
+	if m.history > 0 {
+		g.samples = make([]GaugeSample, 0, m.history)
+		g.record(v, g.t)
 	}
-	cs.gauges[m.hash] = g
-	GetStore(ctx).storeMetric(cs.pid, m.name, g)
+	cs.gauges[h] = g
+	GetStore(ctx).storeMetric(cs.pid, mn, g)
+}
+
+// GaugeSample is a value a gauge was set to, and when.
+type GaugeSample struct {
+	Value     int64
+	Timestamp time.Time
 }
 
 // gauge is a metric cell for gauge values.
@@ -426,15 +977,78 @@ type gauge struct {
 	mu sync.Mutex
 	t  time.Time
 	v  int64
+
+	// samples is a ring buffer of the values the gauge was set to, if it
+	// keeps a history, with its capacity being the history size. next is
+	// the index the next sample is written to once it's full.
+	samples []GaugeSample
+	next    int
+
+	// min and max are the smallest and largest values the gauge was set
+	// to, reported if it's summarized.
+	min, max  int64
+	summarize bool
 }
 
+// set updates the gauge with last write wins semantics by timestamp.
+// Updates older than the current value are dropped, and when timestamps
+// are equal the larger value is kept, so the result is deterministic.
+// Every update counts towards the gauge's min and max, even if dropped.
 func (m *gauge) set(v int64) {
+	t := now()
 	m.mu.Lock()
-	m.t = now()
-	m.v = v
+	if v < m.min {
+		m.min = v
+	}
+	if v > m.max {
+		m.max = v
+	}
+	if t.After(m.t) || (t.Equal(m.t) && v > m.v) {
+		m.t = t
+		m.v = v
+		m.record(v, t)
+	}
 	m.mu.Unlock()
 }
 
+// record adds the value to the gauge's history, if it keeps one, evicting
+// the oldest sample if the history is full. Requires m.mu to be held.
+func (m *gauge) record(v int64, t time.Time) {
+	switch {
+	case cap(m.samples) == 0:
+	case len(m.samples) < cap(m.samples):
+		m.samples = append(m.samples, GaugeSample{Value: v, Timestamp: t})
+	default:
+		m.samples[m.next] = GaugeSample{Value: v, Timestamp: t}
+		m.next = (m.next + 1) % len(m.samples)
+	}
+}
+
+// history returns the gauge's history, oldest first, or nil if it doesn't
+// keep one. Only accepted updates are recorded, so samples are in
+// timestamp order.
+func (m *gauge) history() []GaugeSample {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.samples) == 0 {
+		return nil
+	}
+	h := make([]GaugeSample, 0, len(m.samples))
+	h = append(h, m.samples[m.next:]...)
+	return append(h, m.samples[:m.next]...)
+}
+
+// summary returns the smallest, largest, and latest values of the gauge,
+// and the time of the latest, or false if the gauge isn't summarized.
+func (m *gauge) summary() (min, max, last int64, t time.Time, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.summarize {
+		return 0, 0, 0, time.Time{}, false
+	}
+	return m.min, m.max, m.v, m.t, true
+}
+
 func (m *gauge) kind() kind {
 	return kindGauge
 }
@@ -448,3 +1062,140 @@ func (m *gauge) get() (int64, time.Time) {
 	defer m.mu.Unlock()
 	return m.v, m.t
 }
+
+// StringGauge is a time, string value pair metric.
+type StringGauge struct {
+	name name
+	hash nameHash
+}
+
+func (m *StringGauge) String() string {
+	return fmt.Sprintf("StringGauge metric %s", m.name)
+}
+
+// NewStringGauge returns the StringGauge with the given namespace and name.
+func NewStringGauge(ns, n string) *StringGauge {
+	return &StringGauge{
+		name: newName(ns, n),
+		hash: hashName(ns, n),
+	}
+}
+
+// Set sets the gauge to the given value, and associates it with the current time on the clock.
+func (m *StringGauge) Set(ctx context.Context, v string) {
+	cs := getCounterSet(ctx)
+	if cs == nil {
+		return
+	}
+	mn, h := scopedName(ctx, m.name, m.hash)
+	if g, ok := cs.stringGauges[h]; ok {
+		g.set(v)
+		return
+	}
+	// We're the first to create this metric!
+	g := &stringGauge{
+		t: now(),
+		v: v,
+	}
+	cs.stringGauges[h] = g
+	GetStore(ctx).storeMetric(cs.pid, mn, g)
+}
+
+// stringGauge is a metric cell for string gauge values.
+type stringGauge struct {
+	mu sync.Mutex
+	t  time.Time
+	v  string
+}
+
+func (m *stringGauge) set(v string) {
+	m.mu.Lock()
+	m.t = now()
+	m.v = v
+	m.mu.Unlock()
+}
+
+func (m *stringGauge) kind() kind {
+	return kindStringGauge
+}
+
+func (m *stringGauge) String() string {
+	return fmt.Sprintf("%v time: %s value: %q", m.kind(), m.t, m.v)
+}
+
+func (m *stringGauge) get() (string, time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.v, m.t
+}
+
+// PreEncoded is a metric whose value is already encoded for its urn,
+// for metric types not otherwise supported by this package.
+// Intended for framework use.
+type PreEncoded struct {
+	name name
+	hash nameHash
+	urn  string
+}
+
+func (m *PreEncoded) String() string {
+	return fmt.Sprintf("PreEncoded metric %s urn: %s", m.name, m.urn)
+}
+
+// NewPreEncoded returns the PreEncoded metric with the given namespace,
+// name, and urn.
+func NewPreEncoded(ns, n, urn string) *PreEncoded {
+	return &PreEncoded{
+		name: newName(ns, n),
+		hash: hashName(ns, n),
+		urn:  urn,
+	}
+}
+
+// Set replaces the metric's encoded value with payload.
+// The payload must not be modified after Set is called.
+func (m *PreEncoded) Set(ctx context.Context, payload []byte) {
+	cs := getCounterSet(ctx)
+	if cs == nil {
+		return
+	}
+	mn, h := scopedName(ctx, m.name, m.hash)
+	if pe, ok := cs.preEncoded[h]; ok {
+		pe.set(payload)
+		return
+	}
+	// We're the first to create this metric!
+	pe := &preEncoded{
+		urn:     m.urn,
+		payload: payload,
+	}
+	cs.preEncoded[h] = pe
+	GetStore(ctx).storeMetric(cs.pid, mn, pe)
+}
+
+// preEncoded is a metric cell for already encoded values.
+type preEncoded struct {
+	mu      sync.Mutex
+	urn     string
+	payload []byte
+}
+
+func (m *preEncoded) set(payload []byte) {
+	m.mu.Lock()
+	m.payload = payload
+	m.mu.Unlock()
+}
+
+func (m *preEncoded) kind() kind {
+	return kindPreEncoded
+}
+
+func (m *preEncoded) String() string {
+	return fmt.Sprintf("%v urn: %s payload: %x", m.kind(), m.urn, m.payload)
+}
+
+func (m *preEncoded) get() (string, []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.urn, m.payload
+}
@@ -17,7 +17,11 @@ package metrics
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math"
+	"reflect"
+	"sort"
 	"testing"
 	"time"
 )
@@ -129,6 +133,176 @@ func TestCounter_Dec(t *testing.T) {
 	}
 }
 
+func TestCounter_Overflow(t *testing.T) {
+	tests := []struct {
+		name     string
+		incs     []int64
+		want     int64
+		overflow bool
+	}{
+		{name: "max", incs: []int64{math.MaxInt64 - 1, 1}, want: math.MaxInt64},
+		{name: "overMax", incs: []int64{math.MaxInt64 - 1, 2}, want: math.MaxInt64, overflow: true},
+		// Overflow is sticky, even if the value is later back in range.
+		{name: "overMaxThenDec", incs: []int64{math.MaxInt64, math.MaxInt64, -1}, want: math.MaxInt64 - 1, overflow: true},
+		{name: "underMin", incs: []int64{math.MinInt64 + 1, -2}, want: math.MinInt64, overflow: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := ctxWith(bID, test.name)
+			m := NewCounter("overflow", test.name)
+			for _, v := range test.incs {
+				m.Inc(ctx, v)
+			}
+			var got int64
+			err := Extractor{
+				SumInt64: func(l Labels, v int64) { got = v },
+			}.ExtractFrom(GetStore(ctx))
+			if got != test.want {
+				t.Errorf("counter value = %v, want %v", got, test.want)
+			}
+			if gotErr := errors.Is(err, ErrCounterOverflow); gotErr != test.overflow {
+				t.Errorf("ExtractFrom() error = %v, want overflow error: %v", err, test.overflow)
+			}
+		})
+	}
+}
+
+func TestWithNamespace(t *testing.T) {
+	ctxs := map[string]context.Context{
+		"before bundle":    SetPTransformID(SetBundleID(WithNamespace(context.Background(), "scoped"), bID), "A"),
+		"after ptransform": WithNamespace(SetPTransformID(SetBundleID(context.Background(), bID), "A"), "scoped"),
+		"between":          SetPTransformID(WithNamespace(SetBundleID(context.Background(), bID), "scoped"), "A"),
+		"wrapped beam ctx": context.WithValue(WithNamespace(SetPTransformID(SetBundleID(context.Background(), bID), "A"), "scoped"), ctxKey("other"), 1),
+	}
+	for desc, ctx := range ctxs {
+		c := NewCounter("declared", "count")
+		c.Inc(ctx, 1)
+		c.Inc(ctx, 2)
+		NewDistribution("declared", "dist").Update(ctx, 3)
+		NewGauge("declared", "gauge").Set(ctx, 4)
+
+		got := make(map[string]string)
+		Extractor{
+			SumInt64:          func(l Labels, v int64) { got[l.Name()] = l.Namespace() },
+			DistributionInt64: func(l Labels, count, sum, min, max int64) { got[l.Name()] = l.Namespace() },
+			GaugeInt64:        func(l Labels, v int64, t time.Time) { got[l.Name()] = l.Namespace() },
+		}.ExtractFrom(GetStore(ctx))
+		want := map[string]string{"count": "scoped", "dist": "scoped", "gauge": "scoped"}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%v: namespaces by name = %v, want %v", desc, got, want)
+		}
+		if got, want := counterValue(GetStore(ctx), "scoped", "count"), int64(3); got != want {
+			t.Errorf("%v: scoped counter = %v, want %v", desc, got, want)
+		}
+	}
+
+	// Metrics updated without the namespace keep their declared namespace,
+	// and are distinct from those updated with it.
+	ctx := SetPTransformID(SetBundleID(context.Background(), bID), "A")
+	c := NewCounter("declared", "count")
+	c.Inc(ctx, 5)
+	c.Inc(WithNamespace(ctx, "scoped"), 7)
+	if got, want := counterValue(GetStore(ctx), "declared", "count"), int64(5); got != want {
+		t.Errorf("declared counter = %v, want %v", got, want)
+	}
+	if got, want := counterValue(GetStore(ctx), "scoped", "count"), int64(7); got != want {
+		t.Errorf("scoped counter = %v, want %v", got, want)
+	}
+}
+
+// counterValue returns the value of the named counter in the store.
+func counterValue(store *Store, ns, n string) int64 {
+	var v int64
+	Extractor{
+		SumInt64: func(l Labels, sum int64) {
+			if l.Namespace() == ns && l.Name() == n {
+				v = sum
+			}
+		},
+	}.ExtractFrom(store)
+	return v
+}
+
+func TestSetTenant(t *testing.T) {
+	if got := GetStore(SetBundleID(context.Background(), bID)).Tenant(); got != "" {
+		t.Errorf("Store.Tenant() without tenant = %q, want \"\"", got)
+	}
+	ctx := SetTenant(context.Background(), "tenant")
+	if got, want := GetStore(SetBundleID(ctx, bID)).Tenant(), "tenant"; got != want {
+		t.Errorf("Store.Tenant() = %q, want %q", got, want)
+	}
+}
+
+func TestCountError(t *testing.T) {
+	ctx := SetBundleID(context.Background(), bID)
+	if got := GetStore(ctx).ErrorCounts(); got != nil {
+		t.Errorf("ErrorCounts() without errors = %v, want none", got)
+	}
+	ctxA, ctxB := SetPTransformID(ctx, "A"), SetPTransformID(ctx, "B")
+	for i := 0; i < 3; i++ {
+		CountError(ctxA)
+	}
+	CountError(ctxB)
+	CountError(context.Background()) // Not a bundle context, so not counted.
+
+	want := map[string]int64{"A": 3, "B": 1}
+	if got := GetStore(ctx).ErrorCounts(); !reflect.DeepEqual(got, want) {
+		t.Errorf("ErrorCounts() = %v, want %v", got, want)
+	}
+}
+
+// mustTags returns NewTags(tags), failing the test on error.
+func mustTags(t *testing.T, tags map[string]string) Tags {
+	t.Helper()
+	ts, err := NewTags(tags)
+	if err != nil {
+		t.Fatalf("NewTags(%v) failed: %v", tags, err)
+	}
+	return ts
+}
+
+func TestTags(t *testing.T) {
+	tags := mustTags(t, map[string]string{"JOB_NAME": "wordcount", "VERSION": "2"})
+	if got, want := tags, mustTags(t, map[string]string{"VERSION": "2", "JOB_NAME": "wordcount"}); got != want {
+		t.Errorf("NewTags() = %v, want %v regardless of map order", got, want)
+	}
+	if got, want := tags.Map(), map[string]string{"JOB_NAME": "wordcount", "VERSION": "2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Map() = %v, want %v", got, want)
+	}
+	if got, want := tags.String(), "JOB_NAME=wordcount,VERSION=2"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+	// Each visits the same tags as Map, including those with empty values.
+	withEmpty := mustTags(t, map[string]string{"A": "", "B": "x", "C": ""})
+	got := make(map[string]string)
+	withEmpty.Each(func(k, v string) { got[k] = v })
+	if want := withEmpty.Map(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Each() visited %v, want %v", got, want)
+	}
+	if got, want := withEmpty.Len(), 3; got != want {
+		t.Errorf("Len() = %v, want %v", got, want)
+	}
+	if got := mustTags(t, nil).Len(); got != 0 {
+		t.Errorf("NewTags(nil).Len() = %v, want 0", got)
+	}
+	if got := mustTags(t, nil); got != (Tags{}) || got.Map() != nil {
+		t.Errorf("NewTags(nil) = %v, want the zero Tags", got)
+	}
+	if got, want := tags.Encoding(), "JOB_NAME\x00wordcount\x00VERSION\x002"; got != want {
+		t.Errorf("Encoding() = %q, want %q", got, want)
+	}
+	// NUL bytes would corrupt the encoding, so they're rejected.
+	for _, bad := range []map[string]string{{"A\x00B": "x"}, {"A": "x\x00B"}} {
+		if got, err := NewTags(bad); err == nil {
+			t.Errorf("NewTags(%q) = %v, want error", bad, got)
+		}
+	}
+	l := UserLabels("pt", "ns", "n")
+	if l.WithTags(tags) == l {
+		t.Errorf("Labels with tags equal to Labels without")
+	}
+}
+
 func TestDistribution_Update(t *testing.T) {
 	ctxA := ctxWith(bID, "A")
 	ctxB := ctxWith(bID, "B")
@@ -185,6 +359,90 @@ func TestDistribution_Update(t *testing.T) {
 	}
 }
 
+func TestMinMax_Update(t *testing.T) {
+	ctxA := ctxWith(bID, "A")
+	ctxB := ctxWith(bID, "B")
+	tests := []struct {
+		ns, n    string // MinMax name
+		ctx      context.Context
+		v        int64
+		min, max int64 // Internal variables to check
+	}{
+		{ns: "update1", n: "size", ctx: ctxA, v: 1, min: 1, max: 1},
+		{ns: "update1", n: "size", ctx: ctxA, v: 3, min: 1, max: 3},
+		{ns: "update1", n: "size", ctx: ctxA, v: -4, min: -4, max: 3},
+		{ns: "update1", n: "size", ctx: ctxA, v: 2, min: -4, max: 3},
+		{ns: "update1", n: "size", ctx: ctxB, v: 2, min: 2, max: 2},
+		{ns: "update2", n: "size", ctx: ctxA, v: 5, min: 5, max: 5},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("add %d to %s.%s[%q] min: %d max: %d", test.v, test.ns, test.n, test.ctx, test.min, test.max),
+			func(t *testing.T) {
+				m := NewMinMax(test.ns, test.n)
+				m.Update(test.ctx, test.v)
+
+				cs := getCounterSet(test.ctx)
+				mm := cs.minMaxes[m.hash]
+				if got, want := mm.min, test.min; got != want {
+					t.Errorf("NewMinMax(%q,%q).Update(%v, %d) mm.min got %v, want %v", test.ns, test.n, test.ctx, test.v, got, want)
+				}
+				if got, want := mm.max, test.max; got != want {
+					t.Errorf("NewMinMax(%q,%q).Update(%v, %d) mm.max got %v, want %v", test.ns, test.n, test.ctx, test.v, got, want)
+				}
+			})
+	}
+}
+
+func TestIntTable_Add(t *testing.T) {
+	ctx := ctxWith(bID, "A")
+	m := NewIntTable("table", "latency")
+	m.Add(ctx, 3, 1)
+	m.Add(ctx, -1, 2)
+	m.Add(ctx, 3, 4)
+	m.Add(ctx, 7, math.MaxInt64)
+	m.Add(ctx, 7, 1) // Saturates.
+
+	got := getCounterSet(ctx).intTables[m.hash].intRows()
+	want := map[int64]int64{-1: 2, 3: 5, 7: math.MaxInt64}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("NewIntTable(\"table\", \"latency\") rows got %v, want %v", got, want)
+	}
+	if got, want := getCounterSet(ctx).intTables[m.hash].String(), "rows: {-1: 2, 3: 5, 7: 9223372036854775807}"; got != want {
+		t.Errorf("IntTable cell String() = %q, want %q", got, want)
+	}
+}
+
+func TestCategoryCounter_Inc(t *testing.T) {
+	ctx := ctxWith(bID, "A")
+	m := NewCategoryCounter("category", "status", []string{"ok", "error"})
+	m.Inc(ctx, "ok", 3)
+	m.Inc(ctx, "error", 1)
+	m.Inc(ctx, "ok", 2)
+	// Categories outside the set share a row.
+	m.Inc(ctx, "timeout", 1)
+	m.Inc(ctx, "canceled", 1)
+	m.Inc(ctx, "error", math.MaxInt64) // Saturates.
+
+	got := getCounterSet(ctx).categories[m.hash].stringRows()
+	want := map[string]int64{"ok": 5, "error": math.MaxInt64, OtherCategory: 2}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("NewCategoryCounter(\"category\", \"status\") counts got %v, want %v", got, want)
+	}
+	if got, want := getCounterSet(ctx).categories[m.hash].String(), `counts: {"error": 9223372036854775807, "ok": 5, "other": 2}`; got != want {
+		t.Errorf("CategoryCounter cell String() = %q, want %q", got, want)
+	}
+}
+
+func TestNewCategoryCounter_NoCategories(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("NewCategoryCounter with no categories succeeded, want panic")
+		}
+	}()
+	NewCategoryCounter("category", "empty", nil)
+}
+
 func testclock(t time.Time) func() time.Time {
 	return func() time.Time { return t }
 }
@@ -235,6 +493,246 @@ func TestGauge_Set(t *testing.T) {
 	}
 }
 
+func TestGauge_SetLastWriteWins(t *testing.T) {
+	ctx := ctxWith(bID, "A")
+	tests := []struct {
+		name   string
+		t1, t2 time.Time
+		v1, v2 int64
+		want   int64
+	}{
+		{name: "later", t1: time.Unix(1, 0), t2: time.Unix(2, 0), v1: 5, v2: 3, want: 3},
+		{name: "earlier", t1: time.Unix(2, 0), t2: time.Unix(1, 0), v1: 5, v2: 7, want: 5},
+		{name: "sameTimeLarger", t1: time.Unix(1, 0), t2: time.Unix(1, 0), v1: 3, v2: 5, want: 5},
+		{name: "sameTimeSmaller", t1: time.Unix(1, 0), t2: time.Unix(1, 0), v1: 5, v2: 3, want: 5},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := NewGauge("lww", test.name)
+			now = testclock(test.t1)
+			m.Set(ctx, test.v1)
+			now = testclock(test.t2)
+			m.Set(ctx, test.v2)
+
+			g := getCounterSet(ctx).gauges[m.hash]
+			if got := g.v; got != test.want {
+				t.Errorf("Set(%d) at %v then Set(%d) at %v: got %v, want %v", test.v1, test.t1, test.v2, test.t2, got, test.want)
+			}
+		})
+	}
+}
+
+func TestDistribution_Stats(t *testing.T) {
+	ctx := ctxWith(bID, "A")
+	d := NewDistributionWithStats("stats", "values")
+	for _, v := range []int64{1, 2, 3, -4} {
+		d.Update(ctx, v)
+	}
+	big := NewDistributionWithStats("stats", "big")
+	big.Update(ctx, math.MaxInt32)
+	big.Update(ctx, math.MinInt64)
+
+	got := make(map[string][5]int64)
+	Extractor{
+		DistributionStatsInt64: func(l Labels, count, sum, min, max, sumSq int64) {
+			got[l.Name()] = [5]int64{count, sum, min, max, sumSq}
+		},
+	}.ExtractFrom(GetStore(ctx))
+	want := map[string][5]int64{
+		"values": {4, 2, -4, 3, 30},
+		// The sum of squares saturates.
+		"big": {2, math.MinInt64 + math.MaxInt32, math.MinInt64, math.MaxInt32, math.MaxInt64},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("extracted distribution stats = %v, want %v", got, want)
+	}
+
+	// Without a stats extractor, they're extracted as plain distributions.
+	var plain int
+	Extractor{
+		DistributionInt64: func(l Labels, count, sum, min, max int64) { plain++ },
+	}.ExtractFrom(GetStore(ctx))
+	if plain != 2 {
+		t.Errorf("extracted %d plain distributions, want 2", plain)
+	}
+}
+
+func TestFixedCounter(t *testing.T) {
+	ctx := ctxWith(bID, "A")
+	cents := NewFixedCounter("fixed", "amount", 2)
+	cents.Inc(ctx, 1999)
+	cents.Inc(ctx, 1)
+	cents.Dec(ctx, 500)
+	// The same name with a different scale is a distinct metric.
+	NewFixedCounter("fixed", "amount", 4).Inc(ctx, 7)
+
+	type sum struct {
+		mantissa int64
+		scale    int32
+	}
+	var got []sum
+	Extractor{
+		SumFixed: func(l Labels, mantissa int64, scale int32) {
+			if l.Namespace() != "fixed" {
+				return
+			}
+			if l.Scale() != scale {
+				t.Errorf("labels scale = %d, want %d", l.Scale(), scale)
+			}
+			got = append(got, sum{mantissa, scale})
+		},
+	}.ExtractFrom(GetStore(ctx))
+	sort.Slice(got, func(i, j int) bool { return got[i].scale < got[j].scale })
+	want := []sum{{1500, 2}, {7, 4}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("extracted fixed sums = %v, want %v", got, want)
+	}
+}
+
+func TestFixedCounter_Dump(t *testing.T) {
+	ctx := ctxWith(bID, "A")
+	NewFixedCounter("fixed", "amount", 2).Inc(ctx, 1999)
+	var lines []string
+	dumperExtractor(GetStore(ctx), func(format string, args ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	})
+	want := "\tfixed.amount - value: 1999 scale: 2"
+	for _, l := range lines {
+		if l == want {
+			return
+		}
+	}
+	t.Errorf("dumped %q, want a line %q", lines, want)
+}
+
+func TestGauge_History(t *testing.T) {
+	ctx := ctxWith(bID, "A")
+	m := NewGaugeWithHistory("history", "queue", 3)
+	for i := int64(1); i <= 5; i++ {
+		now = testclock(time.Unix(i, 0))
+		m.Set(ctx, i*10)
+	}
+	// Out of order updates are dropped, and aren't recorded.
+	now = testclock(time.Unix(0, 0))
+	m.Set(ctx, 100)
+
+	var got []GaugeSample
+	Extractor{
+		GaugeHistory: func(l Labels, samples []GaugeSample) {
+			if l.Namespace() == "history" && l.Name() == "queue" {
+				got = samples
+			}
+		},
+	}.ExtractFrom(GetStore(ctx))
+	want := []GaugeSample{
+		{Value: 30, Timestamp: time.Unix(3, 0)},
+		{Value: 40, Timestamp: time.Unix(4, 0)},
+		{Value: 50, Timestamp: time.Unix(5, 0)},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("gauge history = %v, want %v", got, want)
+	}
+
+	// Gauges without a history don't report one.
+	NewGauge("history", "plain").Set(ctx, 1)
+	Extractor{
+		GaugeHistory: func(l Labels, samples []GaugeSample) {
+			if l.Name() == "plain" {
+				t.Errorf("gauge without history reported %v", samples)
+			}
+		},
+	}.ExtractFrom(GetStore(ctx))
+}
+
+func TestGauge_Summary(t *testing.T) {
+	ctx := ctxWith(bID, "A")
+	m := NewGaugeWithSummary("summary", "queue")
+	for i, v := range []int64{20, -5, 40, 10} {
+		now = testclock(time.Unix(int64(i+1), 0))
+		m.Set(ctx, v)
+	}
+	// Out of order updates don't change the latest value, but count
+	// towards the min and max.
+	now = testclock(time.Unix(0, 0))
+	m.Set(ctx, 100)
+
+	var got []int64
+	var gotT time.Time
+	Extractor{
+		GaugeSummary: func(l Labels, min, max, last int64, t time.Time) {
+			if l.Namespace() == "summary" && l.Name() == "queue" {
+				got, gotT = []int64{min, max, last}, t
+			}
+		},
+	}.ExtractFrom(GetStore(ctx))
+	if want := []int64{-5, 100, 10}; !reflect.DeepEqual(got, want) {
+		t.Errorf("gauge summary min, max, last = %v, want %v", got, want)
+	}
+	if want := time.Unix(4, 0); !gotT.Equal(want) {
+		t.Errorf("gauge summary time = %v, want %v", gotT, want)
+	}
+
+	// Gauges without a summary don't report one.
+	NewGauge("summary", "plain").Set(ctx, 1)
+	Extractor{
+		GaugeSummary: func(l Labels, min, max, last int64, _ time.Time) {
+			if l.Name() == "plain" {
+				t.Errorf("gauge without summary reported %v, %v, %v", min, max, last)
+			}
+		},
+	}.ExtractFrom(GetStore(ctx))
+}
+
+func TestStringGauge_Set(t *testing.T) {
+	ctxA := ctxWith(bID, "A")
+	ctxB := ctxWith(bID, "B")
+	tests := []struct {
+		ns, n string // Gauge name
+		ctx   context.Context
+		v     string
+		t     time.Time
+	}{
+		{ns: "set1", n: "state", ctx: ctxA, v: "idle", t: time.Unix(0, 0)},
+		{ns: "set1", n: "state", ctx: ctxA, v: "busy", t: time.Unix(1, 0)},
+		{ns: "set1", n: "state", ctx: ctxB, v: "", t: time.Unix(2, 0)},
+		{ns: "set2", n: "state", ctx: ctxA, v: "スタリング", t: time.Unix(3, 0)},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("set %s.%s[%v] to %q at %v", test.ns, test.n, test.ctx, test.v, test.t),
+			func(t *testing.T) {
+				m := NewStringGauge(test.ns, test.n)
+				now = testclock(test.t)
+				m.Set(test.ctx, test.v)
+
+				cs := getCounterSet(test.ctx)
+				g := cs.stringGauges[m.hash]
+				if got, want := g.v, test.v; got != want {
+					t.Errorf("NewStringGauge(%q,%q).Set(%v, %q) g.v got %v, want %v", test.ns, test.n, test.ctx, test.v, got, want)
+				}
+				if got, want := g.t, test.t; got != want {
+					t.Errorf("NewStringGauge(%q,%q).Set(%v, %q) g.t got %v, want %v", test.ns, test.n, test.ctx, test.v, got, want)
+				}
+
+				var extracted bool
+				Extractor{
+					GaugeString: func(l Labels, v string, tm time.Time) {
+						if l.Transform() != cs.pid || l.Namespace() != test.ns || l.Name() != test.n {
+							return
+						}
+						extracted = true
+						if v != test.v || !tm.Equal(test.t) {
+							t.Errorf("GaugeString(%v) extracted (%q, %v), want (%q, %v)", l, v, tm, test.v, test.t)
+						}
+					},
+				}.ExtractFrom(GetStore(test.ctx))
+				if !extracted {
+					t.Errorf("GaugeString wasn't called for %s.%s", test.ns, test.n)
+				}
+			})
+	}
+}
+
 func TestNameCollisions(t *testing.T) {
 	ns, c, d, g := "collisions", "counter", "distribution", "gauge"
 	// Checks that user code panics if a counter attempts to be defined in the same PTransform
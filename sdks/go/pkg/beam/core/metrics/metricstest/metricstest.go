@@ -0,0 +1,107 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metricstest contains utilities for testing metric extraction.
+package metricstest
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/apache/beam/sdks/go/pkg/beam/core/metrics"
+)
+
+// MetricRecord is a single metric extracted from a Store.
+type MetricRecord struct {
+	Transform, Namespace, Name, PCollection string
+
+	// Kind is the kind of metric, one of "Counter", "Distribution",
+	// "Gauge" or "StringGauge".
+	Kind string
+	// Value is an int64 for counters, a DistributionValue for
+	// distributions, a GaugeValue for gauges, and a StringGaugeValue
+	// for string gauges.
+	Value interface{}
+}
+
+func (r MetricRecord) String() string {
+	return fmt.Sprintf("%s %s.%s{transform: %q, pcollection: %q} = %v", r.Kind, r.Namespace, r.Name, r.Transform, r.PCollection, r.Value)
+}
+
+// DistributionValue is the value of a distribution.
+type DistributionValue struct {
+	Count, Sum, Min, Max int64
+}
+
+// GaugeValue is the value of a gauge.
+type GaugeValue struct {
+	Value     int64
+	Timestamp time.Time
+}
+
+// StringGaugeValue is the value of a string gauge.
+type StringGaugeValue struct {
+	Value     string
+	Timestamp time.Time
+}
+
+// CollectAll extracts the counters, distributions and gauges in the store,
+// sorted by transform, namespace, name, PCollection, and then kind, so the
+// records are in a deterministic order.
+func CollectAll(store *metrics.Store) []MetricRecord {
+	var rs []MetricRecord
+	record := func(l metrics.Labels, kind string, v interface{}) {
+		rs = append(rs, MetricRecord{
+			Transform:   l.Transform(),
+			Namespace:   l.Namespace(),
+			Name:        l.Name(),
+			PCollection: l.PCollection(),
+			Kind:        kind,
+			Value:       v,
+		})
+	}
+	metrics.Extractor{
+		SumInt64: func(l metrics.Labels, v int64) {
+			record(l, "Counter", v)
+		},
+		DistributionInt64: func(l metrics.Labels, count, sum, min, max int64) {
+			record(l, "Distribution", DistributionValue{Count: count, Sum: sum, Min: min, Max: max})
+		},
+		GaugeInt64: func(l metrics.Labels, v int64, t time.Time) {
+			record(l, "Gauge", GaugeValue{Value: v, Timestamp: t})
+		},
+		GaugeString: func(l metrics.Labels, v string, t time.Time) {
+			record(l, "StringGauge", StringGaugeValue{Value: v, Timestamp: t})
+		},
+	}.ExtractFrom(store)
+
+	sort.Slice(rs, func(i, j int) bool {
+		a, b := rs[i], rs[j]
+		switch {
+		case a.Transform != b.Transform:
+			return a.Transform < b.Transform
+		case a.Namespace != b.Namespace:
+			return a.Namespace < b.Namespace
+		case a.Name != b.Name:
+			return a.Name < b.Name
+		case a.PCollection != b.PCollection:
+			return a.PCollection < b.PCollection
+		default:
+			return a.Kind < b.Kind
+		}
+	})
+	return rs
+}
@@ -0,0 +1,68 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metricstest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/apache/beam/sdks/go/pkg/beam/core/metrics"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCollectAll(t *testing.T) {
+	ctx := metrics.SetBundleID(context.Background(), "bundle")
+	ctxA := metrics.SetPTransformID(ctx, "A")
+	ctxB := metrics.SetPTransformID(ctx, "B")
+
+	metrics.NewCounter("ns", "count").Inc(ctxB, 3)
+	metrics.NewCounter("ns", "count").Inc(ctxA, 1)
+	metrics.NewDistribution("ns", "dist").Update(ctxA, 5)
+	metrics.NewDistribution("ns", "dist").Update(ctxA, 2)
+	metrics.NewGauge("ns", "gauge").Set(ctxA, 7)
+	metrics.NewStringGauge("ns", "sgauge").Set(ctxB, "seven")
+
+	got := CollectAll(metrics.GetStore(ctx))
+	// Gauge timestamps depend on when they were set.
+	for i, r := range got {
+		switch v := r.Value.(type) {
+		case GaugeValue:
+			if v.Timestamp.IsZero() {
+				t.Errorf("%v has no timestamp", r)
+			}
+			got[i].Value = GaugeValue{Value: v.Value}
+		case StringGaugeValue:
+			if v.Timestamp.IsZero() {
+				t.Errorf("%v has no timestamp", r)
+			}
+			got[i].Value = StringGaugeValue{Value: v.Value}
+		}
+	}
+	want := []MetricRecord{
+		{Transform: "A", Namespace: "ns", Name: "count", Kind: "Counter", Value: int64(1)},
+		{Transform: "A", Namespace: "ns", Name: "dist", Kind: "Distribution", Value: DistributionValue{Count: 2, Sum: 7, Min: 2, Max: 5}},
+		{Transform: "A", Namespace: "ns", Name: "gauge", Kind: "Gauge", Value: GaugeValue{Value: 7}},
+		{Transform: "B", Namespace: "ns", Name: "count", Kind: "Counter", Value: int64(3)},
+		{Transform: "B", Namespace: "ns", Name: "sgauge", Kind: "StringGauge", Value: StringGaugeValue{Value: "seven"}},
+	}
+	if d := cmp.Diff(want, got); d != "" {
+		t.Errorf("CollectAll() diff (-want, +got):\n%v", d)
+	}
+
+	if got := CollectAll(metrics.GetStore(metrics.SetBundleID(context.Background(), "empty"))); len(got) != 0 {
+		t.Errorf("CollectAll(empty store) = %v, want none", got)
+	}
+}
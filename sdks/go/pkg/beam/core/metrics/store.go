@@ -17,8 +17,13 @@ package metrics
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/apache/beam/sdks/go/pkg/beam/core/graph/mtime"
 )
 
 // Implementation note: We avoid depending on the FnAPI protos here
@@ -29,6 +34,16 @@ import (
 type Labels struct {
 	transform, namespace, name string
 	pcollection                string
+	tenant                     string
+	worker                     string
+	tags                       Tags
+
+	// The window the metric is scoped to, if windowed is set.
+	windowStart, windowEnd mtime.Time
+	windowed               bool
+
+	// The decimal scale of fixed point sums.
+	scale int32
 }
 
 // Transform returns the transform context for this metric, if available.
@@ -40,6 +55,159 @@ func (l Labels) Namespace() string { return l.namespace }
 // Name returns the name for this metric.
 func (l Labels) Name() string { return l.name }
 
+// PCollection returns the PCollection context for this metric, if available.
+func (l Labels) PCollection() string { return l.pcollection }
+
+// Tenant returns the tenant the metric was reported for, if available.
+func (l Labels) Tenant() string { return l.tenant }
+
+// WithTenant returns a copy of the Labels for the given tenant.
+// Intended for framework use.
+func (l Labels) WithTenant(tenant string) Labels {
+	l.tenant = tenant
+	return l
+}
+
+// Worker returns the id of the worker the metric was reported by, if
+// available.
+func (l Labels) Worker() string { return l.worker }
+
+// WithWorker returns a copy of the Labels for the given worker.
+// Intended for framework use.
+func (l Labels) WithWorker(worker string) Labels {
+	l.worker = worker
+	return l
+}
+
+// Tags returns the static tags the metric is labeled with.
+func (l Labels) Tags() Tags { return l.tags }
+
+// WithTags returns a copy of the Labels with the given static tags,
+// replacing any previous tags. Intended for framework use.
+func (l Labels) WithTags(tags Tags) Labels {
+	l.tags = tags
+	return l
+}
+
+// Tags are static key value labels, such as a job name or version, that
+// label all the metrics of a process for comparisons across jobs. Tags are
+// comparable, and equal when they have the same keys and values. The zero
+// value has no tags.
+type Tags struct {
+	// The NUL separated keys and values, sorted by key.
+	enc string
+}
+
+// NewTags returns the Tags with the given keys and values. Returns an
+// error if any key or value contains a NUL byte.
+func NewTags(tags map[string]string) (Tags, error) {
+	keys := make([]string, 0, len(tags))
+	for k, v := range tags {
+		if strings.IndexByte(k, 0) >= 0 || strings.IndexByte(v, 0) >= 0 {
+			return Tags{}, fmt.Errorf("tag %q=%q contains a NUL byte", k, v)
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, 2*len(keys))
+	for _, k := range keys {
+		parts = append(parts, k, tags[k])
+	}
+	return Tags{enc: strings.Join(parts, "\x00")}, nil
+}
+
+// Encoding returns the canonical encoding of the tags: their NUL separated
+// keys and values, sorted by key. Equal tags have equal encodings, so tags
+// can be hashed or ordered by their encoding without allocating. Intended
+// for framework use.
+func (t Tags) Encoding() string {
+	return t.enc
+}
+
+// Map returns the keys and values of the tags, or nil if there are none.
+func (t Tags) Map() map[string]string {
+	if t.enc == "" {
+		return nil
+	}
+	parts := strings.Split(t.enc, "\x00")
+	m := make(map[string]string, len(parts)/2)
+	for i := 0; i+1 < len(parts); i += 2 {
+		m[parts[i]] = parts[i+1]
+	}
+	return m
+}
+
+// Len returns the number of tags.
+func (t Tags) Len() int {
+	if t.enc == "" {
+		return 0
+	}
+	return (strings.Count(t.enc, "\x00") + 1) / 2
+}
+
+// Each calls f with the key and value of each tag, in key order, without
+// allocating.
+func (t Tags) Each(f func(k, v string)) {
+	for rest := t.enc; rest != ""; {
+		i := strings.IndexByte(rest, 0)
+		if i < 0 {
+			return
+		}
+		k, v := rest[:i], rest[i+1:]
+		rest = ""
+		if j := strings.IndexByte(v, 0); j >= 0 {
+			v, rest = v[:j], v[j+1:]
+		}
+		f(k, v)
+	}
+}
+
+// String returns the tags as comma separated key=value pairs, sorted by key.
+func (t Tags) String() string {
+	if t.enc == "" {
+		return ""
+	}
+	parts := strings.Split(t.enc, "\x00")
+	pairs := make([]string, 0, len(parts)/2)
+	for i := 0; i+1 < len(parts); i += 2 {
+		pairs = append(pairs, parts[i]+"="+parts[i+1])
+	}
+	return strings.Join(pairs, ",")
+}
+
+// WithPCollection returns a copy of the Labels attributed to the given
+// PCollection as well, for metrics scoped to a transform and one of its
+// PCollections. Intended for framework use.
+func (l Labels) WithPCollection(pcollection string) Labels {
+	l.pcollection = pcollection
+	return l
+}
+
+// Window returns the bounds of the window the metric is scoped to, and
+// whether it's scoped to a window at all.
+func (l Labels) Window() (start, end mtime.Time, ok bool) {
+	return l.windowStart, l.windowEnd, l.windowed
+}
+
+// WithWindow returns a copy of the Labels scoped to the window with the
+// given bounds, for metrics of windowed aggregations.
+// Intended for framework use.
+func (l Labels) WithWindow(start, end mtime.Time) Labels {
+	l.windowStart, l.windowEnd, l.windowed = start, end, true
+	return l
+}
+
+// Scale returns the decimal scale of a fixed point sum, the number of digits
+// after the decimal point, or 0 for other metrics.
+func (l Labels) Scale() int32 { return l.scale }
+
+// WithScale returns a copy of the Labels for a fixed point sum with the
+// given decimal scale. Intended for framework use.
+func (l Labels) WithScale(scale int32) Labels {
+	l.scale = scale
+	return l
+}
+
 // UserLabels builds a Labels for user metrics.
 // Intended for framework use.
 func UserLabels(transform, namespace, name string) Labels {
@@ -67,31 +235,67 @@ type Extractor struct {
 	SumInt64 func(labels Labels, v int64)
 	// DistributionInt64 extracts data from Distribution Int64 counters.
 	DistributionInt64 func(labels Labels, count, sum, min, max int64)
+	// DistributionStatsInt64 extracts data from Distribution Int64 counters
+	// that track the sum of squares of their values. If it's unset, they're
+	// extracted by DistributionInt64 instead. See NewDistributionWithStats.
+	DistributionStatsInt64 func(labels Labels, count, sum, min, max, sumSq int64)
 	// GaugeInt64 extracts data from Gauge Int64 counters.
 	GaugeInt64 func(labels Labels, v int64, t time.Time)
+	// GaugeString extracts data from Gauge String counters.
+	GaugeString func(labels Labels, v string, t time.Time)
+	// MinMaxInt64 extracts data from MinMax Int64 counters.
+	MinMaxInt64 func(labels Labels, min, max int64)
+	// SumFixed extracts data from fixed point FixedCounters, whose value is
+	// mantissa * 10^-scale.
+	SumFixed func(labels Labels, mantissa int64, scale int32)
+	// GaugeHistory extracts the recent values, oldest first, of Gauge Int64
+	// counters that keep a history. See NewGaugeWithHistory.
+	GaugeHistory func(labels Labels, samples []GaugeSample)
+	// GaugeSummary extracts the smallest, largest, and latest values, and
+	// the time of the latest, of Gauge Int64 counters created with
+	// NewGaugeWithSummary.
+	GaugeSummary func(labels Labels, min, max, last int64, t time.Time)
+	// IntTable extracts the rows of IntTables, by key. The map is a copy.
+	IntTable func(labels Labels, rows map[int64]int64)
+	// CategoryCount extracts the counts of CategoryCounters, by category.
+	// The map is a copy.
+	CategoryCount func(labels Labels, counts map[string]int64)
+	// PreEncoded extracts data from metrics holding already encoded
+	// payloads for the given metric urn.
+	PreEncoded func(labels Labels, urn string, payload []byte)
 }
 
 // ExtractFrom the given metrics Store all the metrics for
 // populated function fields.
-// Returns an error if no fields were set.
+// Returns an error if no fields were set, or an error wrapping
+// ErrCounterOverflow after extracting all metrics if any counters
+// overflowed, in which case their saturated values were extracted.
 func (e Extractor) ExtractFrom(store *Store) error {
 	store.mu.RLock()
 	defer store.mu.RUnlock()
 
-	if e.SumInt64 == nil && e.DistributionInt64 == nil && e.GaugeInt64 == nil {
+	if e.SumInt64 == nil && e.DistributionInt64 == nil && e.GaugeInt64 == nil && e.GaugeString == nil && e.MinMaxInt64 == nil && e.PreEncoded == nil && e.GaugeHistory == nil && e.SumFixed == nil && e.DistributionStatsInt64 == nil && e.IntTable == nil && e.CategoryCount == nil && e.GaugeSummary == nil {
 		return fmt.Errorf("no Extractor fields were set")
 	}
 
+	var overflowed []Labels
 	for l, um := range store.store {
 		switch um.kind() {
 		case kindSumCounter:
 			if e.SumInt64 != nil {
-				data := um.(*counter).get()
-				e.SumInt64(l, data)
+				c := um.(*counter)
+				e.SumInt64(l, c.get())
+				if c.overflowed() {
+					overflowed = append(overflowed, l)
+				}
 			}
 		case kindDistribution:
-			if e.DistributionInt64 != nil {
-				count, sum, min, max := um.(*distribution).get()
+			d := um.(*distribution)
+			if d.stats && e.DistributionStatsInt64 != nil {
+				count, sum, min, max, sumSq := d.getStats()
+				e.DistributionStatsInt64(l, count, sum, min, max, sumSq)
+			} else if e.DistributionInt64 != nil {
+				count, sum, min, max := d.get()
 				e.DistributionInt64(l, count, sum, min, max)
 			}
 		case kindGauge:
@@ -99,8 +303,52 @@ func (e Extractor) ExtractFrom(store *Store) error {
 				v, t := um.(*gauge).get()
 				e.GaugeInt64(l, v, t)
 			}
+			if e.GaugeHistory != nil {
+				if h := um.(*gauge).history(); h != nil {
+					e.GaugeHistory(l, h)
+				}
+			}
+			if e.GaugeSummary != nil {
+				if min, max, last, t, ok := um.(*gauge).summary(); ok {
+					e.GaugeSummary(l, min, max, last, t)
+				}
+			}
+		case kindStringGauge:
+			if e.GaugeString != nil {
+				v, t := um.(*stringGauge).get()
+				e.GaugeString(l, v, t)
+			}
+		case kindSumFixed:
+			if e.SumFixed != nil {
+				c := um.(*fixedCounter)
+				e.SumFixed(l, c.get(), l.scale)
+				if c.overflowed() {
+					overflowed = append(overflowed, l)
+				}
+			}
+		case kindMinMax:
+			if e.MinMaxInt64 != nil {
+				min, max := um.(*minMax).get()
+				e.MinMaxInt64(l, min, max)
+			}
+		case kindIntTable:
+			if e.IntTable != nil {
+				e.IntTable(l, um.(*sumTable).intRows())
+			}
+		case kindCategoryCount:
+			if e.CategoryCount != nil {
+				e.CategoryCount(l, um.(*sumTable).stringRows())
+			}
+		case kindPreEncoded:
+			if e.PreEncoded != nil {
+				urn, payload := um.(*preEncoded).get()
+				e.PreEncoded(l, urn, payload)
+			}
 		}
 	}
+	if len(overflowed) > 0 {
+		return fmt.Errorf("%w: saturated counters %v", ErrCounterOverflow, overflowed)
+	}
 	return nil
 }
 
@@ -121,12 +369,21 @@ type ptCounterSet struct {
 	counters      map[nameHash]*counter
 	distributions map[nameHash]*distribution
 	gauges        map[nameHash]*gauge
+	stringGauges  map[nameHash]*stringGauge
+	preEncoded    map[nameHash]*preEncoded
+	minMaxes      map[nameHash]*minMax
+	fixedCounters map[fixedKey]*fixedCounter
+	intTables     map[nameHash]*sumTable
+	categories    map[nameHash]*sumTable
+
+	errors int64 // Errors counted with CountError. Accessed atomically.
 }
 
 // Store retains per transform countersets, intended for per bundle use.
 type Store struct {
-	mu  sync.RWMutex
-	css []*ptCounterSet
+	mu     sync.RWMutex
+	css    []*ptCounterSet
+	tenant string
 
 	store map[Labels]userMetric
 }
@@ -135,13 +392,42 @@ func newStore() *Store {
 	return &Store{store: make(map[Labels]userMetric)}
 }
 
+// Tenant returns the tenant of the bundle the store's metrics were
+// reported for, or "" if it's unset. See SetTenant.
+func (b *Store) Tenant() string {
+	return b.tenant
+}
+
+// ErrorCounts returns the errors counted with CountError, keyed by
+// transform. Transforms without errors are omitted.
+func (b *Store) ErrorCounts() map[string]int64 {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	var m map[string]int64
+	for _, cs := range b.css {
+		if n := atomic.LoadInt64(&cs.errors); n > 0 {
+			if m == nil {
+				m = make(map[string]int64)
+			}
+			m[cs.pid] += n
+		}
+	}
+	return m
+}
+
 // storeMetric stores a metric away on its first use so it may be retrieved later on.
 // In the event of a name collision, storeMetric can panic, so it's prudent to release
 // locks if they are no longer required.
 func (b *Store) storeMetric(pid string, n name, m userMetric) {
+	b.storeLabeledMetric(Labels{transform: pid, namespace: n.namespace, name: n.name}, m)
+}
+
+// storeLabeledMetric is like storeMetric, for metrics with labels beyond
+// their transform and name.
+func (b *Store) storeLabeledMetric(l Labels, m userMetric) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
-	l := Labels{transform: pid, namespace: n.namespace, name: n.name}
+	n := name{namespace: l.namespace, name: l.name}
 	if ms, ok := b.store[l]; ok {
 		if ms.kind() != m.kind() {
 			panic(fmt.Sprintf("metric name %s being reused for a different metric type in a single PTransform", n))
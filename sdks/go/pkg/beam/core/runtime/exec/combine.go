@@ -21,6 +21,7 @@ import (
 	"io"
 	"path"
 	"reflect"
+	"sync/atomic"
 
 	"github.com/apache/beam/sdks/go/pkg/beam/core/graph"
 	"github.com/apache/beam/sdks/go/pkg/beam/core/graph/coder"
@@ -43,8 +44,9 @@ type Combine struct {
 
 	binaryMergeFn reflectx.Func2x1 // optimized caller in the case of binary merge accumulators
 
-	status Status
-	err    errorx.GuardedError
+	status   Status
+	err      errorx.GuardedError
+	errCount int64 // Errors the unit failed with. Accessed atomically.
 
 	// reusable invokers
 	createAccumInv, addInputInv, mergeInv, extractOutputInv *invoker
@@ -287,9 +289,15 @@ func (n *Combine) extract(ctx context.Context, accum interface{}) (interface{},
 func (n *Combine) fail(err error) error {
 	n.status = Broken
 	n.err.TrySetError(err)
+	atomic.AddInt64(&n.errCount, 1)
 	return err
 }
 
+// errorCount returns the number of errors the Combine has failed with.
+func (n *Combine) errorCount() int64 {
+	return atomic.LoadInt64(&n.errCount)
+}
+
 func (n *Combine) String() string {
 	return fmt.Sprintf("Combine[%v] Keyed:%v Out:%v", path.Base(n.Fn.Name()), n.UsesKey, n.Out.ID())
 }
@@ -20,6 +20,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -34,11 +35,16 @@ type DataSink struct {
 	SID   StreamID
 	Coder *coder.Coder
 
-	enc   ElementEncoder
-	wEnc  WindowEncoder
-	w     io.WriteCloser
-	count int64
-	start time.Time
+	enc       ElementEncoder
+	wEnc      WindowEncoder
+	w         io.WriteCloser
+	count     elementSampler
+	sized     elementSampler   // Samples the elements whose sizes are recorded.
+	sizes     sizeDistribution // Encoded sizes of the sampled elements.
+	byteCount int64            // Bytes written to the data channel.
+	coderOps  int64            // Elements encoded for the data channel.
+	inputPID  string           // The PCollection the written bytes are attributed to.
+	start     time.Time
 }
 
 func (n *DataSink) ID() UnitID {
@@ -57,7 +63,11 @@ func (n *DataSink) StartBundle(ctx context.Context, id string, data DataContext)
 		return err
 	}
 	n.w = w
-	atomic.StoreInt64(&n.count, 0)
+	n.count.reset(atomic.LoadInt64(&elementSampleRate))
+	n.sized.reset(atomic.LoadInt64(&sizeSampleRate))
+	n.sizes.reset()
+	atomic.StoreInt64(&n.byteCount, 0)
+	atomic.StoreInt64(&n.coderOps, 0)
 	n.start = time.Now()
 	return nil
 }
@@ -67,21 +77,26 @@ func (n *DataSink) ProcessElement(ctx context.Context, value *FullValue, values
 	// unit.
 	var b bytes.Buffer
 
-	atomic.AddInt64(&n.count, 1)
+	n.count.observe()
 	if err := EncodeWindowedValueHeader(n.wEnc, value.Windows, value.Timestamp, &b); err != nil {
 		return err
 	}
 	if err := n.enc.Encode(value, &b); err != nil {
 		return errors.WithContextf(err, "encoding element %v with coder %v", value, n.enc)
 	}
+	atomic.AddInt64(&n.coderOps, 1)
 	if _, err := n.w.Write(b.Bytes()); err != nil {
 		return err
 	}
+	atomic.AddInt64(&n.byteCount, int64(b.Len()))
+	if n.sized.observe() {
+		n.sizes.update(int64(b.Len()))
+	}
 	return nil
 }
 
 func (n *DataSink) FinishBundle(ctx context.Context) error {
-	log.Infof(ctx, "DataSink: %d elements in %d ns", atomic.LoadInt64(&n.count), time.Now().Sub(n.start))
+	log.Infof(ctx, "DataSink: %d elements in %d ns", n.count.estimate(), time.Now().Sub(n.start))
 	return n.w.Close()
 }
 
@@ -92,3 +107,115 @@ func (n *DataSink) Down(ctx context.Context) error {
 func (n *DataSink) String() string {
 	return fmt.Sprintf("DataSink[%v] Coder:%v", n.SID, n.Coder)
 }
+
+// elementSampleRate is the rate DataSinks sample element counts at.
+// Accessed atomically.
+var elementSampleRate int64 = 1
+
+// SetElementCountSampling sets DataSinks to count 1 in every rate elements,
+// and report the count scaled by the rate as an estimate. This avoids
+// updating the shared count for every element in high throughput pipelines.
+// A rate of 1 or less counts every element. Applies to bundles started
+// after the call.
+func SetElementCountSampling(rate int64) {
+	if rate < 1 {
+		rate = 1
+	}
+	atomic.StoreInt64(&elementSampleRate, rate)
+}
+
+// sizeSampleRate is the rate DataSinks sample element sizes at. Accessed
+// atomically.
+var sizeSampleRate int64 = 16
+
+// SetSizeSampling sets DataSinks to record the encoded size of 1 in every
+// rate elements, which avoids updating the shared size distribution for
+// every element. A rate of 1 or less records every element's size. Applies
+// to bundles started after the call.
+func SetSizeSampling(rate int64) {
+	if rate < 1 {
+		rate = 1
+	}
+	atomic.StoreInt64(&sizeSampleRate, rate)
+}
+
+// elementSampler counts 1 in every rate observed elements. The estimate
+// is at most rate-1 below the true count.
+type elementSampler struct {
+	rate    int64 // Written atomically, and only read atomically by other goroutines.
+	seen    int64 // Only accessed by the processing goroutine.
+	sampled int64 // Accessed atomically.
+}
+
+func (s *elementSampler) reset(rate int64) {
+	atomic.StoreInt64(&s.rate, rate)
+	s.seen = 0
+	atomic.StoreInt64(&s.sampled, 0)
+}
+
+// observe counts an element, and reports whether it was sampled.
+func (s *elementSampler) observe() bool {
+	s.seen++
+	if s.rate <= 1 || s.seen%s.rate == 0 {
+		atomic.AddInt64(&s.sampled, 1)
+		return true
+	}
+	return false
+}
+
+// estimate returns the sampled count scaled by the rate.
+func (s *elementSampler) estimate() int64 {
+	n := atomic.LoadInt64(&s.sampled)
+	if rate := atomic.LoadInt64(&s.rate); rate > 1 {
+		n *= rate
+	}
+	return n
+}
+
+// SizeSnapshot summarizes sampled element sizes, in bytes.
+type SizeSnapshot struct {
+	Count, Sum, Min, Max int64
+}
+
+// merge combines two snapshots into one.
+func (s SizeSnapshot) merge(o SizeSnapshot) SizeSnapshot {
+	switch {
+	case o.Count == 0:
+		return s
+	case s.Count == 0:
+		return o
+	}
+	if o.Min < s.Min {
+		s.Min = o.Min
+	}
+	if o.Max > s.Max {
+		s.Max = o.Max
+	}
+	s.Count += o.Count
+	s.Sum += o.Sum
+	return s
+}
+
+// sizeDistribution accumulates the sizes of sampled elements.
+type sizeDistribution struct {
+	mu sync.Mutex
+	s  SizeSnapshot
+}
+
+func (d *sizeDistribution) reset() {
+	d.mu.Lock()
+	d.s = SizeSnapshot{}
+	d.mu.Unlock()
+}
+
+func (d *sizeDistribution) update(size int64) {
+	d.mu.Lock()
+	d.s = d.s.merge(SizeSnapshot{Count: 1, Sum: size, Min: size, Max: size})
+	d.mu.Unlock()
+}
+
+func (d *sizeDistribution) snapshot() SizeSnapshot {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.s
+}
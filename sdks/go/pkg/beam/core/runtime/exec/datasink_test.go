@@ -0,0 +1,73 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exec
+
+import "testing"
+
+func TestElementSampler(t *testing.T) {
+	tests := []struct {
+		rate, n int64
+	}{
+		{rate: 1, n: 0},
+		{rate: 1, n: 1234},
+		{rate: 0, n: 1234},
+		{rate: 10, n: 9},
+		{rate: 10, n: 1000},
+		{rate: 7, n: 1234},
+		{rate: 100, n: 100050},
+	}
+	for _, test := range tests {
+		var s elementSampler
+		s.reset(test.rate)
+		for i := int64(0); i < test.n; i++ {
+			s.observe()
+		}
+		// Only unsampled elements at the end of the bundle are missed.
+		rate := test.rate
+		if rate < 1 {
+			rate = 1
+		}
+		if got := s.estimate(); got > test.n || got <= test.n-rate {
+			t.Errorf("1 in %d sampler estimate for %d elements = %d, want in (%d, %d]", test.rate, test.n, got, test.n-rate, test.n)
+		}
+	}
+}
+
+func TestSizeDistribution(t *testing.T) {
+	var d sizeDistribution
+	if got, want := d.snapshot(), (SizeSnapshot{}); got != want {
+		t.Errorf("empty snapshot = %+v, want %+v", got, want)
+	}
+	for _, size := range []int64{7, 3, 12, 5} {
+		d.update(size)
+	}
+	if got, want := d.snapshot(), (SizeSnapshot{Count: 4, Sum: 27, Min: 3, Max: 12}); got != want {
+		t.Errorf("snapshot = %+v, want %+v", got, want)
+	}
+
+	other := SizeSnapshot{Count: 2, Sum: 3, Min: 1, Max: 2}
+	if got, want := d.snapshot().merge(other), (SizeSnapshot{Count: 6, Sum: 30, Min: 1, Max: 12}); got != want {
+		t.Errorf("merge = %+v, want %+v", got, want)
+	}
+	if got, want := (SizeSnapshot{}).merge(other), other; got != want {
+		t.Errorf("merge into empty = %+v, want %+v", got, want)
+	}
+
+	d.reset()
+	if got, want := d.snapshot(), (SizeSnapshot{}); got != want {
+		t.Errorf("snapshot after reset = %+v, want %+v", got, want)
+	}
+}
@@ -23,6 +23,7 @@ import (
 	"math"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/apache/beam/sdks/go/pkg/beam/core/graph/coder"
@@ -46,6 +47,10 @@ type DataSource struct {
 	index     int64
 	splitIdx  int64
 	start     time.Time
+	byteCount int64 // Bytes read from the data channel. Accessed atomically.
+	coderOps  int64 // Elements decoded from the data channel. Accessed atomically.
+	latency   latencyDistribution
+	timed     elementSampler // Selects the elements whose latency is measured.
 
 	// su is non-nil if this DataSource feeds directly to a splittable unit,
 	// and receives that splittable unit when it is available for splitting.
@@ -86,6 +91,10 @@ func (n *DataSource) StartBundle(ctx context.Context, id string, data DataContex
 	n.start = time.Now()
 	n.index = -1
 	n.splitIdx = math.MaxInt64
+	atomic.StoreInt64(&n.byteCount, 0)
+	atomic.StoreInt64(&n.coderOps, 0)
+	n.latency.reset()
+	n.timed.reset(atomic.LoadInt64(&timingSampleRate))
 	n.mu.Unlock()
 	return n.Out.StartBundle(ctx, id, data)
 }
@@ -97,6 +106,7 @@ func (n *DataSource) Process(ctx context.Context) error {
 		return err
 	}
 	defer r.Close()
+	r = &byteCountReader{reader: r, count: &n.byteCount}
 
 	c := coder.SkipW(n.Coder)
 	wc := MakeWindowDecoder(n.Coder.Window)
@@ -132,6 +142,7 @@ func (n *DataSource) Process(ctx context.Context) error {
 		if err != nil {
 			return errors.Wrap(err, "source decode failed")
 		}
+		atomic.AddInt64(&n.coderOps, 1)
 		pe.Timestamp = t
 		pe.Windows = ws
 
@@ -144,9 +155,17 @@ func (n *DataSource) Process(ctx context.Context) error {
 			valReStreams = append(valReStreams, values)
 		}
 
+		if !n.timed.observe() {
+			if err := n.Out.ProcessElement(ctx, pe, valReStreams...); err != nil {
+				return err
+			}
+			continue
+		}
+		start := time.Now()
 		if err := n.Out.ProcessElement(ctx, pe, valReStreams...); err != nil {
 			return err
 		}
+		n.latency.update(time.Since(start))
 	}
 }
 
@@ -260,6 +279,22 @@ func (n *DataSource) incrementIndexAndCheckSplit() bool {
 	return b
 }
 
+// byteCountReader wraps an io.ReadCloser and counts the bytes read from it.
+type byteCountReader struct {
+	reader io.ReadCloser
+	count  *int64
+}
+
+func (r *byteCountReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	atomic.AddInt64(r.count, int64(n))
+	return n, err
+}
+
+func (r *byteCountReader) Close() error {
+	return r.reader.Close()
+}
+
 // ProgressReportSnapshot captures the progress reading an input source.
 //
 // TODO(lostluck) 2020/02/06: Add a visitor pattern for collecting progress
@@ -267,6 +302,69 @@ func (n *DataSource) incrementIndexAndCheckSplit() bool {
 type ProgressReportSnapshot struct {
 	ID, Name, PID string
 	Count         int64
+	ReadBytes     int64 // Bytes read from the data channel.
+
+	// Fraction is the fraction of the bundle's elements completed, and is
+	// only valid if HasFraction is set. The fraction is known once a split
+	// has bounded the number of elements in the bundle.
+	Fraction    float64
+	HasFraction bool
+
+	// Latency summarizes the time taken to process each element read.
+	Latency LatencySnapshot
+}
+
+// LatencySnapshot summarizes the processing latencies of the timed elements,
+// in microseconds.
+type LatencySnapshot struct {
+	Count, Sum, Min, Max int64
+}
+
+// timingSampleRate is the rate elements are timed at. Accessed atomically.
+var timingSampleRate int64 = 16
+
+// SetTimingSampling sets the plan to time 1 in every rate elements, which
+// avoids reading the clock for every element. Latency distributions cover
+// only the timed elements, and wall times scale the timed elements' times by
+// the rate. A rate of 1 or less times every element. Applies to bundles
+// started after the call.
+func SetTimingSampling(rate int64) {
+	if rate < 1 {
+		rate = 1
+	}
+	atomic.StoreInt64(&timingSampleRate, rate)
+}
+
+// latencyDistribution accumulates per element processing latencies.
+type latencyDistribution struct {
+	mu sync.Mutex
+	s  LatencySnapshot
+}
+
+func (d *latencyDistribution) reset() {
+	d.mu.Lock()
+	d.s = LatencySnapshot{}
+	d.mu.Unlock()
+}
+
+func (d *latencyDistribution) update(elapsed time.Duration) {
+	v := elapsed.Microseconds()
+	d.mu.Lock()
+	if d.s.Count == 0 || v < d.s.Min {
+		d.s.Min = v
+	}
+	if d.s.Count == 0 || v > d.s.Max {
+		d.s.Max = v
+	}
+	d.s.Count++
+	d.s.Sum += v
+	d.mu.Unlock()
+}
+
+func (d *latencyDistribution) snapshot() LatencySnapshot {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.s
 }
 
 // Progress returns a snapshot of the source's progress.
@@ -277,13 +375,19 @@ func (n *DataSource) Progress() ProgressReportSnapshot {
 	n.mu.Lock()
 	// The count is the number of "completely processed elements"
 	// which matches the index of the currently processing element.
-	c := n.index
+	c, end := n.index, n.splitIdx
 	n.mu.Unlock()
 	// Do not sent negative progress reports, index is initialized to 0.
 	if c < 0 {
 		c = 0
 	}
-	return ProgressReportSnapshot{PID: n.outputPID, ID: n.SID.PtransformID, Name: n.Name, Count: c}
+	snapshot := ProgressReportSnapshot{PID: n.outputPID, ID: n.SID.PtransformID, Name: n.Name, Count: c, ReadBytes: atomic.LoadInt64(&n.byteCount)}
+	snapshot.Latency = n.latency.snapshot()
+	if end > 0 && end < math.MaxInt64 {
+		snapshot.Fraction = float64(c) / float64(end)
+		snapshot.HasFraction = true
+	}
+	return snapshot
 }
 
 // Split takes a sorted set of potential split indices and a fraction of the
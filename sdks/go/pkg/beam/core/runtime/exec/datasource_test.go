@@ -16,16 +16,21 @@
 package exec
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/apache/beam/sdks/go/pkg/beam/core/graph/coder"
 	"github.com/apache/beam/sdks/go/pkg/beam/core/graph/mtime"
 	"github.com/apache/beam/sdks/go/pkg/beam/core/graph/window"
 	"github.com/apache/beam/sdks/go/pkg/beam/internal/errors"
+	"github.com/google/go-cmp/cmp"
 )
 
 func TestDataSource_PerElement(t *testing.T) {
@@ -363,6 +368,10 @@ func TestDataSource_Split(t *testing.T) {
 					if got, want := source.Progress().Count, test.splitIdx-1; got != want {
 						t.Errorf("error in Progress: got finished processing Count = %v, want %v ", got, want)
 					}
+					// The split bounds the bundle, so the completed fraction is known.
+					if p, want := source.Progress(), float64(test.splitIdx-1)/float64(test.splitIdx); !p.HasFraction || p.Fraction != want {
+						t.Errorf("error in Progress: got Fraction = %v (known: %v), want %v", p.Fraction, p.HasFraction, want)
+					}
 					unblockCh <- struct{}{}
 				}()
 
@@ -586,6 +595,146 @@ func TestDataSource_Split(t *testing.T) {
 	})
 }
 
+func TestPlan_SplitCounts(t *testing.T) {
+	out := &CaptureNode{UID: 1}
+	source := &DataSource{
+		UID:   2,
+		SID:   StreamID{PtransformID: "myPTransform"},
+		Name:  "split",
+		Coder: coder.NewW(coder.NewVarInt(), coder.NewGlobalWindow()),
+		Out:   out,
+	}
+	p, err := NewPlan("a", []Unit{out, source})
+	if err != nil {
+		t.Fatalf("failed to construct plan: %v", err)
+	}
+	if got := p.SplitCounts(); got != nil {
+		t.Errorf("SplitCounts() before splitting = %v, want none", got)
+	}
+	ctx := context.Background()
+	for i, root := range p.units {
+		if err := root.Up(ctx); err != nil {
+			t.Fatalf("error in root[%d].Up: %v", i, err)
+		}
+	}
+	p.status = Active
+	pr, pw := io.Pipe()
+	pw.Close()
+	dc := DataContext{Data: &TestDataManager{R: pr}}
+	runOnRoots(ctx, t, p, "StartBundle", func(root Root, ctx context.Context) error { return root.StartBundle(ctx, "1", dc) })
+
+	for _, idx := range []int64{5, 3} {
+		if _, err := p.Split(SplitPoints{Splits: []int64{0, idx}}); err != nil {
+			t.Fatalf("error in Split: %v", err)
+		}
+	}
+	if got, want := p.SplitCounts()["myPTransform"], int64(2); got != want {
+		t.Errorf("SplitCounts()[myPTransform] = %v, want %v", got, want)
+	}
+}
+
+func TestPlan_CoderOps(t *testing.T) {
+	c := coder.NewW(coder.NewVarInt(), coder.NewGlobalWindow())
+	sink := &DataSink{UID: 1, SID: StreamID{PtransformID: "sink"}, Coder: c}
+	source := &DataSource{UID: 2, SID: StreamID{PtransformID: "source"}, Name: "ops", Coder: c, Out: sink}
+	p, err := NewPlan("a", []Unit{sink, source})
+	if err != nil {
+		t.Fatalf("failed to construct plan: %v", err)
+	}
+
+	for _, n := range []int64{3, 5} {
+		var in bytes.Buffer
+		wc := MakeWindowEncoder(c.Window)
+		ec := MakeElementEncoder(coder.SkipW(c))
+		for i := int64(0); i < n; i++ {
+			EncodeWindowedValueHeader(wc, window.SingleGlobalWindow, mtime.ZeroTimestamp, &in)
+			ec.Encode(&FullValue{Elm: i}, &in)
+		}
+		dc := DataContext{Data: &TestDataManager{R: ioutil.NopCloser(&in), W: &bufferWriteCloser{}}}
+		if err := p.Execute(context.Background(), "1", dc); err != nil {
+			t.Fatalf("execute failed: %v", err)
+		}
+		// Counts are of the latest bundle, with an operation per element.
+		want := map[string]int64{"source": n, "sink": n}
+		if d := cmp.Diff(want, p.CoderOps()); d != "" {
+			t.Errorf("CoderOps() after %d elements diff (-want, +got):\n%v", n, d)
+		}
+	}
+}
+
+// TestDataSource_TimingSampling verifies that only the sampled elements
+// contribute to the latency distribution.
+func TestDataSource_TimingSampling(t *testing.T) {
+	defer SetTimingSampling(atomic.LoadInt64(&timingSampleRate))
+
+	c := coder.NewW(coder.NewVarInt(), coder.NewGlobalWindow())
+	for _, test := range []struct {
+		rate, want int64
+	}{{rate: 1, want: 10}, {rate: 4, want: 2}, {rate: 20, want: 0}} {
+		SetTimingSampling(test.rate)
+		out := &CaptureNode{UID: 1}
+		source := &DataSource{UID: 2, SID: StreamID{PtransformID: "source"}, Name: "timed", Coder: c, Out: out}
+		p, err := NewPlan("a", []Unit{out, source})
+		if err != nil {
+			t.Fatalf("failed to construct plan: %v", err)
+		}
+		var in bytes.Buffer
+		wc := MakeWindowEncoder(c.Window)
+		ec := MakeElementEncoder(coder.SkipW(c))
+		for i := int64(0); i < 10; i++ {
+			EncodeWindowedValueHeader(wc, window.SingleGlobalWindow, mtime.ZeroTimestamp, &in)
+			ec.Encode(&FullValue{Elm: i}, &in)
+		}
+		dc := DataContext{Data: &TestDataManager{R: ioutil.NopCloser(&in)}}
+		if err := p.Execute(context.Background(), "1", dc); err != nil {
+			t.Fatalf("execute failed: %v", err)
+		}
+		if got := source.Progress().Latency.Count; got != test.want {
+			t.Errorf("latency count at rate %d = %v, want %v", test.rate, got, test.want)
+		}
+	}
+}
+
+// TestDataSink_SizeSampling verifies that only the sampled elements
+// contribute to the size distribution.
+func TestDataSink_SizeSampling(t *testing.T) {
+	defer SetSizeSampling(atomic.LoadInt64(&sizeSampleRate))
+
+	c := coder.NewW(coder.NewVarInt(), coder.NewGlobalWindow())
+	for _, test := range []struct {
+		rate, want int64
+	}{{rate: 1, want: 10}, {rate: 4, want: 2}, {rate: 20, want: 0}} {
+		SetSizeSampling(test.rate)
+		sink := &DataSink{UID: 1, SID: StreamID{PtransformID: "sink"}, Coder: c, inputPID: "sizedP"}
+		source := &DataSource{UID: 2, SID: StreamID{PtransformID: "source"}, Name: "sized", Coder: c, Out: sink}
+		p, err := NewPlan("a", []Unit{sink, source})
+		if err != nil {
+			t.Fatalf("failed to construct plan: %v", err)
+		}
+		var in bytes.Buffer
+		wc := MakeWindowEncoder(c.Window)
+		ec := MakeElementEncoder(coder.SkipW(c))
+		for i := int64(0); i < 10; i++ {
+			EncodeWindowedValueHeader(wc, window.SingleGlobalWindow, mtime.ZeroTimestamp, &in)
+			ec.Encode(&FullValue{Elm: i}, &in)
+		}
+		dc := DataContext{Data: &TestDataManager{R: ioutil.NopCloser(&in), W: &bufferWriteCloser{}}}
+		if err := p.Execute(context.Background(), "1", dc); err != nil {
+			t.Fatalf("execute failed: %v", err)
+		}
+		if got := p.DataSinkElementSizes()["sizedP"].Count; got != test.want {
+			t.Errorf("sampled sizes at rate %d = %v, want %v", test.rate, got, test.want)
+		}
+	}
+}
+
+// bufferWriteCloser is an io.WriteCloser that buffers the written bytes.
+type bufferWriteCloser struct {
+	bytes.Buffer
+}
+
+func (w *bufferWriteCloser) Close() error { return nil }
+
 const testTransformId = "transform_id"
 const testInputId = "input_id"
 
@@ -837,6 +986,7 @@ func runOnRoots(ctx context.Context, t *testing.T, p *Plan, name string, mthd fu
 
 type TestDataManager struct {
 	R io.ReadCloser
+	W io.WriteCloser
 }
 
 func (dm *TestDataManager) OpenRead(ctx context.Context, id StreamID) (io.ReadCloser, error) {
@@ -844,7 +994,7 @@ func (dm *TestDataManager) OpenRead(ctx context.Context, id StreamID) (io.ReadCl
 }
 
 func (dm *TestDataManager) OpenWrite(ctx context.Context, id StreamID) (io.WriteCloser, error) {
-	return nil, nil
+	return dm.W, nil
 }
 
 // TestSideInputReader simulates state reads using channels.
@@ -883,3 +1033,20 @@ func validateSource(t *testing.T, out *CaptureNode, source *DataSource, expected
 		t.Errorf("DataSource => %#v, want %#v", extractValues(out.Elements...), extractValues(expected...))
 	}
 }
+
+func TestLatencyDistribution(t *testing.T) {
+	var d latencyDistribution
+	if got, want := d.snapshot(), (LatencySnapshot{}); got != want {
+		t.Errorf("empty latencyDistribution = %+v, want %+v", got, want)
+	}
+	for _, elapsed := range []time.Duration{3 * time.Millisecond, 500 * time.Microsecond, 10 * time.Millisecond, 1500 * time.Nanosecond} {
+		d.update(elapsed)
+	}
+	if got, want := d.snapshot(), (LatencySnapshot{Count: 4, Sum: 13501, Min: 1, Max: 10000}); got != want {
+		t.Errorf("latencyDistribution = %+v, want %+v", got, want)
+	}
+	d.reset()
+	if got, want := d.snapshot(), (LatencySnapshot{}); got != want {
+		t.Errorf("reset latencyDistribution = %+v, want %+v", got, want)
+	}
+}
@@ -19,6 +19,8 @@ import (
 	"context"
 	"fmt"
 	"path"
+	"sync/atomic"
+	"time"
 
 	"github.com/apache/beam/sdks/go/pkg/beam/core/funcx"
 	"github.com/apache/beam/sdks/go/pkg/beam/core/graph"
@@ -46,8 +48,11 @@ type ParDo struct {
 	side  StateReader
 	cache *cacheElm
 
-	status Status
-	err    errorx.GuardedError
+	status   Status
+	err      errorx.GuardedError
+	errCount int64         // Errors the unit failed with this bundle. Accessed atomically.
+	wallTime time.Duration // Time spent invoking the DoFn this bundle. Accessed atomically.
+	clock    *wallClock    // Shared by the ParDos of a plan.
 }
 
 // GetPID returns the PTransformID for this ParDo.
@@ -74,6 +79,9 @@ func (n *ParDo) Up(ctx context.Context) error {
 	}
 	n.status = Up
 	n.inv = newInvoker(n.Fn.ProcessElementFn())
+	if n.clock == nil {
+		n.clock = &wallClock{}
+	}
 
 	// We can't cache the context during Setup since it runs only once per bundle.
 	// Subsequent bundles might run this same node, and the context here would be
@@ -98,6 +106,9 @@ func (n *ParDo) StartBundle(ctx context.Context, id string, data DataContext) er
 	}
 	n.status = Active
 	n.side = data.State
+	// Errors and wall time are reported per bundle.
+	atomic.StoreInt64(&n.errCount, 0)
+	atomic.StoreInt64((*int64)(&n.wallTime), 0)
 	// Allocating contexts all the time is expensive, but we seldom re-write them,
 	// and never accept modified contexts from users, so we will cache them per-bundle
 	// per-unit, to avoid the constant allocation overhead.
@@ -285,7 +296,9 @@ func (n *ParDo) invokeDataFn(ctx context.Context, ws []typex.Window, ts typex.Ev
 	if err := n.preInvoke(ctx, ws, ts); err != nil {
 		return nil, err
 	}
+	m := n.clock.enter(true)
 	val, err := Invoke(ctx, ws, ts, fn, opt, n.cache.extra...)
+	n.clock.exit(m, &n.wallTime)
 	if err != nil {
 		return nil, err
 	}
@@ -300,7 +313,9 @@ func (n *ParDo) invokeProcessFn(ctx context.Context, ws []typex.Window, ts typex
 	if err := n.preInvoke(ctx, ws, ts); err != nil {
 		return nil, err
 	}
+	m := n.clock.enter(false)
 	val, err := n.inv.Invoke(ctx, ws, ts, opt, n.cache.extra...)
+	n.clock.exit(m, &n.wallTime)
 	if err != nil {
 		return nil, err
 	}
@@ -310,6 +325,76 @@ func (n *ParDo) invokeProcessFn(ctx context.Context, ws []typex.Window, ts typex
 	return val, nil
 }
 
+// elapsed returns the estimated wall time spent invoking the DoFn.
+func (n *ParDo) elapsed() time.Duration {
+	return time.Duration(atomic.LoadInt64((*int64)(&n.wallTime)))
+}
+
+// wallClock times the DoFn invocations of the ParDos in a plan. Fused ParDos
+// invoke their downstream ParDos from within their own invocations, so the
+// outermost invocation decides whether an element is timed, and nested
+// invocations are timed along with it. This lets each invocation exclude the
+// time spent in its downstream ParDos. Only accessed by the processing
+// goroutine.
+type wallClock struct {
+	sample elementSampler
+	depth  int
+	scale  int64         // The sampling rate of the current timed element, or 0.
+	child  time.Duration // Time spent in nested invocations of the current one.
+}
+
+// wallNow is the clock wallClocks time invocations with.
+var wallNow = time.Now
+
+// wallMark holds the state of an invocation between enter and exit.
+type wallMark struct {
+	start time.Time
+	child time.Duration
+}
+
+// reset clears the clock for a new bundle, timing 1 in every rate elements.
+func (c *wallClock) reset(rate int64) {
+	c.sample.reset(rate)
+	c.depth = 0
+	c.scale = 0
+	c.child = 0
+}
+
+// enter starts an invocation. Outermost invocations are timed if sampled,
+// or if always is set, as for bundle level invocations.
+func (c *wallClock) enter(always bool) wallMark {
+	if c.depth == 0 {
+		c.scale = 0
+		if always {
+			c.scale = 1
+		} else if c.sample.observe() {
+			c.scale = c.sample.rate
+			if c.scale < 1 {
+				c.scale = 1
+			}
+		}
+	}
+	c.depth++
+	if c.scale == 0 {
+		return wallMark{}
+	}
+	m := wallMark{start: wallNow(), child: c.child}
+	c.child = 0
+	return m
+}
+
+// exit ends the invocation started by m, adding its time, less the time
+// spent in nested invocations and scaled by the sampling rate, to total.
+func (c *wallClock) exit(m wallMark, total *time.Duration) {
+	c.depth--
+	if c.scale == 0 {
+		return
+	}
+	d := wallNow().Sub(m.start)
+	atomic.AddInt64((*int64)(total), int64(d-c.child)*c.scale)
+	c.child = m.child + d
+}
+
 func (n *ParDo) preInvoke(ctx context.Context, ws []typex.Window, ts typex.EventTime) error {
 	for _, e := range n.emitters {
 		if err := e.Init(ctx, ws, ts); err != nil {
@@ -331,9 +416,15 @@ func (n *ParDo) postInvoke() error {
 func (n *ParDo) fail(err error) error {
 	n.status = Broken
 	n.err.TrySetError(err)
+	atomic.AddInt64(&n.errCount, 1)
 	return err
 }
 
+// errorCount returns the number of errors the ParDo has failed with.
+func (n *ParDo) errorCount() int64 {
+	return atomic.LoadInt64(&n.errCount)
+}
+
 func (n *ParDo) String() string {
 	return fmt.Sprintf("ParDo[%v] Out:%v", path.Base(n.Fn.Name()), IDs(n.Out...))
 }
@@ -17,13 +17,18 @@ package exec
 
 import (
 	"context"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/apache/beam/sdks/go/pkg/beam/core/graph"
 	"github.com/apache/beam/sdks/go/pkg/beam/core/graph/mtime"
 	"github.com/apache/beam/sdks/go/pkg/beam/core/graph/window"
+	"github.com/apache/beam/sdks/go/pkg/beam/core/metrics"
 	"github.com/apache/beam/sdks/go/pkg/beam/core/typex"
 	"github.com/apache/beam/sdks/go/pkg/beam/core/util/reflectx"
+	"github.com/apache/beam/sdks/go/pkg/beam/internal/errors"
+	"github.com/google/go-cmp/cmp"
 )
 
 func sumFn(n int, a int, b []int, c func(*int) bool, d func() func(*int) bool, e func(int)) int {
@@ -97,6 +102,135 @@ func TestParDo(t *testing.T) {
 	}
 }
 
+func failFn(n int) error {
+	return errors.Errorf("failed on %v", n)
+}
+
+// TestParDo_ErrorCounts verifies that the plan counts the errors a ParDo fails with.
+func TestParDo_ErrorCounts(t *testing.T) {
+	fn, err := graph.NewDoFn(failFn)
+	if err != nil {
+		t.Fatalf("invalid function: %v", err)
+	}
+
+	g := graph.New()
+	nN := g.NewNode(typex.New(reflectx.Int), window.DefaultWindowingStrategy(), true)
+	edge, err := graph.NewParDo(g, g.Root(), fn, []*graph.Node{nN}, nil, nil)
+	if err != nil {
+		t.Fatalf("invalid pardo: %v", err)
+	}
+
+	pardo := &ParDo{UID: 1, PID: "fail", Fn: edge.DoFn, Inbound: edge.Input}
+	n := &FixedRoot{UID: 2, Elements: makeInput(10, 20, 30), Out: pardo}
+	p, err := NewPlan("a", []Unit{n, pardo})
+	if err != nil {
+		t.Fatalf("failed to construct plan: %v", err)
+	}
+	if got := p.ErrorCounts(); got != nil {
+		t.Errorf("ErrorCounts() before execution = %v, want none", got)
+	}
+
+	if err := p.Execute(context.Background(), "1", DataContext{}); err == nil {
+		t.Fatal("execute succeeded, want the DoFn's error")
+	}
+	if got, want := p.ErrorCounts()["fail"], int64(1); got != want {
+		t.Errorf("ErrorCounts()[fail] = %v, want %v", got, want)
+	}
+}
+
+func retryFn(ctx context.Context, n int) {
+	metrics.CountError(ctx)
+}
+
+// TestParDo_HandledErrorCounts verifies that the plan counts the errors a
+// DoFn handles without failing the bundle, per bundle.
+func TestParDo_HandledErrorCounts(t *testing.T) {
+	fn, err := graph.NewDoFn(retryFn)
+	if err != nil {
+		t.Fatalf("invalid function: %v", err)
+	}
+
+	g := graph.New()
+	nN := g.NewNode(typex.New(reflectx.Int), window.DefaultWindowingStrategy(), true)
+	edge, err := graph.NewParDo(g, g.Root(), fn, []*graph.Node{nN}, nil, nil)
+	if err != nil {
+		t.Fatalf("invalid pardo: %v", err)
+	}
+
+	pardo := &ParDo{UID: 1, PID: "retry", Fn: edge.DoFn, Inbound: edge.Input}
+	n := &FixedRoot{UID: 2, Elements: makeInput(10, 20, 30), Out: pardo}
+	p, err := NewPlan("a", []Unit{n, pardo})
+	if err != nil {
+		t.Fatalf("failed to construct plan: %v", err)
+	}
+	for _, id := range []string{"1", "2"} {
+		if err := p.Execute(context.Background(), id, DataContext{}); err != nil {
+			t.Fatalf("execute failed: %v", err)
+		}
+		if got, want := p.ErrorCounts()["retry"], int64(3); got != want {
+			t.Errorf("ErrorCounts()[retry] in bundle %v = %v, want %v", id, got, want)
+		}
+		if got, want := p.BundleCounts()["retry"], int64(1); got != want {
+			t.Errorf("BundleCounts()[retry] in bundle %v = %v, want %v", id, got, want)
+		}
+	}
+}
+
+// wallTestClock is the fake clock of TestParDo_WallTimes, advanced by the
+// DoFns rather than by sleeping.
+var wallTestClock time.Time
+
+func waitFn(n int) {
+	wallTestClock = wallTestClock.Add(time.Duration(n) * time.Millisecond)
+}
+
+func waitEmitFn(n int, emit func(int)) {
+	wallTestClock = wallTestClock.Add(time.Duration(n) * time.Millisecond)
+	emit(4 * n)
+}
+
+// TestParDo_WallTimes verifies that the plan measures the wall time spent in a
+// ParDo, including time the DoFn spends waiting rather than using the CPU, but
+// excluding the time its downstream ParDos spend on its outputs.
+func TestParDo_WallTimes(t *testing.T) {
+	defer SetTimingSampling(atomic.LoadInt64(&timingSampleRate))
+	SetTimingSampling(1)
+	defer func(old func() time.Time) { wallNow = old }(wallNow)
+	wallNow = func() time.Time { return wallTestClock }
+
+	g := graph.New()
+	nN := g.NewNode(typex.New(reflectx.Int), window.DefaultWindowingStrategy(), true)
+	makeEdge := func(dofn interface{}) *graph.MultiEdge {
+		fn, err := graph.NewDoFn(dofn)
+		if err != nil {
+			t.Fatalf("invalid function: %v", err)
+		}
+		edge, err := graph.NewParDo(g, g.Root(), fn, []*graph.Node{nN}, nil, nil)
+		if err != nil {
+			t.Fatalf("invalid pardo: %v", err)
+		}
+		return edge
+	}
+	up, down := makeEdge(waitEmitFn), makeEdge(waitFn)
+
+	downstream := &ParDo{UID: 1, PID: "downstream", Fn: down.DoFn, Inbound: down.Input}
+	upstream := &ParDo{UID: 2, PID: "upstream", Fn: up.DoFn, Inbound: up.Input, Out: []Node{downstream}}
+	n := &FixedRoot{UID: 3, Elements: makeInput(10, 20, 30), Out: upstream}
+	p, err := NewPlan("a", []Unit{n, upstream, downstream})
+	if err != nil {
+		t.Fatalf("failed to construct plan: %v", err)
+	}
+	if err := p.Execute(context.Background(), "1", DataContext{}); err != nil {
+		t.Fatalf("execute failed: %v", err)
+	}
+
+	// The upstream time excludes the 240ms its downstream ParDo spent.
+	want := map[string]time.Duration{"upstream": 60 * time.Millisecond, "downstream": 240 * time.Millisecond}
+	if d := cmp.Diff(want, p.WallTimes()); d != "" {
+		t.Errorf("WallTimes() diff (-want, +got):\n%v", d)
+	}
+}
+
 func emitSumFn(n int, emit func(int)) {
 	emit(n + 1)
 }
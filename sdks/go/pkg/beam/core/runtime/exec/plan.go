@@ -22,6 +22,8 @@ import (
 	"fmt"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/apache/beam/sdks/go/pkg/beam/core/metrics"
 	"github.com/apache/beam/sdks/go/pkg/beam/internal/errors"
@@ -36,7 +38,9 @@ type Plan struct {
 	units    []Unit
 	parDoIDs []string
 
-	status Status
+	status  Status
+	bundles int64      // 1 once the plan has started a bundle. Accessed atomically.
+	clock   *wallClock // Times the plan's ParDos.
 
 	// While the store is threadsafe, the reference to it
 	// is not, so we need to protect the store field to be
@@ -44,8 +48,13 @@ type Plan struct {
 	storeMu sync.Mutex
 	store   *metrics.Store
 
+	// Dynamic splits performed, by transform. Guarded by splitMu.
+	splitMu sync.Mutex
+	splits  map[string]int64
+
 	// TODO: there can be more than 1 DataSource in a bundle.
 	source *DataSource
+	sinks  []*DataSink
 }
 
 // hasPID provides a common interface for extracting PTransformIDs
@@ -58,7 +67,9 @@ type hasPID interface {
 func NewPlan(id string, units []Unit) (*Plan, error) {
 	var roots []Root
 	var source *DataSource
+	var sinks []*DataSink
 	var pardoIDs []string
+	clock := &wallClock{}
 
 	for _, u := range units {
 		if u == nil {
@@ -70,9 +81,18 @@ func NewPlan(id string, units []Unit) (*Plan, error) {
 		if s, ok := u.(*DataSource); ok {
 			source = s
 		}
+		if s, ok := u.(*DataSink); ok {
+			sinks = append(sinks, s)
+		}
 		if p, ok := u.(hasPID); ok {
 			pardoIDs = append(pardoIDs, p.GetPID())
 		}
+		switch n := u.(type) {
+		case *ParDo:
+			n.clock = clock
+		case *ProcessSizedElementsAndRestrictions:
+			n.PDo.clock = clock
+		}
 	}
 	if len(roots) == 0 {
 		return nil, errors.Errorf("no root units")
@@ -85,6 +105,8 @@ func NewPlan(id string, units []Unit) (*Plan, error) {
 		units:    units,
 		parDoIDs: pardoIDs,
 		source:   source,
+		sinks:    sinks,
+		clock:    clock,
 	}, nil
 }
 
@@ -126,6 +148,11 @@ func (p *Plan) Execute(ctx context.Context, id string, manager DataContext) erro
 	// Process bundle. If there are any kinds of failures, we bail and mark the plan broken.
 
 	p.status = Active
+	atomic.StoreInt64(&p.bundles, 1)
+	p.splitMu.Lock()
+	p.splits = nil
+	p.splitMu.Unlock()
+	p.clock.reset(atomic.LoadInt64(&timingSampleRate))
 	for _, root := range p.roots {
 		if err := callNoPanic(ctx, func(ctx context.Context) error { return root.StartBundle(ctx, id, manager) }); err != nil {
 			p.status = Broken
@@ -189,6 +216,151 @@ func (p *Plan) Progress() (ProgressReportSnapshot, bool) {
 	return ProgressReportSnapshot{}, false
 }
 
+// DataSinkElements returns the number of elements written to the data
+// channel by the plan's DataSinks, keyed by the PCollection ID of their
+// input. Counts are estimates if element count sampling is enabled.
+func (p *Plan) DataSinkElements() map[string]int64 {
+	if len(p.sinks) == 0 {
+		return nil
+	}
+	m := make(map[string]int64, len(p.sinks))
+	for _, s := range p.sinks {
+		m[s.inputPID] += s.count.estimate()
+	}
+	return m
+}
+
+// DataSinkElementSizes returns the distribution of encoded sizes of the
+// elements sampled by the plan's DataSinks, keyed by the PCollection ID of
+// their input. See SetSizeSampling.
+func (p *Plan) DataSinkElementSizes() map[string]SizeSnapshot {
+	if len(p.sinks) == 0 {
+		return nil
+	}
+	m := make(map[string]SizeSnapshot, len(p.sinks))
+	for _, s := range p.sinks {
+		m[s.inputPID] = m[s.inputPID].merge(s.sizes.snapshot())
+	}
+	return m
+}
+
+// DataSinkBytes returns the number of bytes written to the data channel
+// by the plan's DataSinks, keyed by the PCollection ID of their input.
+func (p *Plan) DataSinkBytes() map[string]int64 {
+	if len(p.sinks) == 0 {
+		return nil
+	}
+	m := make(map[string]int64, len(p.sinks))
+	for _, s := range p.sinks {
+		m[s.inputPID] += atomic.LoadInt64(&s.byteCount)
+	}
+	return m
+}
+
+// CoderOps returns the number of elements the plan's DataSource decoded
+// and DataSinks encoded in the current or last bundle, keyed by their
+// transform ID. Values of grouped elements are decoded with their key, and
+// count as a single operation.
+func (p *Plan) CoderOps() map[string]int64 {
+	if p.source == nil && len(p.sinks) == 0 {
+		return nil
+	}
+	m := make(map[string]int64, len(p.sinks)+1)
+	if p.source != nil {
+		m[p.source.SID.PtransformID] = atomic.LoadInt64(&p.source.coderOps)
+	}
+	for _, s := range p.sinks {
+		m[s.SID.PtransformID] += atomic.LoadInt64(&s.coderOps)
+	}
+	return m
+}
+
+// BundleCounts returns the number of bundles each transform of the plan has
+// participated in, keyed by transform ID. Like the plan's other metrics, the
+// counts are of the current bundle, so they're 1 once the plan has started a
+// bundle, and sum to the total across bundles. Every transform of the plan
+// participates in every bundle the plan executes.
+func (p *Plan) BundleCounts() map[string]int64 {
+	n := atomic.LoadInt64(&p.bundles)
+	if n == 0 {
+		return nil
+	}
+	m := make(map[string]int64, len(p.parDoIDs)+len(p.sinks)+1)
+	for _, id := range p.parDoIDs {
+		m[id] = n
+	}
+	if p.source != nil {
+		m[p.source.SID.PtransformID] = n
+	}
+	for _, s := range p.sinks {
+		m[s.SID.PtransformID] = n
+	}
+	return m
+}
+
+// errorCounter is implemented by units that count the errors they fail with.
+type errorCounter interface {
+	hasPID
+	errorCount() int64
+}
+
+// ErrorCounts returns the number of errors each transform of the plan has
+// failed with, or handled and counted with metrics.CountError, in the
+// current bundle, keyed by transform ID. Transforms without errors are
+// omitted.
+func (p *Plan) ErrorCounts() map[string]int64 {
+	p.storeMu.Lock()
+	store := p.store
+	p.storeMu.Unlock()
+	var m map[string]int64
+	if store != nil {
+		m = store.ErrorCounts()
+	}
+	for _, u := range p.units {
+		c, ok := u.(errorCounter)
+		if !ok {
+			continue
+		}
+		if n := c.errorCount(); n > 0 {
+			if m == nil {
+				m = make(map[string]int64)
+			}
+			m[c.GetPID()] += n
+		}
+	}
+	return m
+}
+
+// wallTimer is implemented by units that measure the wall time spent
+// invoking their user functions.
+type wallTimer interface {
+	hasPID
+	elapsed() time.Duration
+}
+
+// WallTimes returns the wall clock time spent in each transform of the
+// plan in the current bundle, keyed by transform ID. Unlike CPU time, it includes time spent
+// waiting, such as on I/O. A transform's time excludes the time its
+// downstream transforms spent processing its outputs. Per element times
+// are estimated from the elements sampled at the rate set by
+// SetTimingSampling. Transforms that haven't been invoked are omitted.
+func (p *Plan) WallTimes() map[string]time.Duration {
+	var m map[string]time.Duration
+	for _, u := range p.units {
+		w, ok := u.(wallTimer)
+		if !ok {
+			continue
+		}
+		if d := w.elapsed(); d > 0 {
+			if m == nil {
+				m = make(map[string]time.Duration)
+			}
+			m[w.GetPID()] += d
+		}
+	}
+	return m
+}
+
 // Store returns the metric store for the last use of this plan.
 func (p *Plan) Store() *metrics.Store {
 	p.storeMu.Lock()
@@ -196,6 +368,15 @@ func (p *Plan) Store() *metrics.Store {
 	return p.store
 }
 
+// ResetStore drops the metric store of the plan's last bundle, so its
+// metrics aren't reported again once the bundle has completed. The next
+// execution of the plan starts a new store regardless.
+func (p *Plan) ResetStore() {
+	p.storeMu.Lock()
+	defer p.storeMu.Unlock()
+	p.store = nil
+}
+
 // SplitPoints captures the split requested by the Runner.
 type SplitPoints struct {
 	// Splits is a list of desired split indices.
@@ -228,7 +409,43 @@ func (p *Plan) Split(s SplitPoints) (SplitResult, error) {
 	// TODO: When bundles with multiple sources, are supported, perform splits
 	// on all sources.
 	if p.source != nil {
-		return p.source.Split(s.Splits, s.Frac, s.BufSize)
+		res, err := p.source.Split(s.Splits, s.Frac, s.BufSize)
+		if err == nil {
+			p.countSplit(res)
+		}
+		return res, err
 	}
 	return SplitResult{}, fmt.Errorf("failed to split at requested splits: {%v}, Source not initialized", s)
 }
+
+// countSplit counts a dynamic split. Sub-element splits are attributed to
+// the transform whose element was split, and channel splits to the source.
+func (p *Plan) countSplit(res SplitResult) {
+	id := res.TId
+	if id == "" {
+		id = p.source.SID.PtransformID
+	}
+	p.splitMu.Lock()
+	defer p.splitMu.Unlock()
+	if p.splits == nil {
+		p.splits = make(map[string]int64)
+	}
+	p.splits[id]++
+}
+
+// SplitCounts returns the number of dynamic splits the plan has performed
+// in the current bundle, keyed by transform ID. Sub-element splits, such as of splittable DoFns,
+// count towards the transform whose element was split, and channel splits
+// towards the DataSource. Transforms without splits are omitted.
+func (p *Plan) SplitCounts() map[string]int64 {
+	p.splitMu.Lock()
+	defer p.splitMu.Unlock()
+	if len(p.splits) == 0 {
+		return nil
+	}
+	m := make(map[string]int64, len(p.splits))
+	for id, n := range p.splits {
+		m[id] = n
+	}
+	return m
+}
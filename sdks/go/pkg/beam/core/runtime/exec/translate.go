@@ -544,6 +544,7 @@ func (b *builder) makeLink(from string, id linkID) (Node, error) {
 
 		sink := &DataSink{UID: b.idgen.New()}
 		sink.SID = StreamID{PtransformID: id.to, Port: port}
+		sink.inputPID = from
 		sink.Coder, err = b.coders.Coder(cid) // Expected to be windowed coder
 		if err != nil {
 			return nil, err
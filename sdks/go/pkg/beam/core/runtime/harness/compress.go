@@ -0,0 +1,158 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package harness
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync/atomic"
+
+	"github.com/apache/beam/sdks/go/pkg/beam/internal/errors"
+)
+
+// CompressedPayloadsKey is the capability runners advertise to accept
+// compressed payloads, and the key under which payloads are sent when
+// compressed. Short ids never contain colons, so it can't collide with one.
+const CompressedPayloadsKey = "beam:protocol:monitoring_data_gzip:v1"
+
+// payloadCompression is whether payloads are compressed in responses.
+// Accessed atomically.
+var payloadCompression int32
+
+// SetPayloadCompression sets whether the short id keyed payloads of
+// progress and bundle responses are sent gzip compressed, reducing the size
+// of responses with large metric sets. Must only be enabled for runners
+// advertising the CompressedPayloadsKey capability, as others won't
+// decompress them. Disabled by default.
+func SetPayloadCompression(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&payloadCompression, v)
+}
+
+// responsePayloads returns the payloads to send in a response, with
+// counters packed and then compressed, if enabled. Payloads are sent
+// unpacked if packing fails, and uncompressed if compression fails, or
+// wouldn't make them smaller.
+func responsePayloads(payloads map[string][]byte) (map[string][]byte, error) {
+	if atomic.LoadInt32(&counterPacking) != 0 && len(payloads) > 0 {
+		packed, err := packPayloads(payloads)
+		if err != nil {
+			return payloads, err
+		}
+		payloads = packed
+	}
+	if atomic.LoadInt32(&payloadCompression) == 0 || len(payloads) == 0 {
+		return payloads, nil
+	}
+	compressed, err := compressPayloads(payloads)
+	if err != nil {
+		return payloads, err
+	}
+	if PayloadsSize(compressed) >= PayloadsSize(payloads) {
+		return payloads, nil
+	}
+	return compressed, nil
+}
+
+// compressPayloads concatenates the payloads in short id order, each as a
+// varint length prefixed short id followed by its varint length prefixed
+// payload, and returns the gzip compressed result under
+// CompressedPayloadsKey.
+func compressPayloads(payloads map[string][]byte) (map[string][]byte, error) {
+	ids := make([]string, 0, len(payloads))
+	for id := range payloads {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	var prefix [binary.MaxVarintLen64]byte
+	for _, id := range ids {
+		for _, b := range [][]byte{[]byte(id), payloads[id]} {
+			n := binary.PutUvarint(prefix[:], uint64(len(b)))
+			if _, err := zw.Write(prefix[:n]); err != nil {
+				return nil, errors.Wrap(err, "failed to compress payloads")
+			}
+			if _, err := zw.Write(b); err != nil {
+				return nil, errors.Wrap(err, "failed to compress payloads")
+			}
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, errors.Wrap(err, "failed to compress payloads")
+	}
+	return map[string][]byte{CompressedPayloadsKey: buf.Bytes()}, nil
+}
+
+// DecompressPayloads returns the short id keyed payloads of a response,
+// decompressing them if they were sent compressed. Payloads that weren't
+// compressed are returned as is.
+func DecompressPayloads(payloads map[string][]byte) (map[string][]byte, error) {
+	compressed, ok := payloads[CompressedPayloadsKey]
+	if !ok {
+		return payloads, nil
+	}
+	if len(payloads) != 1 {
+		return nil, errors.Errorf("compressed payloads sent with %d other payloads", len(payloads)-1)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decompress payloads")
+	}
+	r := bufio.NewReader(zr)
+	ret := make(map[string][]byte)
+	for {
+		id, err := readPrefixed(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to decompress payloads")
+		}
+		payload, err := readPrefixed(r)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to decompress payload for short id %v", string(id))
+		}
+		ret[string(id)] = payload
+	}
+	return ret, nil
+}
+
+// readPrefixed reads a varint length prefixed byte slice from r. Returns
+// io.EOF only if r is exhausted before the prefix.
+func readPrefixed(r *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(r, int64(n)))
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(b)) != n {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return b, nil
+}
@@ -0,0 +1,123 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package harness
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// largePayloads returns n counter payloads keyed by short id.
+func largePayloads(t *testing.T, n int) map[string][]byte {
+	t.Helper()
+	payloads := make(map[string][]byte, n)
+	for i := 0; i < n; i++ {
+		payload, err := int64Counter(int64(i % 100))
+		if err != nil {
+			t.Fatalf("int64Counter(%d) failed: %v", i, err)
+		}
+		payloads[strconv.Itoa(i+1)] = payload
+	}
+	// An empty payload must round trip too.
+	payloads["0"] = []byte{}
+	return payloads
+}
+
+func TestCompressPayloads(t *testing.T) {
+	payloads := largePayloads(t, 10000)
+	compressed, err := compressPayloads(payloads)
+	if err != nil {
+		t.Fatalf("compressPayloads failed: %v", err)
+	}
+	if _, ok := compressed[CompressedPayloadsKey]; !ok || len(compressed) != 1 {
+		t.Fatalf("compressPayloads returned %d payloads, want only %v", len(compressed), CompressedPayloadsKey)
+	}
+	if got, orig := PayloadsSize(compressed), PayloadsSize(payloads); got >= orig {
+		t.Errorf("compressed payloads are %d bytes, want fewer than %d", got, orig)
+	}
+	got, err := DecompressPayloads(compressed)
+	if err != nil {
+		t.Fatalf("DecompressPayloads failed: %v", err)
+	}
+	if d := cmp.Diff(payloads, got); d != "" {
+		t.Errorf("round tripped payloads diff (-want, +got):\n%v", d)
+	}
+}
+
+func TestDecompressPayloads_Uncompressed(t *testing.T) {
+	payloads := largePayloads(t, 3)
+	got, err := DecompressPayloads(payloads)
+	if err != nil {
+		t.Fatalf("DecompressPayloads failed: %v", err)
+	}
+	if d := cmp.Diff(payloads, got); d != "" {
+		t.Errorf("DecompressPayloads of uncompressed payloads diff (-want, +got):\n%v", d)
+	}
+}
+
+func TestDecompressPayloads_Invalid(t *testing.T) {
+	compressed, err := compressPayloads(largePayloads(t, 3))
+	if err != nil {
+		t.Fatalf("compressPayloads failed: %v", err)
+	}
+	z := compressed[CompressedPayloadsKey]
+	tests := map[string]map[string][]byte{
+		"not gzip":  {CompressedPayloadsKey: []byte("payloads")},
+		"truncated": {CompressedPayloadsKey: z[:len(z)/2]},
+		"mixed":     {CompressedPayloadsKey: z, "1": {1}},
+	}
+	for name, payloads := range tests {
+		if _, err := DecompressPayloads(payloads); err == nil {
+			t.Errorf("DecompressPayloads(%v) succeeded, want error", name)
+		}
+	}
+}
+
+func TestResponsePayloads(t *testing.T) {
+	defer SetPayloadCompression(false)
+	payloads := largePayloads(t, 1000)
+
+	got, err := responsePayloads(payloads)
+	if err != nil {
+		t.Fatalf("responsePayloads failed: %v", err)
+	}
+	if _, ok := got[CompressedPayloadsKey]; ok {
+		t.Errorf("responsePayloads compressed payloads with compression disabled")
+	}
+
+	SetPayloadCompression(true)
+	got, err = responsePayloads(payloads)
+	if err != nil {
+		t.Fatalf("responsePayloads failed: %v", err)
+	}
+	if _, ok := got[CompressedPayloadsKey]; !ok {
+		t.Errorf("responsePayloads didn't compress payloads with compression enabled")
+	}
+	if got, err = DecompressPayloads(got); err != nil {
+		t.Fatalf("DecompressPayloads failed: %v", err)
+	}
+	if d := cmp.Diff(payloads, got); d != "" {
+		t.Errorf("round tripped payloads diff (-want, +got):\n%v", d)
+	}
+
+	// Compression that doesn't save space is skipped.
+	small := map[string][]byte{"1": {1}}
+	if got, _ := responsePayloads(small); !cmp.Equal(small, got) {
+		t.Errorf("responsePayloads(%v) = %v, want it uncompressed", small, got)
+	}
+}
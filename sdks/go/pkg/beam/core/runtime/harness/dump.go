@@ -0,0 +1,308 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package harness
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/apache/beam/sdks/go/pkg/beam/core/runtime/exec"
+	pipepb "github.com/apache/beam/sdks/go/pkg/beam/model/pipeline_v1"
+	"github.com/golang/protobuf/proto"
+)
+
+// jsonInfo is the JSON representation of a MonitoringInfo with its
+// decoded value.
+type jsonInfo struct {
+	Urn    string            `json:"urn"`
+	Type   string            `json:"type"`
+	Labels map[string]string `json:"labels"`
+	Value  interface{}       `json:"value,omitempty"`
+	// Payload is only set when the payload type can't be decoded.
+	Payload []byte `json:"payload,omitempty"`
+}
+
+// DumpMonitoringJSON is a debugging function that extracts the current
+// metrics of the plan, and returns them as JSON with their decoded values.
+// Metrics are sorted by urn, then labels.
+//
+// This is intended for human consumption, and isn't part of the FnAPI
+// protocol.
+func DumpMonitoringJSON(p *exec.Plan) ([]byte, error) {
+	mons, err := peekMonitoring(p)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]jsonInfo, 0, len(mons))
+	for _, mi := range mons {
+		info := jsonInfo{
+			Urn:    mi.GetUrn(),
+			Type:   mi.GetType(),
+			Labels: mi.GetLabels(),
+		}
+		if v, err := decodePayload(mi.GetType(), mi.GetPayload()); err == nil {
+			info.Value = v
+		} else {
+			info.Payload = mi.GetPayload()
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Urn != infos[j].Urn {
+			return infos[i].Urn < infos[j].Urn
+		}
+		return fmt.Sprint(infos[i].Labels) < fmt.Sprint(infos[j].Labels)
+	})
+	return json.MarshalIndent(infos, "", "  ")
+}
+
+// MonitoringTextProto extracts the current metrics of the plan, and renders
+// them as the monitoring_infos of a ProcessBundleResponse in text proto
+// format, for readable golden file tests. Each MonitoringInfo is followed
+// by a comment holding its decoded value.
+//
+// The output is deterministic: metrics are sorted by urn, then labels, and
+// worker level metrics such as the heartbeat, whose values change with
+// every call, are omitted.
+func MonitoringTextProto(p *exec.Plan) (string, error) {
+	mons, err := peekMonitoring(p)
+	if err != nil {
+		return "", err
+	}
+	return monitoringText(mons), nil
+}
+
+// monitoringText renders the MonitoringInfos for MonitoringTextProto.
+func monitoringText(mons []*pipepb.MonitoringInfo) string {
+	infos := make([]*pipepb.MonitoringInfo, 0, len(mons))
+	for _, mi := range mons {
+		switch mi.GetUrn() {
+		case sUrns[urnWorkerHeartbeat], sUrns[urnWorkerCPUSeconds], sUrns[urnWorkerMaxRSSBytes]:
+			continue
+		}
+		infos = append(infos, mi)
+	}
+	sortInfos(infos)
+
+	var b strings.Builder
+	for _, mi := range infos {
+		b.WriteString("monitoring_infos {\n")
+		for _, line := range strings.SplitAfter(proto.MarshalTextString(mi), "\n") {
+			if line != "" {
+				b.WriteString("  " + line)
+			}
+		}
+		if v, err := decodePayload(mi.GetType(), mi.GetPayload()); err == nil {
+			fmt.Fprintf(&b, "  # value: %v\n", v)
+		}
+		b.WriteString("}\n")
+	}
+	return b.String()
+}
+
+// PrintMetrics is a debugging function that extracts the current metrics
+// of the plan, and prints one line per metric to w, in the form
+//
+//	urn labels=KEY=value,... value=decoded
+//
+// for eyeballing metrics in local runs without a metrics backend. Metrics
+// are sorted by urn, then labels. Metrics whose payloads can't be decoded
+// are printed with their raw payload in hex instead of a value.
+func PrintMetrics(w io.Writer, p *exec.Plan) error {
+	mons, err := peekMonitoring(p)
+	if err != nil {
+		return err
+	}
+	return printMetrics(w, mons)
+}
+
+// printMetrics prints the MonitoringInfos for PrintMetrics.
+func printMetrics(w io.Writer, mons []*pipepb.MonitoringInfo) error {
+	infos := append([]*pipepb.MonitoringInfo(nil), mons...)
+	sortInfos(infos)
+
+	var buf bytes.Buffer
+	for _, mi := range infos {
+		fmt.Fprintf(&buf, "%s labels=%s ", mi.GetUrn(), joinLabels(mi.GetLabels()))
+		if v, err := decodePayload(mi.GetType(), mi.GetPayload()); err == nil {
+			fmt.Fprintf(&buf, "value=%v\n", v)
+		} else {
+			fmt.Fprintf(&buf, "payload=%x\n", mi.GetPayload())
+		}
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// ShortIDCacheHandler serves the short ids the harness has assigned as a
+// plain text table of each short id's urn, type and labels, to diagnose
+// metric cardinality issues live. The cache is snapshotted under its locks.
+func ShortIDCacheHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(shortIDTable(ShortIDSnapshot()))
+}
+
+// shortIDTable renders the short id metadata as a table, in short id order.
+func shortIDTable(infos map[string]*pipepb.MonitoringInfo) []byte {
+	ids := make([]string, 0, len(infos))
+	for id := range infos {
+		ids = append(ids, id)
+	}
+	// Short ids are base 36 numbers, so shorter ids are smaller.
+	sort.Slice(ids, func(i, j int) bool {
+		if len(ids[i]) != len(ids[j]) {
+			return len(ids[i]) < len(ids[j])
+		}
+		return ids[i] < ids[j]
+	})
+
+	var buf bytes.Buffer
+	tw := tabwriter.NewWriter(&buf, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "SHORT ID\tURN\tTYPE\tLABELS")
+	for _, id := range ids {
+		mi := infos[id]
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", id, mi.GetUrn(), mi.GetType(), joinLabels(mi.GetLabels()))
+	}
+	tw.Flush()
+	return buf.Bytes()
+}
+
+// joinLabels renders the labels as comma separated KEY=value pairs, sorted.
+func joinLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// sortInfos sorts the MonitoringInfos by urn, then labels.
+func sortInfos(infos []*pipepb.MonitoringInfo) {
+	labels := make(map[*pipepb.MonitoringInfo]string, len(infos))
+	for _, mi := range infos {
+		labels[mi] = labelsKey(mi)
+	}
+	sort.SliceStable(infos, func(i, j int) bool {
+		if infos[i].GetUrn() != infos[j].GetUrn() {
+			return infos[i].GetUrn() < infos[j].GetUrn()
+		}
+		return labels[infos[i]] < labels[infos[j]]
+	})
+}
+
+// labelsKey returns a string identifying the labels of the MonitoringInfo.
+// Text marshalling sorts map keys, so equal labels have equal keys.
+func labelsKey(mi *pipepb.MonitoringInfo) string {
+	return proto.CompactTextString(&pipepb.MonitoringInfo{Labels: mi.GetLabels()})
+}
+
+// InfoDiffKind is the kind of difference DiffInfos found for a metric.
+type InfoDiffKind int
+
+// The kinds of differences between two sets of MonitoringInfos.
+const (
+	InfoAdded InfoDiffKind = iota
+	InfoRemoved
+	InfoChanged
+)
+
+func (k InfoDiffKind) String() string {
+	switch k {
+	case InfoAdded:
+		return "added"
+	case InfoRemoved:
+		return "removed"
+	case InfoChanged:
+		return "changed"
+	default:
+		return fmt.Sprintf("InfoDiffKind(%d)", int(k))
+	}
+}
+
+// InfoDiff is a difference DiffInfos found for a metric.
+type InfoDiff struct {
+	Kind   InfoDiffKind
+	Urn    string
+	Labels map[string]string
+	// Old and New are the decoded values of the metric in each set, or nil
+	// if it's absent from the set. Payloads that can't be decoded are
+	// reported as their raw bytes.
+	Old, New interface{}
+}
+
+func (d InfoDiff) String() string {
+	return fmt.Sprintf("%v %v%v: %v -> %v", d.Kind, d.Urn, d.Labels, d.Old, d.New)
+}
+
+// DiffInfos is a debugging function that compares two sets of
+// MonitoringInfos, such as metrics extracted at different times. Metrics
+// are matched by urn and labels, the metadata a short id identifies, and
+// those added in b, removed from a, or whose payloads changed, are
+// reported. Diffs are sorted by urn, then labels.
+func DiffInfos(a, b []*pipepb.MonitoringInfo) []InfoDiff {
+	type key struct{ urn, labels string }
+	keyOf := func(mi *pipepb.MonitoringInfo) key {
+		return key{mi.GetUrn(), labelsKey(mi)}
+	}
+	old := make(map[key]*pipepb.MonitoringInfo, len(a))
+	for _, mi := range a {
+		old[keyOf(mi)] = mi
+	}
+
+	var diffs []InfoDiff
+	seen := make(map[key]bool, len(b))
+	for _, mi := range b {
+		k := keyOf(mi)
+		seen[k] = true
+		prev, ok := old[k]
+		switch {
+		case !ok:
+			diffs = append(diffs, InfoDiff{Kind: InfoAdded, Urn: mi.GetUrn(), Labels: mi.GetLabels(), New: infoValue(mi)})
+		case prev.GetType() != mi.GetType() || !bytes.Equal(prev.GetPayload(), mi.GetPayload()):
+			diffs = append(diffs, InfoDiff{Kind: InfoChanged, Urn: mi.GetUrn(), Labels: mi.GetLabels(), Old: infoValue(prev), New: infoValue(mi)})
+		}
+	}
+	for _, mi := range a {
+		if k := keyOf(mi); !seen[k] {
+			seen[k] = true
+			diffs = append(diffs, InfoDiff{Kind: InfoRemoved, Urn: mi.GetUrn(), Labels: mi.GetLabels(), Old: infoValue(mi)})
+		}
+	}
+
+	sort.Slice(diffs, func(i, j int) bool {
+		if diffs[i].Urn != diffs[j].Urn {
+			return diffs[i].Urn < diffs[j].Urn
+		}
+		return labelsKey(&pipepb.MonitoringInfo{Labels: diffs[i].Labels}) < labelsKey(&pipepb.MonitoringInfo{Labels: diffs[j].Labels})
+	})
+	return diffs
+}
+
+// infoValue returns the decoded value of the MonitoringInfo, or its raw
+// payload if it can't be decoded.
+func infoValue(mi *pipepb.MonitoringInfo) interface{} {
+	if v, err := decodePayload(mi.GetType(), mi.GetPayload()); err == nil {
+		return v
+	}
+	return mi.GetPayload()
+}
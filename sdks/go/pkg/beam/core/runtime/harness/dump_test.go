@@ -0,0 +1,256 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package harness
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apache/beam/sdks/go/pkg/beam/core/metrics"
+	fnpb "github.com/apache/beam/sdks/go/pkg/beam/model/fnexecution_v1"
+	pipepb "github.com/apache/beam/sdks/go/pkg/beam/model/pipeline_v1"
+	"github.com/golang/protobuf/proto"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDumpMonitoringJSON(t *testing.T) {
+	plan, _ := executeTestPlan(t, 10)
+	b, err := DumpMonitoringJSON(plan)
+	if err != nil {
+		t.Fatalf("DumpMonitoringJSON failed: %v", err)
+	}
+	var got []struct {
+		Urn    string
+		Labels map[string]string
+		Value  interface{}
+	}
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("DumpMonitoringJSON produced invalid JSON: %v\n%s", err, b)
+	}
+	var found bool
+	for _, info := range got {
+		if info.Urn != sUrns[urnElementCount] {
+			continue
+		}
+		found = true
+		if got, want := info.Labels["PCOLLECTION"], "p1"; got != want {
+			t.Errorf("element count PCOLLECTION label = %v, want %v", got, want)
+		}
+		// JSON numbers are decoded as float64.
+		if got, want := info.Value, float64(10); got != want {
+			t.Errorf("element count value = %v, want %v", got, want)
+		}
+	}
+	if !found {
+		t.Errorf("DumpMonitoringJSON didn't include %v:\n%s", sUrns[urnElementCount], b)
+	}
+}
+
+func TestMonitoringText(t *testing.T) {
+	count, _ := int64Counter(3)
+	gauge, _ := int64Latest(time.Unix(1, 0), 7)
+	heartbeat, _ := int64Counter(42)
+	mons := []*pipepb.MonitoringInfo{
+		{
+			Urn:     sUrns[urnUserLatestMsInt64],
+			Type:    urnToType(urnUserLatestMsInt64),
+			Payload: gauge,
+			Labels:  map[string]string{"PTRANSFORM": "pt", "NAMESPACE": "ns", "NAME": "gauge"},
+		},
+		{
+			Urn:     sUrns[urnElementCount],
+			Type:    urnToType(urnElementCount),
+			Payload: count,
+			Labels:  map[string]string{"PCOLLECTION": "p2"},
+		},
+		{
+			Urn:     sUrns[urnElementCount],
+			Type:    urnToType(urnElementCount),
+			Payload: count,
+			Labels:  map[string]string{"PCOLLECTION": "p1"},
+		},
+		{
+			Urn:     sUrns[urnWorkerHeartbeat],
+			Type:    urnToType(urnWorkerHeartbeat),
+			Payload: heartbeat,
+		},
+	}
+	want := `monitoring_infos {
+  urn: "beam:metric:element_count:v1"
+  type: "beam:metrics:sum_int64:v1"
+  payload: "\003"
+  labels: <
+    key: "PCOLLECTION"
+    value: "p1"
+  >
+  # value: 3
+}
+monitoring_infos {
+  urn: "beam:metric:element_count:v1"
+  type: "beam:metrics:sum_int64:v1"
+  payload: "\003"
+  labels: <
+    key: "PCOLLECTION"
+    value: "p2"
+  >
+  # value: 3
+}
+monitoring_infos {
+  urn: "beam:metric:user:latest_int64:v1"
+  type: "beam:metrics:latest_int64:v1"
+  payload: "\350\007\007"
+  labels: <
+    key: "NAME"
+    value: "gauge"
+  >
+  labels: <
+    key: "NAMESPACE"
+    value: "ns"
+  >
+  labels: <
+    key: "PTRANSFORM"
+    value: "pt"
+  >
+  # value: {1970-01-01 00:00:01 +0000 UTC 7}
+}
+`
+	got := monitoringText(mons)
+	if d := cmp.Diff(want, got); d != "" {
+		t.Errorf("monitoringText diff (-want, +got):\n%v", d)
+	}
+	// Reversing the input doesn't change the output.
+	for i, j := 0, len(mons)-1; i < j; i, j = i+1, j-1 {
+		mons[i], mons[j] = mons[j], mons[i]
+	}
+	if again := monitoringText(mons); again != got {
+		t.Errorf("monitoringText isn't deterministic:\n%v\nthen\n%v", got, again)
+	}
+	// The output is a valid ProcessBundleResponse.
+	var resp fnpb.ProcessBundleResponse
+	if err := proto.UnmarshalText(got, &resp); err != nil {
+		t.Fatalf("monitoringText produced invalid text proto: %v", err)
+	}
+	if got, want := len(resp.GetMonitoringInfos()), 3; got != want {
+		t.Errorf("parsed %d MonitoringInfos, want %d", got, want)
+	}
+}
+
+func TestMonitoringTextProto(t *testing.T) {
+	plan, _ := executeTestPlan(t, 10)
+	first, err := MonitoringTextProto(plan)
+	if err != nil {
+		t.Fatalf("MonitoringTextProto failed: %v", err)
+	}
+	second, err := MonitoringTextProto(plan)
+	if err != nil {
+		t.Fatalf("MonitoringTextProto failed: %v", err)
+	}
+	if first != second {
+		t.Errorf("MonitoringTextProto isn't stable:\n%v\nthen\n%v", first, second)
+	}
+}
+
+func TestPrintMetrics(t *testing.T) {
+	plan, _ := executeTestPlan(t, 10)
+	var buf bytes.Buffer
+	if err := PrintMetrics(&buf, plan); err != nil {
+		t.Fatalf("PrintMetrics failed: %v", err)
+	}
+	want := sUrns[urnElementCount] + " labels=PCOLLECTION=p1 value=10\n"
+	if !strings.Contains(buf.String(), want) {
+		t.Errorf("PrintMetrics didn't print %q:\n%s", want, buf.String())
+	}
+}
+
+func TestPrintMetrics_Undecodable(t *testing.T) {
+	mons := []*pipepb.MonitoringInfo{{
+		Urn:     "beam:metric:custom:v1",
+		Type:    "beam:metrics:custom:v1",
+		Payload: []byte{0xbe, 0xef},
+		Labels:  map[string]string{"PTRANSFORM": "pt", "NAME": "custom"},
+	}}
+	var buf bytes.Buffer
+	if err := printMetrics(&buf, mons); err != nil {
+		t.Fatalf("printMetrics failed: %v", err)
+	}
+	if got, want := buf.String(), "beam:metric:custom:v1 labels=NAME=custom,PTRANSFORM=pt payload=beef\n"; got != want {
+		t.Errorf("printMetrics printed %q, want %q", got, want)
+	}
+}
+
+func TestDiffInfos(t *testing.T) {
+	info := func(urn mUrn, pcol string, v int64) *pipepb.MonitoringInfo {
+		payload, err := int64Counter(v)
+		if err != nil {
+			t.Fatalf("failed to encode %v: %v", v, err)
+		}
+		return &pipepb.MonitoringInfo{
+			Urn:     sUrns[urn],
+			Type:    urnToType(urn),
+			Payload: payload,
+			Labels:  map[string]string{"PCOLLECTION": pcol},
+		}
+	}
+	a := []*pipepb.MonitoringInfo{
+		info(urnElementCount, "same", 1),
+		info(urnElementCount, "removed", 2),
+		info(urnElementCount, "changed", 3),
+	}
+	b := []*pipepb.MonitoringInfo{
+		info(urnElementCount, "changed", 4),
+		info(urnElementCount, "same", 1),
+		info(urnElementCount, "added", 5),
+	}
+	want := []InfoDiff{
+		{Kind: InfoAdded, Urn: sUrns[urnElementCount], Labels: map[string]string{"PCOLLECTION": "added"}, New: int64(5)},
+		{Kind: InfoChanged, Urn: sUrns[urnElementCount], Labels: map[string]string{"PCOLLECTION": "changed"}, Old: int64(3), New: int64(4)},
+		{Kind: InfoRemoved, Urn: sUrns[urnElementCount], Labels: map[string]string{"PCOLLECTION": "removed"}, Old: int64(2)},
+	}
+	if d := cmp.Diff(want, DiffInfos(a, b)); d != "" {
+		t.Errorf("DiffInfos diff (-want, +got):\n%v", d)
+	}
+	if got := DiffInfos(a, a); len(got) != 0 {
+		t.Errorf("DiffInfos(a, a) = %v, want no diffs", got)
+	}
+}
+
+func TestShortIDCacheHandler(t *testing.T) {
+	l := metrics.UserLabels("debugT", "debugNS", "debugName")
+	id := getShortID(l, urnUserSumInt64)
+
+	rec := httptest.NewRecorder()
+	ShortIDCacheHandler(rec, httptest.NewRequest("GET", "/shortids", nil))
+	body, err := ioutil.ReadAll(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(string(body), "\n")
+	if !strings.HasPrefix(lines[0], "SHORT ID") {
+		t.Errorf("output doesn't start with a header:\n%s", body)
+	}
+	want := []string{id, sUrns[urnUserSumInt64], "beam:metrics:sum_int64:v1", "NAME=debugName,NAMESPACE=debugNS,PTRANSFORM=debugT"}
+	for _, line := range lines[1:] {
+		if cmp.Equal(strings.Fields(line), want) {
+			return
+		}
+	}
+	t.Errorf("output is missing the row %v:\n%s", want, body)
+}
@@ -0,0 +1,36 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package harness
+
+import "github.com/apache/beam/sdks/go/pkg/beam/internal/errors"
+
+// Errors for metric payloads that can't be encoded, decoded or merged.
+// Returned errors wrap them with the metric or field at fault, so they
+// should be checked for with errors.Is.
+var (
+	// ErrUnknownMetricURN indicates a metric urn that's neither built in
+	// nor registered.
+	ErrUnknownMetricURN = errors.New("unknown metric urn")
+	// ErrUnsupportedType indicates a monitoring type whose payloads can't
+	// be encoded or decoded.
+	ErrUnsupportedType = errors.New("unsupported monitoring type")
+	// ErrPayloadTooShort indicates a payload that ends before all of the
+	// fields of its type.
+	ErrPayloadTooShort = errors.New("payload too short")
+	// ErrMalformedPayload indicates a payload with invalid field values,
+	// or bytes beyond the fields of its type.
+	ErrMalformedPayload = errors.New("malformed payload")
+)
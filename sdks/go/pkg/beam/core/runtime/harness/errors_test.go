@@ -0,0 +1,104 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package harness
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecodePayload_Errors(t *testing.T) {
+	must := func(b []byte, err error) []byte {
+		if err != nil {
+			t.Fatalf("encoding failed: %v", err)
+		}
+		return b
+	}
+	latest := must(stringLatest(time.Unix(1, 0), "value"))
+	dist := must(int64Distribution(3, 600, 100, 300))
+	tests := []struct {
+		name    string
+		typ     string
+		payload []byte
+		want    error
+		field   string
+	}{
+		{"unsupported", "beam:metrics:custom:v1", []byte{1}, ErrUnsupportedType, ""},
+		{"empty counter", "beam:metrics:sum_int64:v1", nil, ErrPayloadTooShort, "value"},
+		{"truncated distribution", "beam:metrics:distribution_int64:v1", dist[:3], ErrPayloadTooShort, "min"},
+		{"truncated double", "beam:metrics:sum_double:v1", must(float64Counter(1))[:4], ErrPayloadTooShort, "value"},
+		{"truncated string", "beam:metrics:latest_string:v1", latest[:len(latest)-1], ErrPayloadTooShort, "value"},
+		{"trailing bytes", "beam:metrics:sum_int64:v1", []byte{1, 2}, ErrMalformedPayload, ""},
+		{"scale out of range", "beam:metrics:sum_fixed:v1", must(minMaxInt64(1, 1<<40)), ErrMalformedPayload, "scale"},
+		{"unordered category keys", "beam:go:metrics:monitoring_table_string_keys:v1", []byte{2, 1, 'b', 1, 1, 'a', 1}, ErrMalformedPayload, "key"},
+		{"unordered table keys", "beam:go:metrics:monitoring_table_int_keys:v1", []byte{2, 2, 1, 2, 1}, ErrMalformedPayload, "key"},
+		{"truncated top n", "beam:metrics:top_n_int64:v1", []byte{0, 0, 0, 2, 1, 0x80}, ErrPayloadTooShort, "value"},
+		{"trailing top n bytes", "beam:metrics:bottom_n_int64:v1", []byte{0, 0, 0, 1, 1, 1}, ErrMalformedPayload, ""},
+		{"negative progress count", "beam:metrics:progress:v1", []byte{0xff, 0xff, 0xff, 0xff}, ErrMalformedPayload, "count"},
+	}
+	for _, test := range tests {
+		_, err := decodePayload(test.typ, test.payload)
+		if !errors.Is(err, test.want) {
+			t.Errorf("decodePayload(%v) = %v, want error wrapping %v", test.name, err, test.want)
+			continue
+		}
+		if test.field != "" && !strings.Contains(err.Error(), "field "+test.field) {
+			t.Errorf("decodePayload(%v) = %v, want it to name field %v", test.name, err, test.field)
+		}
+	}
+}
+
+func TestCheckPayload_Errors(t *testing.T) {
+	tests := []struct {
+		typ     string
+		payload []byte
+		want    error
+	}{
+		{"beam:metrics:sum_int64:v1", nil, ErrPayloadTooShort},
+		{"beam:metrics:sum_int64:v1", []byte{0x80}, ErrPayloadTooShort},
+		{"beam:metrics:sum_int64:v1", []byte{1, 1}, ErrMalformedPayload},
+		{"beam:metrics:sum_double:v1", make([]byte, 7), ErrPayloadTooShort},
+		{"beam:metrics:sum_double:v1", make([]byte, 9), ErrMalformedPayload},
+		{"beam:metrics:progress:v1", []byte{0, 0, 0, 1}, ErrPayloadTooShort},
+		{"beam:metrics:latest_string:v1", []byte{1, 3, 'a'}, ErrPayloadTooShort},
+		{"beam:metrics:gauge_history_int64:v1", []byte{2, 1, 1, 1}, ErrPayloadTooShort},
+		{"beam:metrics:gauge_history_int64:v1", []byte{1, 1, 1, 1}, ErrMalformedPayload},
+		{"beam:go:metrics:monitoring_table_int_keys:v1", []byte{2, 1, 1}, ErrPayloadTooShort},
+		{"beam:go:metrics:monitoring_table_int_keys:v1", []byte{1, 1, 1, 1}, ErrMalformedPayload},
+		{"beam:go:metrics:monitoring_table_string_keys:v1", []byte{1, 2, 'a'}, ErrPayloadTooShort},
+		{"beam:go:metrics:monitoring_table_string_keys:v1", []byte{1, 1, 'a', 1, 1}, ErrMalformedPayload},
+	}
+	for _, test := range tests {
+		if err := checkPayload(test.typ, test.payload); !errors.Is(err, test.want) {
+			t.Errorf("checkPayload(%v, %v) = %v, want error wrapping %v", test.typ, test.payload, err, test.want)
+		}
+	}
+}
+
+func TestMergePayloads_Errors(t *testing.T) {
+	if _, err := MergePayloads("beam:metric:test:unknown:v1", nil, nil); !errors.Is(err, ErrUnknownMetricURN) {
+		t.Errorf("MergePayloads of an unknown urn = %v, want error wrapping %v", err, ErrUnknownMetricURN)
+	}
+	// Progress urns are known, but have no combiner.
+	if _, err := MergePayloads(sUrns[urnProgressFraction], nil, nil); err == nil || errors.Is(err, ErrUnknownMetricURN) {
+		t.Errorf("MergePayloads of a progress urn = %v, want an error not wrapping %v", err, ErrUnknownMetricURN)
+	}
+	if _, err := MergePayloads(sUrns[urnUserSumInt64], []byte{1}, nil); !errors.Is(err, ErrPayloadTooShort) {
+		t.Errorf("MergePayloads of an empty payload = %v, want error wrapping %v", err, ErrPayloadTooShort)
+	}
+}
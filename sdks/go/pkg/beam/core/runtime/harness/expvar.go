@@ -0,0 +1,135 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package harness
+
+import (
+	"expvar"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apache/beam/sdks/go/pkg/beam/core/runtime/exec"
+	pipepb "github.com/apache/beam/sdks/go/pkg/beam/model/pipeline_v1"
+)
+
+// ExpvarName is the name of the expvar.Map PublishExpvar publishes the
+// harness metrics under, so they appear at /debug/vars.
+const ExpvarName = "beam_harness_metrics"
+
+var (
+	expvarOnce    sync.Once
+	expvarMetrics *expvar.Map
+)
+
+// harnessExpvar returns the published metrics map, publishing it on first
+// use so merely importing the harness doesn't add to /debug/vars.
+func harnessExpvar() *expvar.Map {
+	expvarOnce.Do(func() {
+		expvarMetrics = expvar.NewMap(ExpvarName)
+	})
+	return expvarMetrics
+}
+
+// PublishExpvar publishes the decoded metrics of the plan in the expvar.Map
+// named ExpvarName, refreshing them every interval until the returned
+// flusher is stopped. It's intended for simple local introspection, with
+// a single plan published at a time.
+//
+// Each metric is keyed by its urn followed by its labels, sorted, as
+// KEY=value segments separated by dots. Characters other than letters,
+// digits, '_', '-' and ':' are escaped as %XX, so distinct metrics have
+// distinct keys. Sums are published as expvar Ints or Floats, other
+// decodable metrics as their JSON representation, and undecodable metrics
+// are skipped. Metrics the plan no longer reports are removed.
+//
+// Refreshing the map reads the plan's metrics without the side effects of
+// reporting them to the runner, such as advancing the worker heartbeat.
+func PublishExpvar(p *exec.Plan, interval time.Duration) *MetricsFlusher {
+	m := harnessExpvar()
+	t := time.NewTicker(interval)
+	return newMetricsFlusher(p, peekExpvar, t.C, t.Stop, func(mons []*pipepb.MonitoringInfo, _ map[string][]byte) {
+		updateExpvar(m, mons)
+	})
+}
+
+// peekExpvar extracts the metrics PublishExpvar publishes.
+func peekExpvar(p metricsSource) ([]*pipepb.MonitoringInfo, map[string][]byte, error) {
+	mons, err := peekMonitoring(p)
+	return mons, nil, err
+}
+
+// updateExpvar sets the decoded values of the MonitoringInfos in m, and
+// deletes the keys of any other metrics.
+func updateExpvar(m *expvar.Map, mons []*pipepb.MonitoringInfo) {
+	keep := make(map[string]bool, len(mons))
+	for _, mi := range mons {
+		v, err := decodePayload(mi.GetType(), mi.GetPayload())
+		if err != nil {
+			continue
+		}
+		key := expvarKey(mi)
+		keep[key] = true
+		switch v := v.(type) {
+		case int64:
+			i := new(expvar.Int)
+			i.Set(v)
+			m.Set(key, i)
+		case float64:
+			f := new(expvar.Float)
+			f.Set(v)
+			m.Set(key, f)
+		default:
+			m.Set(key, expvar.Func(func() interface{} { return v }))
+		}
+	}
+	var stale []string
+	m.Do(func(kv expvar.KeyValue) {
+		if !keep[kv.Key] {
+			stale = append(stale, kv.Key)
+		}
+	})
+	for _, key := range stale {
+		m.Delete(key)
+	}
+}
+
+// expvarKey returns the key of the MonitoringInfo in the published map.
+func expvarKey(mi *pipepb.MonitoringInfo) string {
+	labels := make([]string, 0, len(mi.GetLabels()))
+	for k, v := range mi.GetLabels() {
+		labels = append(labels, expvarName(k)+"="+expvarName(v))
+	}
+	sort.Strings(labels)
+	return strings.Join(append([]string{expvarName(mi.GetUrn())}, labels...), ".")
+}
+
+// expvarName escapes the bytes of s that aren't letters, digits, '_', '-'
+// or ':' as %XX. The separators '.' and '=' are always escaped, so keys
+// can't collide.
+func expvarName(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '_', c == '-', c == ':':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,111 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package harness
+
+import (
+	"expvar"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pipepb "github.com/apache/beam/sdks/go/pkg/beam/model/pipeline_v1"
+)
+
+func TestPublishExpvar(t *testing.T) {
+	plan, _ := executeTestPlan(t, 10)
+	f := PublishExpvar(plan, time.Millisecond)
+	defer f.Stop()
+
+	m, ok := expvar.Get(ExpvarName).(*expvar.Map)
+	if !ok {
+		t.Fatalf("expvar %v isn't a published map", ExpvarName)
+	}
+	key := "beam:metric:element_count:v1.PCOLLECTION=p1"
+	waitFor(t, func() bool { return m.Get(key) != nil })
+	v, ok := m.Get(key).(*expvar.Int)
+	if !ok {
+		t.Fatalf("expvar %v = %v, want an Int", key, m.Get(key))
+	}
+	if got, want := v.Value(), int64(10); got != want {
+		t.Errorf("expvar %v = %v, want %v", key, got, want)
+	}
+}
+
+func TestExpvarKey(t *testing.T) {
+	mi := &pipepb.MonitoringInfo{
+		Urn:    "beam:metric:user:sum_int64:v1",
+		Labels: map[string]string{"PTRANSFORM": "main/Read.Lines", "NAMESPACE": "my ns", "NAME": "count"},
+	}
+	if got, want := expvarKey(mi), "beam:metric:user:sum_int64:v1.NAME=count.NAMESPACE=my%20ns.PTRANSFORM=main%2FRead%2ELines"; got != want {
+		t.Errorf("expvarKey() = %q, want %q", got, want)
+	}
+
+	// Labels that only differ in escaped characters have distinct keys.
+	seen := make(map[string]map[string]string)
+	for _, labels := range []map[string]string{
+		{"NAMESPACE": "my ns"},
+		{"NAMESPACE": "my_ns"},
+		{"NAMESPACE": "a.NAME=b"},
+		{"NAMESPACE": "a", "NAME": "b"},
+		{"NAMESPACE": "%20"},
+		{"NAMESPACE": " "},
+	} {
+		key := expvarKey(&pipepb.MonitoringInfo{Urn: mi.Urn, Labels: labels})
+		if prev, ok := seen[key]; ok {
+			t.Errorf("expvarKey() = %q for both %v and %v", key, prev, labels)
+		}
+		seen[key] = labels
+	}
+}
+
+func TestUpdateExpvar_RemovesStaleKeys(t *testing.T) {
+	m := new(expvar.Map)
+	sum := func(name string) *pipepb.MonitoringInfo {
+		payload, err := int64Counter(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return newMonitoringInfo(urnUserSumInt64, map[string]string{"NAME": name}, payload)
+	}
+	first, second := sum("first"), sum("second")
+	updateExpvar(m, []*pipepb.MonitoringInfo{first, second})
+	updateExpvar(m, []*pipepb.MonitoringInfo{second})
+	if m.Get(expvarKey(first)) != nil {
+		t.Errorf("expvar %v is still published after its metric is no longer reported", expvarKey(first))
+	}
+	if m.Get(expvarKey(second)) == nil {
+		t.Errorf("expvar %v isn't published", expvarKey(second))
+	}
+}
+
+func TestPeekMonitoring_NoSideEffects(t *testing.T) {
+	plan, _ := executeTestPlan(t, 10)
+	beat := atomic.LoadInt64(&heartbeat)
+	ids := len(defaultShortIDCache.Snapshot())
+	mons, err := peekMonitoring(plan)
+	if err != nil {
+		t.Fatalf("peekMonitoring failed: %v", err)
+	}
+	if len(mons) == 0 {
+		t.Errorf("peekMonitoring returned no MonitoringInfos")
+	}
+	if got := atomic.LoadInt64(&heartbeat); got != beat {
+		t.Errorf("heartbeat = %v after peekMonitoring, want %v", got, beat)
+	}
+	if got := len(defaultShortIDCache.Snapshot()); got != ids {
+		t.Errorf("short ids = %v after peekMonitoring, want %v", got, ids)
+	}
+}
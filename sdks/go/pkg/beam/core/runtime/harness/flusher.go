@@ -0,0 +1,118 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package harness
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/apache/beam/sdks/go/pkg/beam/core/runtime/exec"
+	pipepb "github.com/apache/beam/sdks/go/pkg/beam/model/pipeline_v1"
+)
+
+// MetricsFlusher periodically extracts the monitoring data of a plan
+// and passes it to a callback, centralizing the progress reporting loop.
+//
+// Extractions never overlap. If the previous extraction and its callback
+// haven't finished when the next tick arrives, that tick is skipped rather
+// than queued.
+type MetricsFlusher struct {
+	plan     metricsSource
+	extract  func(metricsSource) ([]*pipepb.MonitoringInfo, map[string][]byte, error)
+	callback func([]*pipepb.MonitoringInfo, map[string][]byte)
+
+	ticks      <-chan time.Time
+	stopTicker func()
+
+	busy    int32 // Non-zero while an extraction is in progress. Accessed atomically.
+	skipped int64 // Accessed atomically.
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// NewMetricsFlusher starts a MetricsFlusher that calls the callback with
+// the plan's monitoring data every interval, until it's stopped.
+func NewMetricsFlusher(p *exec.Plan, interval time.Duration, callback func([]*pipepb.MonitoringInfo, map[string][]byte)) *MetricsFlusher {
+	t := time.NewTicker(interval)
+	return newMetricsFlusher(p, monitoring, t.C, t.Stop, callback)
+}
+
+// newMetricsFlusher starts a MetricsFlusher that extracts the monitoring
+// data of p with extract on every tick.
+func newMetricsFlusher(p metricsSource, extract func(metricsSource) ([]*pipepb.MonitoringInfo, map[string][]byte, error), ticks <-chan time.Time, stopTicker func(), callback func([]*pipepb.MonitoringInfo, map[string][]byte)) *MetricsFlusher {
+	f := &MetricsFlusher{
+		plan:       p,
+		extract:    extract,
+		callback:   callback,
+		ticks:      ticks,
+		stopTicker: stopTicker,
+		stop:       make(chan struct{}),
+	}
+	f.wg.Add(1)
+	go f.loop()
+	return f
+}
+
+func (f *MetricsFlusher) loop() {
+	defer f.wg.Done()
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-f.ticks:
+			if !atomic.CompareAndSwapInt32(&f.busy, 0, 1) {
+				atomic.AddInt64(&f.skipped, 1)
+				continue
+			}
+			f.wg.Add(1)
+			go f.flush()
+		}
+	}
+}
+
+func (f *MetricsFlusher) flush() {
+	defer f.wg.Done()
+	defer atomic.StoreInt32(&f.busy, 0)
+
+	// Partial results are still worth reporting.
+	mons, pylds, _ := f.extract(f.plan)
+	select {
+	case <-f.stop:
+		// Stopped during extraction, so drop the results.
+		return
+	default:
+	}
+	f.callback(mons, pylds)
+}
+
+// Skipped returns the number of ticks skipped because the previous
+// extraction was still in progress.
+func (f *MetricsFlusher) Skipped() int64 {
+	return atomic.LoadInt64(&f.skipped)
+}
+
+// Stop halts the flusher, and waits for any in progress callback to finish.
+// No callbacks are made once Stop returns. Stop may be called more than once.
+func (f *MetricsFlusher) Stop() {
+	f.stopOnce.Do(func() {
+		f.stopTicker()
+		close(f.stop)
+	})
+	f.wg.Wait()
+}
@@ -0,0 +1,91 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package harness
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pipepb "github.com/apache/beam/sdks/go/pkg/beam/model/pipeline_v1"
+)
+
+func TestMetricsFlusher(t *testing.T) {
+	plan, _ := executeTestPlan(t, 10)
+
+	ticks := make(chan time.Time)
+	var tickerStopped bool
+	called := make(chan struct{})
+	release := make(chan struct{})
+	var calls int64
+	f := newMetricsFlusher(plan, monitoring, ticks, func() { tickerStopped = true }, func(mons []*pipepb.MonitoringInfo, _ map[string][]byte) {
+		atomic.AddInt64(&calls, 1)
+		if len(mons) == 0 {
+			t.Errorf("callback received no MonitoringInfos")
+		}
+		called <- struct{}{}
+		<-release
+	})
+
+	ticks <- time.Now()
+	<-called
+
+	// The first callback is still blocked, so these ticks must be skipped.
+	ticks <- time.Now()
+	ticks <- time.Now()
+	waitFor(t, func() bool { return f.Skipped() == 2 })
+	release <- struct{}{}
+
+	if got, want := atomic.LoadInt64(&calls), int64(1); got != want {
+		t.Errorf("callbacks after overlapping ticks = %v, want %v", got, want)
+	}
+
+	// Once the previous callback has finished, ticks are handled again.
+	waitFor(t, func() bool { return atomic.LoadInt32(&f.busy) == 0 })
+	ticks <- time.Now()
+	<-called
+	release <- struct{}{}
+	if got, want := atomic.LoadInt64(&calls), int64(2); got != want {
+		t.Errorf("callbacks = %v, want %v", got, want)
+	}
+
+	f.Stop()
+	if !tickerStopped {
+		t.Error("Stop didn't stop the ticker")
+	}
+	select {
+	case ticks <- time.Now():
+		t.Error("tick was received after Stop")
+	case <-time.After(10 * time.Millisecond):
+	}
+	if got, want := atomic.LoadInt64(&calls), int64(2); got != want {
+		t.Errorf("callbacks after Stop = %v, want %v", got, want)
+	}
+	f.Stop() // Stopping again is a no-op.
+}
+
+// waitFor polls the condition until it's true, failing the test if
+// that takes too long.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
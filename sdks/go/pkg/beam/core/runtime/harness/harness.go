@@ -29,6 +29,7 @@ import (
 	"github.com/apache/beam/sdks/go/pkg/beam/internal/errors"
 	"github.com/apache/beam/sdks/go/pkg/beam/log"
 	fnpb "github.com/apache/beam/sdks/go/pkg/beam/model/fnexecution_v1"
+	pipepb "github.com/apache/beam/sdks/go/pkg/beam/model/pipeline_v1"
 	"github.com/apache/beam/sdks/go/pkg/beam/util/grpcx"
 	"github.com/golang/protobuf/proto"
 	"google.golang.org/grpc"
@@ -257,7 +258,15 @@ func (c *control) handleInstruction(ctx context.Context, req *fnpb.InstructionRe
 		data.Close()
 		state.Close()
 
-		mons, pylds := monitoring(plan)
+		mons, pylds, merr := bundleMonitoring(plan, true)
+		if merr != nil {
+			log.Warnf(ctx, "metrics for instruction %v: %v", instID, merr)
+		}
+		pylds, merr = responsePayloads(pylds)
+		if merr != nil {
+			log.Warnf(ctx, "sending plain metrics for instruction %v: %v", instID, merr)
+		}
+		resetBundleMetrics(plan)
 		// Move the plan back to the candidate state
 		c.mu.Lock()
 		// Mark the instruction as failed.
@@ -283,19 +292,7 @@ func (c *control) handleInstruction(ctx context.Context, req *fnpb.InstructionRe
 		}
 		c.mu.Unlock()
 
-		if err != nil {
-			return fail(ctx, instID, "process bundle failed for instruction %v using plan %v : %v", instID, bdID, err)
-		}
-
-		return &fnpb.InstructionResponse{
-			InstructionId: string(instID),
-			Response: &fnpb.InstructionResponse_ProcessBundle{
-				ProcessBundle: &fnpb.ProcessBundleResponse{
-					MonitoringData:  pylds,
-					MonitoringInfos: mons,
-				},
-			},
-		}
+		return processBundleResponse(ctx, instID, bdID, mons, pylds, err)
 
 	case req.GetProcessBundleProgress() != nil:
 		msg := req.GetProcessBundleProgress()
@@ -315,7 +312,14 @@ func (c *control) handleInstruction(ctx context.Context, req *fnpb.InstructionRe
 			}
 		}
 
-		mons, pylds := monitoring(plan)
+		mons, pylds, err := bundleMonitoring(plan, false)
+		if err != nil {
+			log.Warnf(ctx, "progress metrics for instruction %v: %v", ref, err)
+		}
+		pylds, err = responsePayloads(pylds)
+		if err != nil {
+			log.Warnf(ctx, "sending plain progress metrics for instruction %v: %v", ref, err)
+		}
 
 		return &fnpb.InstructionResponse{
 			InstructionId: string(instID),
@@ -434,6 +438,27 @@ func (c *control) getPlanOrResponse(ctx context.Context, kind string, instID, re
 	return plan, nil
 }
 
+// processBundleResponse returns the response to a ProcessBundle instruction,
+// reporting the bundle's metrics. Failed bundles report their metrics along
+// with the error, so runners receive the errors transforms failed with.
+func processBundleResponse(ctx context.Context, instID instructionID, bdID bundleDescriptorID, mons []*pipepb.MonitoringInfo, pylds map[string][]byte, err error) *fnpb.InstructionResponse {
+	pb := &fnpb.InstructionResponse_ProcessBundle{
+		ProcessBundle: &fnpb.ProcessBundleResponse{
+			MonitoringData:  pylds,
+			MonitoringInfos: mons,
+		},
+	}
+	if err != nil {
+		resp := fail(ctx, instID, "process bundle failed for instruction %v using plan %v : %v", instID, bdID, err)
+		resp.Response = pb
+		return resp
+	}
+	return &fnpb.InstructionResponse{
+		InstructionId: string(instID),
+		Response:      pb,
+	}
+}
+
 func fail(ctx context.Context, id instructionID, format string, args ...interface{}) *fnpb.InstructionResponse {
 	log.Output(ctx, log.SevError, 1, fmt.Sprintf(format, args...))
 	dummy := &fnpb.InstructionResponse_Register{Register: &fnpb.RegisterResponse{}}
@@ -16,10 +16,14 @@
 package harness
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"strings"
 	"testing"
 
+	"github.com/apache/beam/sdks/go/pkg/beam/core/graph/coder"
+	"github.com/apache/beam/sdks/go/pkg/beam/core/metrics"
 	"github.com/apache/beam/sdks/go/pkg/beam/core/runtime/exec"
 	fnpb "github.com/apache/beam/sdks/go/pkg/beam/model/fnexecution_v1"
 	pipepb "github.com/apache/beam/sdks/go/pkg/beam/model/pipeline_v1"
@@ -27,7 +31,7 @@ import (
 )
 
 // validDescriptor describes a valid pipeline with a source and a sink, but doesn't do anything else.
-func validDescriptor(t *testing.T) *fnpb.ProcessBundleDescriptor {
+func validDescriptor(t testing.TB) *fnpb.ProcessBundleDescriptor {
 	t.Helper()
 	port := &fnpb.RemoteGrpcPort{
 		CoderId: "c1",
@@ -163,3 +167,33 @@ func TestControl_getOrCreatePlan(t *testing.T) {
 	}
 
 }
+
+// TestProcessBundleResponse_Failed validates that a failed bundle's response
+// carries its metrics, including the errors its transforms failed with.
+func TestProcessBundleResponse_Failed(t *testing.T) {
+	src := &erroringSource{
+		fakeSource: fakeSource{store: metrics.GetStore(metrics.SetBundleID(context.Background(), "bundle"))},
+		errs:       map[string]int64{"broken": 1},
+	}
+	mons, pylds, err := monitoring(src)
+	if err != nil {
+		t.Fatalf("monitoring failed: %v", err)
+	}
+
+	resp := processBundleResponse(context.Background(), "inst", "plan", mons, pylds, fmt.Errorf("bundle failed"))
+	if !strings.Contains(resp.GetError(), "bundle failed") {
+		t.Errorf("response error = %q, want the bundle's error", resp.GetError())
+	}
+	var got []*pipepb.MonitoringInfo
+	for _, mi := range resp.GetProcessBundle().GetMonitoringInfos() {
+		if mi.GetUrn() == URNTransformErrorCount.String() && mi.GetLabels()["PTRANSFORM"] == "broken" {
+			got = append(got, mi)
+		}
+	}
+	if len(got) != 1 {
+		t.Fatalf("response has %d error counts for broken, want 1: %v", len(got), resp)
+	}
+	if v, err := coder.DecodeVarInt(bytes.NewReader(got[0].GetPayload())); err != nil || v != 1 {
+		t.Errorf("error count = %v, %v, want 1", v, err)
+	}
+}
@@ -0,0 +1,241 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package harness
+
+import (
+	"math"
+	"sync"
+
+	"github.com/apache/beam/sdks/go/pkg/beam/internal/errors"
+)
+
+// payloadCombiner merges two encoded payloads of a metric into one.
+type payloadCombiner func(a, b []byte) ([]byte, error)
+
+// combiners holds the payload combiners used by MergePayloads, keyed by
+// metric urn.
+var combiners = struct {
+	mu sync.RWMutex
+	m  map[string]payloadCombiner
+}{m: make(map[string]payloadCombiner)}
+
+// RegisterCombiner registers the function MergePayloads uses to merge
+// payloads of the metric urn, allowing custom metric types to define their
+// own aggregation. Registering a combiner for an urn that already has one
+// replaces it, including the standard combiners of built in urns.
+func RegisterCombiner(urn string, combine func(a, b []byte) ([]byte, error)) {
+	if urn == "" || combine == nil {
+		panic(errors.Errorf("invalid combiner registration for urn %q", urn))
+	}
+	combiners.mu.Lock()
+	defer combiners.mu.Unlock()
+	combiners.m[urn] = combine
+}
+
+// MergePayloads merges two payloads of the metric urn, such as the values
+// of a metric reported by different bundles, with the combiner registered
+// for the urn. Returns an error if the urn has no combiner, wrapping
+// ErrUnknownMetricURN if the urn is neither built in nor registered.
+func MergePayloads(urn string, a, b []byte) ([]byte, error) {
+	combiners.mu.RLock()
+	combine, ok := combiners.m[urn]
+	combiners.mu.RUnlock()
+	if !ok {
+		if _, known := lookupURN(urn); !known {
+			return nil, errors.Wrapf(ErrUnknownMetricURN, "no combiner registered for metric urn %v", urn)
+		}
+		return nil, errors.Errorf("no combiner registered for metric urn %v", urn)
+	}
+	merged, err := combine(a, b)
+	if err != nil {
+		return nil, errors.WithContextf(err, "merging payloads of metric urn %v", urn)
+	}
+	return merged, nil
+}
+
+// typeCombiners are the standard combiners of the encoding types, which
+// built in urns are registered with. Progress payloads can't be merged
+// meaningfully, so they have none.
+var typeCombiners = map[string]payloadCombiner{
+	"beam:metrics:sum_int64:v1": func(a, b []byte) ([]byte, error) {
+		x, y, err := decodeBoth("beam:metrics:sum_int64:v1", a, b)
+		if err != nil {
+			return nil, err
+		}
+		return int64Counter(x.(int64) + y.(int64))
+	},
+	"beam:metrics:sum_double:v1": func(a, b []byte) ([]byte, error) {
+		x, y, err := decodeBoth("beam:metrics:sum_double:v1", a, b)
+		if err != nil {
+			return nil, err
+		}
+		return float64Counter(x.(float64) + y.(float64))
+	},
+	// Fixed sums are only exact with a common scale, so differing scales
+	// are an error rather than being rescaled. Like the cells, the sums
+	// saturate rather than wrapping around.
+	"beam:metrics:sum_fixed:v1": func(a, b []byte) ([]byte, error) {
+		x, y, err := decodeBoth("beam:metrics:sum_fixed:v1", a, b)
+		if err != nil {
+			return nil, err
+		}
+		f, g := x.(FixedData), y.(FixedData)
+		if f.Scale != g.Scale {
+			return nil, errors.Errorf("can't merge sum_fixed payloads with scales %d and %d", f.Scale, g.Scale)
+		}
+		return fixedSum(addSaturating(f.Mantissa, g.Mantissa), f.Scale)
+	},
+	"beam:metrics:distribution_int64:v1": func(a, b []byte) ([]byte, error) {
+		x, y, err := decodeBoth("beam:metrics:distribution_int64:v1", a, b)
+		if err != nil {
+			return nil, err
+		}
+		d := combineDistribution(x.(DistributionData), y.(DistributionData))
+		return int64Distribution(d.count, d.sum, d.min, d.max)
+	},
+	"beam:metrics:distribution_stats_int64:v1": func(a, b []byte) ([]byte, error) {
+		x, y, err := decodeBoth("beam:metrics:distribution_stats_int64:v1", a, b)
+		if err != nil {
+			return nil, err
+		}
+		m, n := x.(DistributionStatsData), y.(DistributionStatsData)
+		d := combineDistribution(m.DistributionData, n.DistributionData)
+		sumSq := m.sumSq + n.sumSq
+		if sumSq < m.sumSq {
+			// Sums of squares are non-negative, so overflow saturates.
+			sumSq = math.MaxInt64
+		}
+		return distributionStats(d.count, d.sum, d.min, d.max, sumSq)
+	},
+	"beam:metrics:min_max_int64:v1": func(a, b []byte) ([]byte, error) {
+		x, y, err := decodeBoth("beam:metrics:min_max_int64:v1", a, b)
+		if err != nil {
+			return nil, err
+		}
+		m, n := x.(MinMaxData), y.(MinMaxData)
+		if n.Min < m.Min {
+			m.Min = n.Min
+		}
+		if n.Max > m.Max {
+			m.Max = n.Max
+		}
+		return minMaxInt64(m.Min, m.Max)
+	},
+	// Tables sum the values of rows with equal keys, saturating like
+	// sum_fixed.
+	"beam:go:metrics:monitoring_table_int_keys:v1": func(a, b []byte) ([]byte, error) {
+		x, y, err := decodeBoth("beam:go:metrics:monitoring_table_int_keys:v1", a, b)
+		if err != nil {
+			return nil, err
+		}
+		rows := make(map[int64]int64)
+		for _, r := range x.([]IntTableRow) {
+			rows[r.Key] = addSaturating(rows[r.Key], r.Value)
+		}
+		for _, r := range y.([]IntTableRow) {
+			rows[r.Key] = addSaturating(rows[r.Key], r.Value)
+		}
+		return monitoringTableIntKeys(rows)
+	},
+	"beam:go:metrics:monitoring_table_string_keys:v1": func(a, b []byte) ([]byte, error) {
+		x, y, err := decodeBoth("beam:go:metrics:monitoring_table_string_keys:v1", a, b)
+		if err != nil {
+			return nil, err
+		}
+		rows := make(map[string]int64)
+		for _, r := range x.([]StringTableRow) {
+			rows[r.Key] = addSaturating(rows[r.Key], r.Value)
+		}
+		for _, r := range y.([]StringTableRow) {
+			rows[r.Key] = addSaturating(rows[r.Key], r.Value)
+		}
+		return monitoringTableStringKeys(rows)
+	},
+	// Gauges keep the latest value, preferring b on equal timestamps.
+	"beam:metrics:latest_int64:v1": func(a, b []byte) ([]byte, error) {
+		x, y, err := decodeBoth("beam:metrics:latest_int64:v1", a, b)
+		if err != nil {
+			return nil, err
+		}
+		if x.(GaugeData).Timestamp.After(y.(GaugeData).Timestamp) {
+			return a, nil
+		}
+		return b, nil
+	},
+	// Gauge summaries keep the overall min and max, and the latest value
+	// like gauges.
+	"beam:go:metrics:gauge_summary_int64:v1": func(a, b []byte) ([]byte, error) {
+		x, y, err := decodeBoth("beam:go:metrics:gauge_summary_int64:v1", a, b)
+		if err != nil {
+			return nil, err
+		}
+		m, n := x.(GaugeSummaryData), y.(GaugeSummaryData)
+		if m.Timestamp.After(n.Timestamp) {
+			n.Timestamp, n.Last = m.Timestamp, m.Last
+		}
+		if m.Min < n.Min {
+			n.Min = m.Min
+		}
+		if m.Max > n.Max {
+			n.Max = m.Max
+		}
+		return gaugeSummary(n.Timestamp, n.Min, n.Max, n.Last)
+	},
+	"beam:metrics:latest_string:v1": func(a, b []byte) ([]byte, error) {
+		x, y, err := decodeBoth("beam:metrics:latest_string:v1", a, b)
+		if err != nil {
+			return nil, err
+		}
+		if x.(StringGaugeData).Timestamp.After(y.(StringGaugeData).Timestamp) {
+			return a, nil
+		}
+		return b, nil
+	},
+}
+
+// decodeBoth decodes two payloads of the given encoding type.
+func decodeBoth(typ string, a, b []byte) (interface{}, interface{}, error) {
+	x, err := decodePayload(typ, a)
+	if err != nil {
+		return nil, nil, err
+	}
+	y, err := decodePayload(typ, b)
+	if err != nil {
+		return nil, nil, err
+	}
+	return x, y, nil
+}
+
+func init() {
+	for i, urn := range sUrns[:urnTestSentinel] {
+		if c, ok := typeCombiners[urnToType(mUrn(i))]; ok {
+			RegisterCombiner(urn, c)
+		}
+	}
+}
+
+// addSaturating returns a+b, saturating at math.MaxInt64 or math.MinInt64
+// rather than wrapping around.
+func addSaturating(a, b int64) int64 {
+	n := a + b
+	switch {
+	case b > 0 && n < a:
+		return math.MaxInt64
+	case b < 0 && n > a:
+		return math.MinInt64
+	}
+	return n
+}
@@ -0,0 +1,119 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package harness
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMergePayloads_Custom(t *testing.T) {
+	const urn = "beam:metric:test:merge_max:v1"
+	if _, err := MergePayloads(urn, nil, nil); err == nil {
+		t.Fatalf("MergePayloads(%v) succeeded without a registered combiner", urn)
+	}
+	defer func() {
+		combiners.mu.Lock()
+		delete(combiners.m, urn)
+		combiners.mu.Unlock()
+	}()
+	calls := 0
+	RegisterCombiner(urn, func(a, b []byte) ([]byte, error) {
+		calls++
+		x, y, err := decodeBoth("beam:metrics:sum_int64:v1", a, b)
+		if err != nil {
+			return nil, err
+		}
+		if x.(int64) > y.(int64) {
+			return a, nil
+		}
+		return b, nil
+	})
+
+	a, _ := int64Counter(7)
+	b, _ := int64Counter(3)
+	merged, err := MergePayloads(urn, a, b)
+	if err != nil {
+		t.Fatalf("MergePayloads(%v) failed: %v", urn, err)
+	}
+	if calls != 1 {
+		t.Errorf("custom combiner called %d times, want 1", calls)
+	}
+	v, err := decodePayload("beam:metrics:sum_int64:v1", merged)
+	if err != nil {
+		t.Fatalf("failed to decode merged payload: %v", err)
+	}
+	if got, want := v.(int64), int64(7); got != want {
+		t.Errorf("merged value = %d, want %d", got, want)
+	}
+}
+
+func TestMergePayloads_Builtin(t *testing.T) {
+	early, late := time.Unix(1, 0), time.Unix(2, 0)
+	must := func(b []byte, err error) []byte {
+		if err != nil {
+			t.Fatalf("encoding failed: %v", err)
+		}
+		return b
+	}
+	tests := []struct {
+		urn  mUrn
+		a, b []byte
+		want interface{}
+	}{
+		{urnUserSumInt64, must(int64Counter(2)), must(int64Counter(3)), int64(5)},
+		{urnUserSumFloat64, must(float64Counter(0.5)), must(float64Counter(1)), 1.5},
+		{urnUserDistInt64, must(int64Distribution(1, 4, 4, 4)), must(int64Distribution(2, 3, 1, 2)), DistributionData{3, 7, 1, 4}},
+		{urnUserMinMaxInt64, must(minMaxInt64(2, 5)), must(minMaxInt64(1, 3)), MinMaxData{1, 5}},
+		{urnUserSumFixed, must(fixedSum(150, 2)), must(fixedSum(-25, 2)), FixedData{125, 2}},
+		{urnUserSumFixed, must(fixedSum(math.MaxInt64-1, 2)), must(fixedSum(5, 2)), FixedData{math.MaxInt64, 2}},
+		{urnUserSumFixed, must(fixedSum(math.MinInt64+1, 2)), must(fixedSum(-5, 2)), FixedData{math.MinInt64, 2}},
+		{urnUserDistStatsInt64, must(distributionStats(1, 4, 4, 4, 16)), must(distributionStats(2, 3, 1, 2, 5)), DistributionStatsData{DistributionData{3, 7, 1, 4}, 21}},
+		{urnUserTableIntKeys, must(monitoringTableIntKeys(map[int64]int64{1: 2, 3: 4})), must(monitoringTableIntKeys(map[int64]int64{0: 1, 3: 1})), []IntTableRow{{0, 1}, {1, 2}, {3, 5}}},
+		{urnUserTableIntKeys, must(monitoringTableIntKeys(map[int64]int64{1: math.MaxInt64 - 1, 2: math.MinInt64 + 1})), must(monitoringTableIntKeys(map[int64]int64{1: 5, 2: -5})), []IntTableRow{{1, math.MaxInt64}, {2, math.MinInt64}}},
+		{urnUserCategoryCount, must(monitoringTableStringKeys(map[string]int64{"a": 2})), must(monitoringTableStringKeys(map[string]int64{"a": 1, "b": 1})), []StringTableRow{{"a", 3}, {"b", 1}}},
+		{urnUserCategoryCount, must(monitoringTableStringKeys(map[string]int64{"a": math.MaxInt64 - 1})), must(monitoringTableStringKeys(map[string]int64{"a": 5})), []StringTableRow{{"a", math.MaxInt64}}},
+		{urnUserLatestMsInt64, must(int64Latest(late, 1)), must(int64Latest(early, 2)), GaugeData{late, 1}},
+		{urnUserGaugeSummary, must(gaugeSummary(late, 2, 6, 3)), must(gaugeSummary(early, 1, 4, 4)), GaugeSummaryData{late, 1, 6, 3}},
+		{urnUserLatestMsString, must(stringLatest(early, "a")), must(stringLatest(late, "b")), StringGaugeData{late, "b"}},
+	}
+	for _, test := range tests {
+		urn := sUrns[test.urn]
+		merged, err := MergePayloads(urn, test.a, test.b)
+		if err != nil {
+			t.Errorf("MergePayloads(%v) failed: %v", urn, err)
+			continue
+		}
+		got, err := decodePayload(urnToType(test.urn), merged)
+		if err != nil {
+			t.Errorf("failed to decode merged %v payload: %v", urn, err)
+			continue
+		}
+		if !cmp.Equal(got, test.want, cmp.AllowUnexported(DistributionData{}, DistributionStatsData{})) {
+			t.Errorf("MergePayloads(%v) = %v, want %v", urn, got, test.want)
+		}
+	}
+
+	if _, err := MergePayloads(sUrns[urnUserSumFixed], must(fixedSum(1, 2)), must(fixedSum(1, 3))); err == nil {
+		t.Errorf("MergePayloads(%v) succeeded, want error for differing scales", sUrns[urnUserSumFixed])
+	}
+	if _, err := MergePayloads(sUrns[urnProgressFraction], nil, nil); err == nil {
+		t.Errorf("MergePayloads(%v) succeeded, want no combiner for progress", sUrns[urnProgressFraction])
+	}
+}
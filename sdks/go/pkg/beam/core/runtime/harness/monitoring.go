@@ -17,7 +17,15 @@ package harness
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -26,10 +34,77 @@ import (
 	"github.com/apache/beam/sdks/go/pkg/beam/core/graph/mtime"
 	"github.com/apache/beam/sdks/go/pkg/beam/core/metrics"
 	"github.com/apache/beam/sdks/go/pkg/beam/core/runtime/exec"
+	"github.com/apache/beam/sdks/go/pkg/beam/internal/errors"
+	"github.com/apache/beam/sdks/go/pkg/beam/log"
 	pipepb "github.com/apache/beam/sdks/go/pkg/beam/model/pipeline_v1"
+	"github.com/apache/beam/sdks/go/pkg/beam/util/syscallx"
+	"github.com/golang/protobuf/proto"
 )
 
-type mUrn uint32
+// MetricURN identifies a metric urn known to the harness, either built in
+// or registered with RegisterMetricURN.
+type MetricURN uint32
+
+// String returns the canonical urn string.
+func (u MetricURN) String() string {
+	if u <= urnTestSentinel {
+		return sUrns[u]
+	}
+	registered.mu.RLock()
+	defer registered.mu.RUnlock()
+	if i := int(u - urnTestSentinel - 1); i < len(registered.urns) {
+		return registered.urns[i]
+	}
+	return fmt.Sprintf("MetricURN(%d)", uint32(u))
+}
+
+// mUrn is the internal name for MetricURN.
+type mUrn = MetricURN
+
+// The built in metric urns, for use outside the harness.
+const (
+	URNUserSumInt64          MetricURN = urnUserSumInt64
+	URNUserSumFloat64        MetricURN = urnUserSumFloat64
+	URNUserDistInt64         MetricURN = urnUserDistInt64
+	URNUserDistFloat64       MetricURN = urnUserDistFloat64
+	URNUserLatestMsInt64     MetricURN = urnUserLatestMsInt64
+	URNUserLatestMsFloat64   MetricURN = urnUserLatestMsFloat64
+	URNUserTopNInt64         MetricURN = urnUserTopNInt64
+	URNUserTopNFloat64       MetricURN = urnUserTopNFloat64
+	URNUserBottomNInt64      MetricURN = urnUserBottomNInt64
+	URNUserBottomNFloat64    MetricURN = urnUserBottomNFloat64
+	URNUserLatestMsString    MetricURN = urnUserLatestMsString
+	URNUserMinMaxInt64       MetricURN = urnUserMinMaxInt64
+	URNElementCount          MetricURN = urnElementCount
+	URNSampledByteSize       MetricURN = urnSampledByteSize
+	URNStartBundle           MetricURN = urnStartBundle
+	URNProcessBundle         MetricURN = urnProcessBundle
+	URNFinishBundle          MetricURN = urnFinishBundle
+	URNTransformTotalTime    MetricURN = urnTransformTotalTime
+	URNProgressRemaining     MetricURN = urnProgressRemaining
+	URNProgressCompleted     MetricURN = urnProgressCompleted
+	URNDataChannelReadIndex  MetricURN = urnDataChannelReadIndex
+	URNDataChannelReadBytes  MetricURN = urnDataChannelReadBytes
+	URNDataChannelWriteBytes MetricURN = urnDataChannelWriteBytes
+	URNProgressFraction      MetricURN = urnProgressFraction
+	URNTransformLatency      MetricURN = urnTransformLatency
+	URNWorkerHeartbeat       MetricURN = urnWorkerHeartbeat
+	URNTransformBundleCount  MetricURN = urnTransformBundleCount
+	URNDroppedMetrics        MetricURN = urnDroppedMetrics
+	URNWorkerCPUSeconds      MetricURN = urnWorkerCPUSeconds
+	URNWorkerMaxRSSBytes     MetricURN = urnWorkerMaxRSSBytes
+	URNTransformErrorCount   MetricURN = urnTransformErrorCount
+	URNTransformWallTime     MetricURN = urnTransformWallTime
+	URNUserGaugeHistory      MetricURN = urnUserGaugeHistory
+	URNUserSumFixed          MetricURN = urnUserSumFixed
+	URNBundleSummary         MetricURN = urnBundleSummary
+	URNUserDistStatsInt64    MetricURN = urnUserDistStatsInt64
+	URNTransformSplitCount   MetricURN = urnTransformSplitCount
+	URNUserTableIntKeys      MetricURN = urnUserTableIntKeys
+	URNCoderOps              MetricURN = urnCoderOps
+	URNUserCategoryCount     MetricURN = urnUserCategoryCount
+	URNUserGaugeSummary      MetricURN = urnUserGaugeSummary
+)
 
 // TODO: Pull these from the protos.
 var sUrns = [...]string{
@@ -43,6 +118,8 @@ var sUrns = [...]string{
 	"beam:metric:user:top_n_double:v1",
 	"beam:metric:user:bottom_n_int64:v1",
 	"beam:metric:user:bottom_n_double:v1",
+	"beam:metric:user:latest_string:v1",
+	"beam:metric:user:min_max_int64:v1",
 
 	"beam:metric:element_count:v1",
 	"beam:metric:sampled_byte_size:v1",
@@ -55,6 +132,26 @@ var sUrns = [...]string{
 	"beam:metric:ptransform_progress:remaining:v1",
 	"beam:metric:ptransform_progress:completed:v1",
 	"beam:metric:data_channel:read_index:v1",
+	"beam:metric:data_channel:read_bytes:v1",
+	"beam:metric:data_channel:write_bytes:v1",
+	"beam:metric:ptransform_progress:fraction:v1",
+	"beam:metric:ptransform_latency_distribution:v1",
+	"beam:metric:worker_heartbeat:v1",
+	"beam:metric:ptransform_bundle_count:v1",
+	"beam:metric:sdk_dropped_metrics:v1",
+	"beam:metric:worker:cpu_seconds:v1",
+	"beam:metric:worker:max_rss_bytes:v1",
+	"beam:metric:ptransform_error_count:v1",
+	"beam:metric:ptransform_wall_time_msecs:v1",
+	"beam:metric:user:gauge_history:v1",
+	"beam:metric:user:sum_fixed:v1",
+	"beam:metric:bundle_summary:v1",
+	"beam:metric:user:distribution_stats_int64:v1",
+	"beam:metric:ptransform_split_count:v1",
+	"beam:metric:user:table_int_keys:v1",
+	"beam:metric:sdk_coder_ops:v1",
+	"beam:metric:user:category_count:v1",
+	"beam:metric:user:gauge_summary:v1",
 
 	"TestingSentinelUrn", // Must remain last.
 }
@@ -70,6 +167,8 @@ const (
 	urnUserTopNFloat64
 	urnUserBottomNInt64
 	urnUserBottomNFloat64
+	urnUserLatestMsString
+	urnUserMinMaxInt64
 
 	urnElementCount
 	urnSampledByteSize
@@ -82,23 +181,86 @@ const (
 	urnProgressRemaining
 	urnProgressCompleted
 	urnDataChannelReadIndex
+	urnDataChannelReadBytes
+	urnDataChannelWriteBytes
+	urnProgressFraction
+	urnTransformLatency
+	urnWorkerHeartbeat
+	urnTransformBundleCount
+	urnDroppedMetrics
+	urnWorkerCPUSeconds
+	urnWorkerMaxRSSBytes
+	urnTransformErrorCount
+	urnTransformWallTime
+	urnUserGaugeHistory
+	urnUserSumFixed
+	urnBundleSummary
+	urnUserDistStatsInt64
+	urnTransformSplitCount
+	urnUserTableIntKeys
+	urnCoderOps
+	urnUserCategoryCount
+	urnUserGaugeSummary
 
 	urnTestSentinel // Must remain last.
 )
 
+// emittedURNs are the urns that monitoring produces payloads for.
+// Must be updated when monitoring emits a new urn.
+var emittedURNs = []mUrn{
+	urnUserSumInt64,
+	urnUserDistInt64,
+	urnUserLatestMsInt64,
+	urnUserLatestMsString,
+	urnUserMinMaxInt64,
+	urnElementCount,
+	urnDataChannelReadIndex,
+	urnDataChannelReadBytes,
+	urnDataChannelWriteBytes,
+	urnProgressFraction,
+	urnTransformLatency,
+	urnWorkerHeartbeat,
+	urnTransformBundleCount,
+	urnDroppedMetrics,
+	urnWorkerCPUSeconds,
+	urnWorkerMaxRSSBytes,
+	urnTransformErrorCount,
+	urnTransformWallTime,
+	urnUserGaugeHistory,
+	urnUserSumFixed,
+	urnUserDistStatsInt64,
+	urnTransformSplitCount,
+	urnUserTableIntKeys,
+	urnCoderOps,
+	urnUserCategoryCount,
+	urnUserGaugeSummary,
+}
+
+// SupportedMetricURNs returns the metric urns this harness reports.
+// Urns that are declared but not yet emitted are excluded, as are urns
+// only reported through pre-encoded metrics.
+func SupportedMetricURNs() []string {
+	urns := make([]string, 0, len(emittedURNs))
+	for _, u := range emittedURNs {
+		urns = append(urns, sUrns[u])
+	}
+	return urns
+}
+
 // urnToType maps the urn to it's encoding type.
 // This function is written to be inlinable by the compiler.
+// Urns registered with RegisterMetricURN are handled by registeredType.
 func urnToType(u mUrn) string {
 	switch u {
-	case urnUserSumInt64, urnElementCount, urnStartBundle, urnProcessBundle, urnFinishBundle, urnTransformTotalTime:
+	case urnUserSumInt64, urnElementCount, urnStartBundle, urnProcessBundle, urnFinishBundle, urnTransformTotalTime, urnTransformBundleCount, urnDroppedMetrics, urnTransformErrorCount, urnTransformWallTime, urnTransformSplitCount, urnCoderOps:
 		return "beam:metrics:sum_int64:v1"
-	case urnUserSumFloat64:
+	case urnUserSumFloat64, urnWorkerCPUSeconds:
 		return "beam:metrics:sum_double:v1"
-	case urnUserDistInt64, urnSampledByteSize:
+	case urnUserDistInt64, urnSampledByteSize, urnTransformLatency:
 		return "beam:metrics:distribution_int64:v1"
 	case urnUserDistFloat64:
 		return "beam:metrics:distribution_double:v1"
-	case urnUserLatestMsInt64:
+	case urnUserLatestMsInt64, urnWorkerMaxRSSBytes:
 		return "beam:metrics:latest_int64:v1"
 	case urnUserLatestMsFloat64:
 		return "beam:metrics:latest_double:v1"
@@ -110,10 +272,29 @@ func urnToType(u mUrn) string {
 		return "beam:metrics:bottom_n_int64:v1"
 	case urnUserBottomNFloat64:
 		return "beam:metrics:bottom_n_double:v1"
+	case urnUserLatestMsString:
+		return "beam:metrics:latest_string:v1"
+	case urnUserMinMaxInt64:
+		return "beam:metrics:min_max_int64:v1"
+	case urnUserGaugeHistory:
+		return "beam:metrics:gauge_history_int64:v1"
+	case urnUserSumFixed:
+		return "beam:metrics:sum_fixed:v1"
+	case urnBundleSummary:
+		return "beam:metrics:bundle_summary:v1"
+	case urnUserDistStatsInt64:
+		return "beam:metrics:distribution_stats_int64:v1"
+	// Types without a cross-language spec are private to the Go SDK.
+	case urnUserTableIntKeys:
+		return "beam:go:metrics:monitoring_table_int_keys:v1"
+	case urnUserCategoryCount:
+		return "beam:go:metrics:monitoring_table_string_keys:v1"
+	case urnUserGaugeSummary:
+		return "beam:go:metrics:gauge_summary_int64:v1"
 
-	case urnProgressRemaining, urnProgressCompleted:
+	case urnProgressRemaining, urnProgressCompleted, urnProgressFraction:
 		return "beam:metrics:progress:v1"
-	case urnDataChannelReadIndex:
+	case urnDataChannelReadIndex, urnDataChannelReadBytes, urnDataChannelWriteBytes, urnWorkerHeartbeat:
 		return "beam:metrics:sum_int64:v1"
 
 	// Monitoring Table isn't currently in the protos.
@@ -124,220 +305,2315 @@ func urnToType(u mUrn) string {
 		return "TestingSentinelType"
 
 	default:
-		panic("metric urn without specified type" + sUrns[u])
+		return registeredType(u)
+	}
+}
+
+// registered retains the metric urns and types registered at runtime
+// by RegisterMetricURN. Their mUrns follow urnTestSentinel, so the
+// i-th registered urn has the mUrn urnTestSentinel+1+i.
+var registered = struct {
+	mu    sync.RWMutex
+	urns  []string
+	types []string
+	index map[string]mUrn
+}{index: make(map[string]mUrn)}
+
+// RegisterMetricURN registers a metric urn not built into the harness
+// along with its encoding type, and returns a handle usable with getShortID.
+//
+// Registering an already known urn with the same type returns the existing
+// handle. Registering a known urn with a different type is an error.
+func RegisterMetricURN(urn, typeURN string) (mUrn, error) {
+	if urn == "" || typeURN == "" {
+		return 0, errors.Errorf("metric urn and type must be non-empty, got %q and %q", urn, typeURN)
+	}
+	for i, s := range sUrns {
+		if s != urn {
+			continue
+		}
+		u := mUrn(i)
+		if t := urnToType(u); t != typeURN {
+			return 0, errors.Errorf("metric urn %v already has type %v, can't register it with type %v", urn, t, typeURN)
+		}
+		return u, nil
+	}
+
+	registered.mu.Lock()
+	defer registered.mu.Unlock()
+	if u, ok := registered.index[urn]; ok {
+		if t := registered.types[u-urnTestSentinel-1]; t != typeURN {
+			return 0, errors.Errorf("metric urn %v already has type %v, can't register it with type %v", urn, t, typeURN)
+		}
+		return u, nil
+	}
+	u := urnTestSentinel + 1 + mUrn(len(registered.urns))
+	registered.urns = append(registered.urns, urn)
+	registered.types = append(registered.types, typeURN)
+	registered.index[urn] = u
+	return u, nil
+}
+
+// lookupURN returns the mUrn for a builtin urn, or one registered with
+// RegisterMetricURN.
+func lookupURN(urn string) (mUrn, bool) {
+	for i, s := range sUrns {
+		if s == urn {
+			return mUrn(i), true
+		}
+	}
+	registered.mu.RLock()
+	defer registered.mu.RUnlock()
+	u, ok := registered.index[urn]
+	return u, ok
+}
+
+// registeredType returns the type of a urn registered with RegisterMetricURN.
+func registeredType(u mUrn) string {
+	registered.mu.RLock()
+	defer registered.mu.RUnlock()
+	i := int(u - urnTestSentinel - 1)
+	if u <= urnTestSentinel || i >= len(registered.types) {
+		panic(fmt.Sprintf("metric urn without specified type: %d", u))
+	}
+	return registered.types[i]
+}
+
+// urnString returns the urn string for the given mUrn, including those
+// registered with RegisterMetricURN.
+func urnString(u mUrn) string {
+	if u <= urnTestSentinel {
+		return sUrns[u]
+	}
+	registered.mu.RLock()
+	defer registered.mu.RUnlock()
+	return registered.urns[u-urnTestSentinel-1]
+}
+
+// newMonitoringInfo returns a MonitoringInfo for the urn, with the
+// urn's encoding type. The labels map isn't copied.
+func newMonitoringInfo(urn mUrn, labels map[string]string, payload []byte) *pipepb.MonitoringInfo {
+	return &pipepb.MonitoringInfo{
+		Urn:     urnString(urn),
+		Type:    urnToType(urn),
+		Labels:  labels,
+		Payload: payload,
 	}
 }
 
-type shortKey struct {
+// MetricKey identifies a metric by its labels and urn.
+type MetricKey struct {
 	metrics.Labels
-	Urn mUrn // Urns fully specify their type.
+	Urn MetricURN // Urns fully specify their type.
 }
 
+// shortKey is the internal name for MetricKey.
+type shortKey = MetricKey
+
+// A shortIDCache has shortIDShards shards. The shard of a short id is in
+// its low shortIDShardBits bits.
+const (
+	shortIDShardBits = 4
+	shortIDShards    = 1 << shortIDShardBits
+)
+
 // shortIDCache retains lookup caches for short ids to the full monitoring
 // info metadata.
 //
-// TODO: 2020/03/26 - measure mutex overhead vs sync.Map for this case.
-// sync.Map might have lower contention for this read heavy load.
+// The cache is sharded by a hash of the metric, so many new metrics, such
+// as at job start, can be added concurrently. Each shard assigns ids from
+// its own counter, with the shard index in the low bits of the id, so ids
+// are unique across shards and any id can be resolved to its shard. The
+// hash is deterministic, so metrics registered in the same order are
+// assigned the same ids by every process.
 type shortIDCache struct {
+	shards [shortIDShards]shortIDShard
+}
+
+// shortIDShard is a shard of a shortIDCache.
+type shortIDShard struct {
 	mu              sync.Mutex
 	labels2ShortIds map[shortKey]string
 	shortIds2Infos  map[string]*pipepb.MonitoringInfo
 
+	// newIDs are the short ids created since the last call to newShortIDs,
+	// whose metadata hasn't been sent yet. Once more than maxNewShortIDs
+	// accumulate, they're discarded and newOverflow is set instead.
+	newIDs      []string
+	newOverflow bool
+
 	lastShortID int64
 }
 
+// maxNewShortIDs is the number of new short ids each shard tracks between
+// calls to newShortIDs, bounding their memory if they're never collected.
+var maxNewShortIDs = 1 << 12
+
 func newShortIDCache() *shortIDCache {
-	return &shortIDCache{
-		labels2ShortIds: make(map[shortKey]string),
-		shortIds2Infos:  make(map[string]*pipepb.MonitoringInfo),
+	c := &shortIDCache{}
+	for i := range c.shards {
+		c.shards[i].labels2ShortIds = make(map[shortKey]string)
+		c.shards[i].shortIds2Infos = make(map[string]*pipepb.MonitoringInfo)
+	}
+	return c
+}
+
+// shardFor returns the shard index for the metric, from an FNV-1a hash of
+// its labels and urn.
+func (c *shortIDCache) shardFor(k shortKey) int {
+	h := labelsHash(k.Labels)
+	var b [20]byte
+	binary.LittleEndian.PutUint32(b[:4], uint32(k.Urn))
+	if start, end, ok := k.Window(); ok {
+		binary.LittleEndian.PutUint64(b[4:12], uint64(start))
+		binary.LittleEndian.PutUint64(b[12:], uint64(end))
 	}
+	for _, v := range b {
+		h = fnvAddByte(h, v)
+	}
+	return int(h & (shortIDShards - 1))
+}
+
+// FNV-1a hash parameters, from hash/fnv. The hash is computed inline to
+// avoid allocating a hash.Hash64 per lookup.
+const (
+	fnvOffset64 = 14695981039346656037
+	fnvPrime64  = 1099511628211
+)
+
+// labelsHash returns the FNV-1a hash of the string labels of l, which
+// excludes the window and scale. Tags are hashed by their encoding, so
+// hashing doesn't allocate.
+func labelsHash(l metrics.Labels) uint64 {
+	h := uint64(fnvOffset64)
+	for _, s := range [...]string{l.Transform(), l.Namespace(), l.Name(), l.PCollection(), l.Tenant(), l.Worker(), l.Tags().Encoding()} {
+		h = fnvAdd(h, s)
+		h = fnvAddByte(h, 0)
+	}
+	return h
+}
+
+// fnvAdd returns the FNV-1a hash h extended with the bytes of s.
+func fnvAdd(h uint64, s string) uint64 {
+	for i := 0; i < len(s); i++ {
+		h = fnvAddByte(h, s[i])
+	}
+	return h
+}
+
+// fnvAddByte returns the FNV-1a hash h extended with c.
+func fnvAddByte(h uint64, c byte) uint64 {
+	return (h ^ uint64(c)) * fnvPrime64
 }
 
-func (c *shortIDCache) getNextShortID() string {
-	id := atomic.AddInt64(&c.lastShortID, 1)
+// shardOf returns the shard that assigned the short id, or nil if the id
+// isn't a valid short id.
+func (c *shortIDCache) shardOf(s string) *shortIDShard {
+	id, err := strconv.ParseInt(s, 36, 64)
+	if err != nil || id < 0 {
+		return nil
+	}
+	return &c.shards[id&(shortIDShards-1)]
+}
+
+// getNextShortID returns a new short id for the shard at index i.
+// Assumes the shard's lock is held.
+func (c *shortIDCache) getNextShortID(i int) string {
+	sh := &c.shards[i]
+	sh.lastShortID++
 	// No reason not to use the smallest string short ids possible.
-	return strconv.FormatInt(id, 36)
+	return strconv.FormatInt(sh.lastShortID<<shortIDShardBits|int64(i), 36)
 }
 
 // getShortID returns the short id for the given metric, and if
 // it doesn't exist yet, stores the metadata.
-// Assumes c.mu lock is held.
 func (c *shortIDCache) getShortID(l metrics.Labels, urn mUrn) string {
+	s, _ := c.getShortIDInfo(l, urn)
+	return s
+}
+
+// getShortIDInfo returns the short id for the given metric along with
+// its cached payload-less metadata, storing the metadata if it doesn't
+// exist yet. The returned MonitoringInfo must not be modified.
+func (c *shortIDCache) getShortIDInfo(l metrics.Labels, urn mUrn) (string, *pipepb.MonitoringInfo) {
 	k := shortKey{l, urn}
-	s, ok := c.labels2ShortIds[k]
-	if ok {
-		return s
+	i := c.shardFor(k)
+	sh := &c.shards[i]
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return c.resolve(i, k)
+}
+
+// getShortIDs returns the short ids for the given metrics, storing the
+// metadata of those that don't exist yet.
+func (c *shortIDCache) getShortIDs(keys []shortKey) []string {
+	ids, _ := c.getShortIDInfos(keys)
+	return ids
+}
+
+// getShortIDInfos is the batched form of getShortIDInfo, returning the short
+// ids and cached metadata of the metrics, in the order of keys. Keys are
+// grouped by shard, so each shard is locked once per batch rather than once
+// per metric.
+func (c *shortIDCache) getShortIDInfos(keys []shortKey) ([]string, []*pipepb.MonitoringInfo) {
+	ids := make([]string, len(keys))
+	infos := make([]*pipepb.MonitoringInfo, len(keys))
+	var byShard [shortIDShards][]int
+	for j, k := range keys {
+		i := c.shardFor(k)
+		byShard[i] = append(byShard[i], j)
+	}
+	for i, js := range byShard {
+		if len(js) == 0 {
+			continue
+		}
+		sh := &c.shards[i]
+		sh.mu.Lock()
+		for _, j := range js {
+			ids[j], infos[j] = c.resolve(i, keys[j])
+		}
+		sh.mu.Unlock()
+	}
+	return ids, infos
+}
+
+// resolveShortIDInfos returns the short ids and cached metadata of the
+// metrics of an extraction, like getShortIDInfos.
+//
+// With deterministic short ids enabled, new ids are only assigned in the
+// final extraction of a bundle, which holds the bundle's full set of
+// metrics, in the sorted order of their keys rather than the order they
+// were extracted in. Earlier extractions only resolve existing ids, and
+// return an empty id and nil metadata for the other metrics.
+func (c *shortIDCache) resolveShortIDInfos(keys []shortKey, final bool) ([]string, []*pipepb.MonitoringInfo) {
+	if atomic.LoadInt32(&deterministicShortIDs) == 0 {
+		return c.getShortIDInfos(keys)
 	}
-	s = c.getNextShortID()
-	c.labels2ShortIds[k] = s
-	c.shortIds2Infos[s] = &pipepb.MonitoringInfo{
-		Urn:    sUrns[urn],
-		Type:   urnToType(urn),
-		Labels: userLabels(l),
+	if !final {
+		return c.lookupShortIDInfos(keys)
 	}
-	return s
+	order := make([]int, len(keys))
+	for j := range order {
+		order[j] = j
+	}
+	sort.Slice(order, func(a, b int) bool {
+		return shortKeyLess(keys[order[a]], keys[order[b]])
+	})
+	sorted := make([]shortKey, len(keys))
+	for j, o := range order {
+		sorted[j] = keys[o]
+	}
+	sortedIDs, sortedInfos := c.getShortIDInfos(sorted)
+	ids := make([]string, len(keys))
+	infos := make([]*pipepb.MonitoringInfo, len(keys))
+	for j, o := range order {
+		ids[o], infos[o] = sortedIDs[j], sortedInfos[j]
+	}
+	return ids, infos
+}
+
+// lookupShortIDInfos returns the existing short ids and cached metadata of
+// the metrics, in the order of keys, without assigning new ids. Metrics
+// without short ids have an empty id and nil metadata.
+func (c *shortIDCache) lookupShortIDInfos(keys []shortKey) ([]string, []*pipepb.MonitoringInfo) {
+	ids := make([]string, len(keys))
+	infos := make([]*pipepb.MonitoringInfo, len(keys))
+	for j, k := range keys {
+		sh := &c.shards[c.shardFor(k)]
+		sh.mu.Lock()
+		if s, ok := sh.labels2ShortIds[k]; ok {
+			ids[j], infos[j] = s, sh.shortIds2Infos[s]
+		}
+		sh.mu.Unlock()
+	}
+	return ids, infos
+}
+
+// shortKeyLess orders keys by urn, then labels. Tags are compared by their
+// encoding, which orders them by key, then value.
+func shortKeyLess(a, b shortKey) bool {
+	if a.Urn != b.Urn {
+		return a.Urn < b.Urn
+	}
+	as := [...]string{a.Transform(), a.Namespace(), a.Name(), a.PCollection(), a.Tenant(), a.Worker(), a.Tags().Encoding()}
+	bs := [...]string{b.Transform(), b.Namespace(), b.Name(), b.PCollection(), b.Tenant(), b.Worker(), b.Tags().Encoding()}
+	for i := range as {
+		if as[i] != bs[i] {
+			return as[i] < bs[i]
+		}
+	}
+	aStart, aEnd, aOK := a.Window()
+	bStart, bEnd, bOK := b.Window()
+	switch {
+	case aOK != bOK:
+		return !aOK
+	case aStart != bStart:
+		return aStart < bStart
+	case aEnd != bEnd:
+		return aEnd < bEnd
+	}
+	return a.Scale() < b.Scale()
+}
+
+// resolve returns the short id and metadata for the metric in the shard at
+// index i, storing them if they don't exist yet. Assumes the shard's lock
+// is held.
+func (c *shortIDCache) resolve(i int, k shortKey) (string, *pipepb.MonitoringInfo) {
+	sh := &c.shards[i]
+	if s, ok := sh.labels2ShortIds[k]; ok {
+		return s, sh.shortIds2Infos[s]
+	}
+	s := c.getNextShortID(i)
+	sh.labels2ShortIds[k] = s
+	info := newMonitoringInfo(k.Urn, monitoringLabels(k.Labels), nil)
+	sh.shortIds2Infos[s] = info
+	switch {
+	case sh.newOverflow:
+	case len(sh.newIDs) >= maxNewShortIDs:
+		sh.newIDs = nil
+		sh.newOverflow = true
+	default:
+		sh.newIDs = append(sh.newIDs, s)
+	}
+	return s, info
+}
+
+// lookup returns the cached metadata for the short id, if any.
+func (c *shortIDCache) lookup(s string) (*pipepb.MonitoringInfo, bool) {
+	sh := c.shardOf(s)
+	if sh == nil {
+		return nil, false
+	}
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	info, ok := sh.shortIds2Infos[s]
+	return info, ok
+}
+
+// newShortIDs returns the short ids created since the last call, and
+// resets the set. Ids are in creation order within each shard. If a shard
+// created more than maxNewShortIDs ids since the last call, all of its ids
+// are returned instead, in no particular order.
+func (c *shortIDCache) newShortIDs() []string {
+	var ids []string
+	for i := range c.shards {
+		sh := &c.shards[i]
+		sh.mu.Lock()
+		if sh.newOverflow {
+			for s := range sh.shortIds2Infos {
+				ids = append(ids, s)
+			}
+		} else {
+			ids = append(ids, sh.newIDs...)
+		}
+		sh.newIDs = nil
+		sh.newOverflow = false
+		sh.mu.Unlock()
+	}
+	return ids
 }
 
 func (c *shortIDCache) shortIdsToInfos(shortids []string) map[string]*pipepb.MonitoringInfo {
-	c.mu.Lock()
-	defer c.mu.Unlock()
 	m := make(map[string]*pipepb.MonitoringInfo, len(shortids))
 	for _, s := range shortids {
-		m[s] = c.shortIds2Infos[s]
+		info, _ := c.lookup(s)
+		m[s] = info
 	}
 	return m
 }
 
+// Snapshot returns a deep copy of the metadata of every short id in the
+// cache, keyed by short id. Changes to the snapshot don't affect the cache.
+func (c *shortIDCache) Snapshot() map[string]*pipepb.MonitoringInfo {
+	m := make(map[string]*pipepb.MonitoringInfo)
+	for i := range c.shards {
+		sh := &c.shards[i]
+		sh.mu.Lock()
+		for s, info := range sh.shortIds2Infos {
+			m[s] = proto.Clone(info).(*pipepb.MonitoringInfo)
+		}
+		sh.mu.Unlock()
+	}
+	return m
+}
+
+// EstimatedMemoryBytes returns an approximation of the memory retained by
+// the cache: the label strings of the keys, the short ids, and the encoded
+// size of the cached metadata. Map and struct overheads aren't included.
+func (c *shortIDCache) EstimatedMemoryBytes() int64 {
+	var n int64
+	for i := range c.shards {
+		sh := &c.shards[i]
+		sh.mu.Lock()
+		for k, s := range sh.labels2ShortIds {
+			n += int64(len(k.Transform()) + len(k.Namespace()) + len(k.Name()) + len(k.PCollection()) + len(k.Tenant()) + len(k.Worker()) + len(k.Tags().Encoding()))
+			// Each short id is stored as a value, and as a key of shortIds2Infos.
+			n += 2 * int64(len(s))
+		}
+		for _, info := range sh.shortIds2Infos {
+			n += int64(proto.Size(info))
+		}
+		sh.mu.Unlock()
+	}
+	return n
+}
+
 // Convenience package functions for production.
 var defaultShortIDCache *shortIDCache
 
 func init() {
+	if err := checkURNTables(); err != nil {
+		panic(err)
+	}
 	defaultShortIDCache = newShortIDCache()
 }
 
+// checkURNTables validates that sUrns and the mUrn constants haven't drifted
+// apart, and that every built in urn has an encoding type. It's checked at
+// startup so a mismatch fails fast, instead of misreporting metrics later.
+func checkURNTables() (err error) {
+	if got, want := len(sUrns), int(urnTestSentinel)+1; got != want {
+		return errors.Errorf("sUrns has %d urns, but there are %d mUrn constants; urns must be added to both", got, want)
+	}
+	if got, want := sUrns[urnTestSentinel], "TestingSentinelUrn"; got != want {
+		return errors.Errorf("sUrns[urnTestSentinel] = %q, want %q; the sentinel must remain last", got, want)
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			err = errors.Errorf("metric urn table is inconsistent: %v", p)
+		}
+	}()
+	for i := range sUrns {
+		urnToType(mUrn(i))
+	}
+	if got, want := urnToType(urnTestSentinel), "TestingSentinelType"; got != want {
+		return errors.Errorf("urnToType(urnTestSentinel) = %q, want %q", got, want)
+	}
+	return nil
+}
+
 func getShortID(l metrics.Labels, urn mUrn) string {
 	return defaultShortIDCache.getShortID(l, urn)
 }
 
+// NewShortIDs returns the short ids created since the last call, so
+// runners caching metadata only need to be sent the metadata for those.
+// Each short id is returned at least once. The ids tracked between calls
+// are bounded, and if too many accumulate, the next call returns every
+// short id, so that the metadata of all of them is resent.
+func NewShortIDs() []string {
+	return defaultShortIDCache.newShortIDs()
+}
+
+// ShortIDSnapshot returns a copy of the metadata for every short id the
+// harness has assigned, for debugging.
+func ShortIDSnapshot() map[string]*pipepb.MonitoringInfo {
+	return defaultShortIDCache.Snapshot()
+}
+
+// ShortIDCacheMemoryBytes returns an estimate of the memory used to cache
+// short ids, to help detect metric cardinality blowups in long running jobs.
+func ShortIDCacheMemoryBytes() int64 {
+	return defaultShortIDCache.EstimatedMemoryBytes()
+}
+
+// PreregisterMetrics assigns short ids to the metrics, in order, before
+// they're first reported. Short ids are otherwise assigned as metrics are
+// first reported, which varies between runs. Registering a pipeline's
+// metrics in the same order at startup, before any bundle runs, assigns
+// them the same ids on every worker and across restarts, so runners can
+// reuse cached metadata. Metrics that already have short ids keep them.
+func PreregisterMetrics(keys []MetricKey) {
+	defaultShortIDCache.getShortIDs(keys)
+}
+
+// deterministicShortIDs is whether short ids are assigned in sorted key
+// order. Accessed atomically.
+var deterministicShortIDs int32
+
+// SetDeterministicShortIDs sets whether the short ids of a bundle's new
+// metrics are assigned once, from the sorted order of the urns and labels
+// of all the bundle's metrics, rather than in the order they're first
+// extracted, which varies between runs. Workers running the same bundles
+// then assign the same metrics the same ids, so runners can reuse cached
+// metadata, at the cost of sorting each bundle's metrics. Progress reports
+// carry metrics that don't have short ids yet by their full labels only.
+// Disabled by default.
+func SetDeterministicShortIDs(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&deterministicShortIDs, v)
+}
+
 func shortIdsToInfos(shortids []string) map[string]*pipepb.MonitoringInfo {
 	return defaultShortIDCache.shortIdsToInfos(shortids)
 }
 
-func monitoring(p *exec.Plan) ([]*pipepb.MonitoringInfo, map[string][]byte) {
+// metricsSource is the subset of *exec.Plan that monitoring extracts
+// metrics from.
+type metricsSource interface {
+	// Store returns the metric store for the current or last bundle.
+	Store() *metrics.Store
+	// Progress returns the progress of the input source, if any.
+	Progress() (exec.ProgressReportSnapshot, bool)
+	// DataSinkElements returns the elements written by data sinks, by PCollection.
+	DataSinkElements() map[string]int64
+	// DataSinkBytes returns the bytes written by data sinks, by PCollection.
+	DataSinkBytes() map[string]int64
+}
+
+var _ metricsSource = (*exec.Plan)(nil)
+
+// elementSizeSampler is optionally implemented by metricsSources that
+// sample the encoded sizes of the elements they write.
+type elementSizeSampler interface {
+	// DataSinkElementSizes returns the sampled element sizes, by PCollection.
+	DataSinkElementSizes() map[string]exec.SizeSnapshot
+}
+
+var _ elementSizeSampler = (*exec.Plan)(nil)
+
+// bundleCounter is optionally implemented by metricsSources that count
+// the bundles their transforms participated in.
+type bundleCounter interface {
+	// BundleCounts returns the bundles processed in the current bundle,
+	// so 1 for each transform once it has started, by transform.
+	BundleCounts() map[string]int64
+}
+
+var _ bundleCounter = (*exec.Plan)(nil)
+
+// errorCounter is optionally implemented by metricsSources that count the
+// errors their transforms failed with or handled.
+type errorCounter interface {
+	// ErrorCounts returns the errors transforms failed with or handled in
+	// the current bundle, by transform.
+	ErrorCounts() map[string]int64
+}
+
+var _ errorCounter = (*exec.Plan)(nil)
+
+// wallTimer is optionally implemented by metricsSources that measure the
+// wall time spent in their transforms.
+type wallTimer interface {
+	// WallTimes returns the wall time spent in the current bundle, by
+	// transform.
+	WallTimes() map[string]time.Duration
+}
+
+var _ wallTimer = (*exec.Plan)(nil)
+
+// splitCounter is optionally implemented by metricsSources that count the
+// dynamic splits performed in their transforms.
+type splitCounter interface {
+	// SplitCounts returns the dynamic splits performed in the current
+	// bundle, by transform.
+	SplitCounts() map[string]int64
+}
+
+var _ splitCounter = (*exec.Plan)(nil)
+
+// coderOpsCounter is optionally implemented by metricsSources that count
+// the elements encoded and decoded by their transforms.
+type coderOpsCounter interface {
+	// CoderOps returns the elements encoded or decoded, by transform.
+	CoderOps() map[string]int64
+}
+
+var _ coderOpsCounter = (*exec.Plan)(nil)
+
+// monitoring extracts the MonitoringInfos and short id keyed payloads for
+// the given plan.
+//
+// Concurrent bundles share the defaultShortIDCache, so identical metrics in
+// different bundles share a short id. This is intended: short ids only
+// identify metric metadata, which runners cache across instructions, while
+// the payloads are extracted from the plan's own per bundle store and
+// returned in that instruction's response, so values never cross bundles.
+//
+// It's safe to call concurrently for the same plan, such as from a progress
+// ticker and the final report. Each call extracts its own snapshot: the set
+// of metrics is read under the store's read lock, and each metric's value
+// is read atomically, so values never go backwards between calls. Metrics
+// keep being updated during extraction, so a snapshot isn't consistent
+// across metrics; the final report is exact once the bundle has finished.
+//
+// Extraction may race with the plan being torn down. If extraction fails
+// part way, the metrics collected so far are returned along with an error
+// wrapping errPartialMonitoring. If a counter overflowed, all metrics are
+// returned along with an error wrapping metrics.ErrCounterOverflow.
+// Metrics whose payloads fail to encode are skipped, and counted by the
+// worker level sdk_dropped_metrics metric.
+func monitoring(p metricsSource) (monitoringInfo []*pipepb.MonitoringInfo, payloads map[string][]byte, err error) {
+	return filteredMonitoring(p, nil, nil)
+}
+
+// resetBundleMetrics clears the user metric cells of the plan's completed
+// bundle, once its final metrics have been reported.
+//
+// User metrics are cumulative within a bundle: every report for a bundle,
+// tentative or final, carries the bundle's running totals, and the runner
+// keeps the latest report of each bundle and sums the final values across
+// bundles. So a bundle's cells must be reported in full exactly once in a
+// final report, and never again, or the runner double counts them. Each
+// execution of a plan starts with fresh cells, and resetting the plan once
+// its bundle is reported ensures a plan idling between bundles reports
+// nothing further. The short id cache is left intact, as short ids stay
+// valid across bundles.
+func resetBundleMetrics(p *exec.Plan) {
+	p.ResetStore()
+}
+
+// workerCPU attributes the worker's CPU time to bundles. Like other sums,
+// cpu_seconds is summed across the final reports of bundles, so each report
+// carries the CPU time used since the last final report, rather than the
+// process total. A final report claims its CPU time as it's sampled, so
+// the final reports of concurrent bundles never cover the same interval.
+var workerCPU = &cpuAccount{}
+
+type cpuAccount struct {
+	mu        sync.Mutex
+	committed time.Duration // CPU time claimed by final reports.
+}
+
+// claim returns the CPU time used since the last final report, and marks
+// it as reported.
+func (a *cpuAccount) claim(cpu time.Duration) time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	d := a.uncommitted(cpu)
+	if cpu > a.committed {
+		a.committed = cpu
+	}
+	return d
+}
+
+// peek is like claim, but leaves the CPU time unclaimed, as tentative
+// reports are superseded by their bundle's final report.
+func (a *cpuAccount) peek(cpu time.Duration) time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.uncommitted(cpu)
+}
+
+// uncommitted returns the CPU time used since the last final report. a.mu
+// must be held.
+func (a *cpuAccount) uncommitted(cpu time.Duration) time.Duration {
+	if d := cpu - a.committed; d > 0 {
+		return d
+	}
+	return 0
+}
+
+// monitoringForTransform is like monitoring, but only returns the metrics
+// attributed to the given transform, for debugging a single stage.
+func monitoringForTransform(p metricsSource, transformID string) ([]*pipepb.MonitoringInfo, map[string][]byte, error) {
+	return filteredMonitoring(p, func(l metrics.Labels) bool {
+		return l.Transform() == transformID
+	}, nil)
+}
+
+// peekMonitoring returns the plan's metrics with their full labels, for
+// local introspection. Unlike monitoring, it has no side effects: it
+// doesn't assign short ids, advance the heartbeat or call the emit hook.
+func peekMonitoring(p metricsSource) (monitoringInfo []*pipepb.MonitoringInfo, err error) {
+	_, _, err = extractMonitoring(p, nil, func(mi *pipepb.MonitoringInfo) error {
+		monitoringInfo = append(monitoringInfo, mi)
+		return nil
+	}, extractPeek)
+	return monitoringInfo, err
+}
+
+// finalMonitoring is like monitoring, for the final report of the plan's
+// bundle. With deterministic short ids, the bundle's new metrics are only
+// assigned short ids in its final report.
+func finalMonitoring(p metricsSource) (monitoringInfo []*pipepb.MonitoringInfo, payloads map[string][]byte, err error) {
+	return extractMonitoring(p, nil, nil, extractFinal)
+}
+
+// filteredMonitoring implements monitoring, only returning the metrics
+// for which keep returns true, if it's non-nil.
+//
+// If emit is non-nil, each MonitoringInfo is passed to it as it's produced
+// instead of being returned, and no payloads are returned, so callers
+// streaming the metrics elsewhere don't hold them all in memory. Streamed
+// MonitoringInfos carry their full labels, so they aren't assigned short
+// ids. Extraction stops at the first error emit returns, which is returned.
+func filteredMonitoring(p metricsSource, keep func(metrics.Labels) bool, emit func(*pipepb.MonitoringInfo) error) (monitoringInfo []*pipepb.MonitoringInfo, payloads map[string][]byte, err error) {
+	return extractMonitoring(p, keep, emit, extractReport)
+}
+
+// extraction is the purpose of an extraction, which determines its side
+// effects.
+type extraction int
+
+const (
+	// extractReport extracts metrics to report, such as for progress.
+	extractReport extraction = iota
+	// extractFinal extracts the final report of a bundle.
+	extractFinal
+	// extractPeek extracts metrics for local introspection. Peeking leaves
+	// the short ids, the heartbeat, the emit hook and the CPU accounting
+	// untouched.
+	extractPeek
+)
+
+// extractMonitoring implements filteredMonitoring, finalMonitoring and
+// peekMonitoring.
+func extractMonitoring(p metricsSource, keep func(metrics.Labels) bool, emit func(*pipepb.MonitoringInfo) error, mode extraction) (monitoringInfo []*pipepb.MonitoringInfo, payloads map[string][]byte, err error) {
+	peek := mode == extractPeek
+	var beat int64
+	if peek {
+		beat = atomic.LoadInt64(&heartbeat)
+	} else {
+		beat = atomic.AddInt64(&heartbeat, 1)
+	}
+
+	// The store is only read once, so the plan moving to a new store, or
+	// dropping it, doesn't affect this extraction.
 	store := p.Store()
 	if store == nil {
-		return nil, nil
+		return nil, nil, nil
 	}
 
-	defaultShortIDCache.mu.Lock()
-	defer defaultShortIDCache.mu.Unlock()
+	defer recoverPartial(&err)
+	defer recoverEmitStop(&err)
 
-	var monitoringInfo []*pipepb.MonitoringInfo
-	payloads := make(map[string][]byte)
-	metrics.Extractor{
+	payloads = make(map[string][]byte)
+	cutoff, skipStale := staleGaugeCutoff()
+	// addPayload queues the payload to be recorded under the metric's short
+	// id. All metrics of the bundle are labeled with its tenant, the
+	// worker id and the metric tags, if any, so tenants' and workers'
+	// identically named metrics have distinct short ids.
+	tenant := store.Tenant()
+	worker := getWorkerID()
+	tags := getMetricTags()
+	var keys []shortKey
+	var pending [][]byte
+	hook := emitHook()
+	if peek {
+		hook = nil
+	}
+	addPayload := func(l metrics.Labels, urn mUrn, payload []byte) {
+		if keep != nil && !keep(l) {
+			return
+		}
+		if tenant != "" {
+			l = l.WithTenant(tenant)
+		}
+		if worker != "" {
+			l = l.WithWorker(worker)
+		}
+		l = l.WithTags(tags)
+		if emit != nil {
+			mi := newMonitoringInfo(urn, monitoringLabels(l), payload)
+			if hook != nil {
+				hook(proto.Clone(mi).(*pipepb.MonitoringInfo))
+			}
+			if err := emit(mi); err != nil {
+				panic(emitStop{err})
+			}
+			return
+		}
+		keys = append(keys, shortKey{l, urn})
+		pending = append(pending, payload)
+	}
+	// The queued payloads' short ids are resolved in a single batch once
+	// extraction completes, appending MonitoringInfos that reuse the
+	// metadata cached with the short ids. Metrics that are yet to be
+	// assigned short ids are only returned as MonitoringInfos. It's
+	// deferred, so the metrics collected before extraction panics are still
+	// returned.
+	defer func() {
+		ids, infos := defaultShortIDCache.resolveShortIDInfos(keys, mode == extractFinal)
+		for j, s := range ids {
+			labels := infos[j].GetLabels()
+			if s == "" {
+				labels = monitoringLabels(keys[j].Labels)
+			}
+			mi := newMonitoringInfo(keys[j].Urn, labels, pending[j])
+			if hook != nil {
+				hook(proto.Clone(mi).(*pipepb.MonitoringInfo))
+			}
+			if s != "" {
+				payloads[s] = pending[j]
+			}
+			monitoringInfo = append(monitoringInfo, mi)
+		}
+	}()
+	// addEncoded adds the payload, unless it failed to encode, or doesn't
+	// have the layout of its type, in which case the metric is skipped and
+	// counted as dropped. Failures are logged at most once per
+	// dropLogInterval for each urn.
+	var dropped int64
+	addEncoded := func(l metrics.Labels, urn mUrn, payload []byte, err error) {
+		if err == nil {
+			err = checkPayload(urnToType(urn), payload)
+		}
+		if err != nil {
+			if n, ok := dropLog.allow(urn, now()); ok {
+				err = errors.WithContextf(err, "encoding %v for %v", urnString(urn), monitoringLabels(l))
+				dropWarnf("dropped a metric that failed to encode, and %d more of %v since the last warning: %v", n, urnString(urn), err)
+			}
+			dropped++
+			return
+		}
+		addPayload(l, urn, payload)
+	}
+	// When sampling, only the user metrics whose label sets are sampled are
+	// reported, with their additive values scaled to estimate the totals.
+	sampler := getMetricSampler()
+	// Overflowed counters are reported with their saturated values, and the
+	// overflow is returned as the error once extraction completes.
+	extractErr := metrics.Extractor{
 		SumInt64: func(l metrics.Labels, v int64) {
-			payload, err := int64Counter(v)
-			if err != nil {
-				panic(err)
-			}
-			payloads[getShortID(l, urnUserSumInt64)] = payload
-
-			monitoringInfo = append(monitoringInfo,
-				&pipepb.MonitoringInfo{
-					Urn:     sUrns[urnUserSumInt64],
-					Type:    urnToType(urnUserSumInt64),
-					Labels:  userLabels(l),
-					Payload: payload,
-				})
+			if !sampler.keep(l) {
+				return
+			}
+			payload, err := int64Counter(sampler.scaled(v))
+			addEncoded(l, urnUserSumInt64, payload, err)
 		},
 		DistributionInt64: func(l metrics.Labels, count, sum, min, max int64) {
-			payload, err := int64Distribution(count, sum, min, max)
-			if err != nil {
-				panic(err)
-			}
-			payloads[getShortID(l, urnUserDistInt64)] = payload
-
-			monitoringInfo = append(monitoringInfo,
-				&pipepb.MonitoringInfo{
-					Urn:     sUrns[urnUserDistInt64],
-					Type:    urnToType(urnUserDistInt64),
-					Labels:  userLabels(l),
-					Payload: payload,
-				})
+			if !sampler.keep(l) {
+				return
+			}
+			payload, err := int64Distribution(sampler.scaled(count), sampler.scaled(sum), min, max)
+			addEncoded(l, urnUserDistInt64, payload, err)
 		},
+		DistributionStatsInt64: func(l metrics.Labels, count, sum, min, max, sumSq int64) {
+			if !sampler.keep(l) {
+				return
+			}
+			payload, err := distributionStats(sampler.scaled(count), sampler.scaled(sum), min, max, sampler.scaled(sumSq))
+			addEncoded(l, urnUserDistStatsInt64, payload, err)
+		},
+		// Gauges report only their latest value. The store resolves multiple
+		// updates within a bundle, keeping the larger value on timestamp ties.
 		GaugeInt64: func(l metrics.Labels, v int64, t time.Time) {
+			if skipStale && clampMtime(t) < cutoff || !sampler.keep(l) {
+				return
+			}
 			payload, err := int64Latest(t, v)
-			if err != nil {
-				panic(err)
+			addEncoded(l, urnUserLatestMsInt64, payload, err)
+		},
+		GaugeString: func(l metrics.Labels, v string, t time.Time) {
+			if skipStale && clampMtime(t) < cutoff || !sampler.keep(l) {
+				return
+			}
+			payload, err := stringLatest(t, v)
+			addEncoded(l, urnUserLatestMsString, payload, err)
+		},
+		GaugeHistory: func(l metrics.Labels, samples []metrics.GaugeSample) {
+			if skipStale && clampMtime(samples[len(samples)-1].Timestamp) < cutoff || !sampler.keep(l) {
+				return
+			}
+			payload, err := gaugeHistory(samples)
+			addEncoded(l, urnUserGaugeHistory, payload, err)
+		},
+		GaugeSummary: func(l metrics.Labels, min, max, last int64, t time.Time) {
+			if skipStale && clampMtime(t) < cutoff || !sampler.keep(l) {
+				return
+			}
+			payload, err := gaugeSummary(t, min, max, last)
+			addEncoded(l, urnUserGaugeSummary, payload, err)
+		},
+		MinMaxInt64: func(l metrics.Labels, min, max int64) {
+			if !sampler.keep(l) {
+				return
+			}
+			payload, err := minMaxInt64(min, max)
+			addEncoded(l, urnUserMinMaxInt64, payload, err)
+		},
+		SumFixed: func(l metrics.Labels, mantissa int64, scale int32) {
+			if !sampler.keep(l) {
+				return
+			}
+			payload, err := fixedSum(sampler.scaled(mantissa), scale)
+			addEncoded(l, urnUserSumFixed, payload, err)
+		},
+		IntTable: func(l metrics.Labels, rows map[int64]int64) {
+			if !sampler.keep(l) {
+				return
+			}
+			for k, v := range rows {
+				rows[k] = sampler.scaled(v)
+			}
+			payload, err := monitoringTableIntKeys(rows)
+			addEncoded(l, urnUserTableIntKeys, payload, err)
+		},
+		CategoryCount: func(l metrics.Labels, counts map[string]int64) {
+			if !sampler.keep(l) {
+				return
+			}
+			for c, v := range counts {
+				counts[c] = sampler.scaled(v)
+			}
+			payload, err := monitoringTableStringKeys(counts)
+			addEncoded(l, urnUserCategoryCount, payload, err)
+		},
+		PreEncoded: func(l metrics.Labels, urn string, payload []byte) {
+			// Payloads for unknown urns are dropped, since their type is
+			// unknown. Pre-encoded values can't be scaled, only sampled.
+			if !sampler.keep(l) {
+				return
+			}
+			if u, ok := lookupURN(urn); ok {
+				addPayload(l, u, payload)
 			}
-			payloads[getShortID(l, urnUserLatestMsInt64)] = payload
-
-			monitoringInfo = append(monitoringInfo,
-				&pipepb.MonitoringInfo{
-					Urn:     sUrns[urnUserLatestMsInt64],
-					Type:    urnToType(urnUserLatestMsInt64),
-					Labels:  userLabels(l),
-					Payload: payload,
-				})
-
 		},
 	}.ExtractFrom(store)
 
 	// Get the execution monitoring information from the bundle plan.
-	if snapshot, ok := p.Progress(); ok {
+	snapshot, hasProgress := p.Progress()
+	if hasProgress {
 		payload, err := int64Counter(snapshot.Count)
-		if err != nil {
-			panic(err)
+		// TODO(BEAM-9934): This metric should account for elements in multiple windows.
+		addEncoded(metrics.PCollectionLabels(snapshot.PID), urnElementCount, payload, err)
+		addEncoded(metrics.PTransformLabels(snapshot.ID), urnDataChannelReadIndex, payload, err)
+
+		payload, err = int64Counter(snapshot.ReadBytes)
+		addEncoded(metrics.PCollectionLabels(snapshot.PID), urnDataChannelReadBytes, payload, err)
+
+		if snapshot.HasFraction {
+			payload, err = progressScalar(snapshot.Fraction)
+			addEncoded(metrics.PTransformLabels(snapshot.ID), urnProgressFraction, payload, err)
 		}
 
-		// TODO(BEAM-9934): This metric should account for elements in multiple windows.
-		payloads[getShortID(metrics.PCollectionLabels(snapshot.PID), urnElementCount)] = payload
-		monitoringInfo = append(monitoringInfo,
-			&pipepb.MonitoringInfo{
-				Urn:  sUrns[urnElementCount],
-				Type: urnToType(urnElementCount),
-				Labels: map[string]string{
-					"PCOLLECTION": snapshot.PID,
-				},
-				Payload: payload,
-			})
-
-		payloads[getShortID(metrics.PTransformLabels(snapshot.ID), urnDataChannelReadIndex)] = payload
-		monitoringInfo = append(monitoringInfo,
-			&pipepb.MonitoringInfo{
-				Urn:  sUrns[urnDataChannelReadIndex],
-				Type: urnToType(urnDataChannelReadIndex),
-				Labels: map[string]string{
-					"PTRANSFORM": snapshot.ID,
-				},
-				Payload: payload,
-			})
-	}
-
-	return monitoringInfo,
-		payloads
-}
+		// Per element processing latencies, in microseconds.
+		if lat := snapshot.Latency; lat.Count > 0 {
+			payload, err = int64Distribution(lat.Count, lat.Sum, lat.Min, lat.Max)
+			addEncoded(metrics.PTransformLabels(snapshot.ID), urnTransformLatency, payload, err)
+		}
+	}
 
-func userLabels(l metrics.Labels) map[string]string {
-	return map[string]string{
-		"PTRANSFORM": l.Transform(),
-		"NAMESPACE":  l.Namespace(),
-		"NAME":       l.Name(),
+	// Element counts written to sinks may be sampled estimates, see
+	// exec.SetElementCountSampling. The source's count takes precedence
+	// for a PCollection that's read and written directly.
+	for pid, n := range p.DataSinkElements() {
+		if hasProgress && pid == snapshot.PID {
+			continue
+		}
+		payload, err := int64Counter(n)
+		addEncoded(metrics.PCollectionLabels(pid), urnElementCount, payload, err)
 	}
-}
 
-func int64Counter(v int64) ([]byte, error) {
-	var buf bytes.Buffer
-	if err := coder.EncodeVarInt(v, &buf); err != nil {
-		return nil, err
+	for pid, n := range p.DataSinkBytes() {
+		payload, err := int64Counter(n)
+		addEncoded(metrics.PCollectionLabels(pid), urnDataChannelWriteBytes, payload, err)
 	}
-	return buf.Bytes(), nil
-}
 
-func int64Latest(t time.Time, v int64) ([]byte, error) {
-	var buf bytes.Buffer
-	if err := coder.EncodeVarInt(mtime.FromTime(t).Milliseconds(), &buf); err != nil {
-		return nil, err
+	if sampler, ok := p.(elementSizeSampler); ok {
+		for pid, size := range sampler.DataSinkElementSizes() {
+			if size.Count == 0 {
+				continue
+			}
+			payload, err := int64Distribution(size.Count, size.Sum, size.Min, size.Max)
+			addEncoded(metrics.PCollectionLabels(pid), urnSampledByteSize, payload, err)
+		}
 	}
-	if err := coder.EncodeVarInt(v, &buf); err != nil {
-		return nil, err
+
+	if counter, ok := p.(bundleCounter); ok {
+		for id, n := range counter.BundleCounts() {
+			payload, err := int64Counter(n)
+			addEncoded(metrics.PTransformLabels(id), urnTransformBundleCount, payload, err)
+		}
 	}
-	return buf.Bytes(), nil
-}
 
-func int64Distribution(count, sum, min, max int64) ([]byte, error) {
-	var buf bytes.Buffer
-	if err := coder.EncodeVarInt(count, &buf); err != nil {
-		return nil, err
+	if counter, ok := p.(errorCounter); ok {
+		for id, n := range counter.ErrorCounts() {
+			payload, err := int64Counter(n)
+			addEncoded(metrics.PTransformLabels(id), urnTransformErrorCount, payload, err)
+		}
 	}
-	if err := coder.EncodeVarInt(sum, &buf); err != nil {
+
+	if timer, ok := p.(wallTimer); ok {
+		for id, d := range timer.WallTimes() {
+			payload, err := int64Counter(d.Milliseconds())
+			addEncoded(metrics.PTransformLabels(id), urnTransformWallTime, payload, err)
+		}
+	}
+
+	if counter, ok := p.(splitCounter); ok {
+		for id, n := range counter.SplitCounts() {
+			payload, err := int64Counter(n)
+			addEncoded(metrics.PTransformLabels(id), urnTransformSplitCount, payload, err)
+		}
+	}
+
+	if counter, ok := p.(coderOpsCounter); ok {
+		for id, n := range counter.CoderOps() {
+			payload, err := int64Counter(n)
+			addEncoded(metrics.PTransformLabels(id), urnCoderOps, payload, err)
+		}
+	}
+
+	payload, encErr := int64Counter(beat)
+	addEncoded(metrics.Labels{}, urnWorkerHeartbeat, payload, encErr)
+
+	// Resource usage is attributed to the worker rather than a transform,
+	// and is omitted on platforms where it can't be sampled.
+	if cpu, maxRSS, err := processResourceUsage(); err == nil {
+		used := workerCPU.peek(cpu)
+		if mode == extractFinal {
+			used = workerCPU.claim(cpu)
+		}
+		payload, encErr := float64Counter(used.Seconds())
+		addEncoded(metrics.Labels{}, urnWorkerCPUSeconds, payload, encErr)
+		payload, encErr = int64Latest(time.Now(), int64(maxRSS))
+		addEncoded(metrics.Labels{}, urnWorkerMaxRSSBytes, payload, encErr)
+	}
+
+	// Report how many metrics couldn't be encoded, so the loss is visible.
+	if dropped > 0 {
+		payload, encErr := int64Counter(dropped)
+		addEncoded(metrics.Labels{}, urnDroppedMetrics, payload, encErr)
+	}
+
+	return monitoringInfo, payloads, extractErr
+}
+
+// dropLogInterval is the minimum time between warnings about metrics of
+// the same urn that failed to encode, so an encoder failing on every
+// monitoring call doesn't flood the worker log.
+const dropLogInterval = time.Minute
+
+// dropLog rate limits the warnings about metrics that failed to encode.
+var dropLog = newDropLimiter(dropLogInterval)
+
+// dropWarnf logs a warning about a metric that failed to encode. A variable
+// so tests can observe the warnings.
+var dropWarnf = func(format string, args ...interface{}) {
+	log.Warnf(context.Background(), format, args...)
+}
+
+// dropLimiter is a token bucket per urn, holding a single token that is
+// refilled once per interval.
+type dropLimiter struct {
+	interval time.Duration
+
+	mu         sync.Mutex
+	refill     map[mUrn]time.Time // when the token of the urn is next available
+	suppressed map[mUrn]int64     // failures not logged since the last warning
+}
+
+func newDropLimiter(interval time.Duration) *dropLimiter {
+	return &dropLimiter{
+		interval:   interval,
+		refill:     make(map[mUrn]time.Time),
+		suppressed: make(map[mUrn]int64),
+	}
+}
+
+// allow takes the token of the urn at time t, if available. It returns
+// whether a warning may be logged, and if so, how many failures of the urn
+// were suppressed since the last one.
+func (l *dropLimiter) allow(urn mUrn, t time.Time) (int64, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if next, ok := l.refill[urn]; ok && t.Before(next) {
+		l.suppressed[urn]++
+		return 0, false
+	}
+	n := l.suppressed[urn]
+	l.refill[urn] = t.Add(l.interval)
+	delete(l.suppressed, urn)
+	return n, true
+}
+
+// workerID is the id of the worker or environment the harness runs in,
+// labeling every emitted metric. See SetWorkerID.
+var workerID atomic.Value
+
+// SetWorkerID sets the worker id every emitted metric is labeled with,
+// as the WORKER_ID label, so runners can attribute metrics to workers
+// when harnesses run per worker. Metrics of different workers have
+// distinct short ids. An empty id, the default, adds no label.
+func SetWorkerID(id string) {
+	workerID.Store(id)
+}
+
+// getWorkerID returns the worker id set by SetWorkerID.
+func getWorkerID() string {
+	id, _ := workerID.Load().(string)
+	return id
+}
+
+// maxMetricTags bounds the number of tags SetMetricTags accepts.
+const maxMetricTags = 16
+
+// reservedLabels are the MonitoringInfo labels the harness sets itself,
+// which metric tags may not replace.
+var reservedLabels = map[string]bool{
+	"PTRANSFORM":   true,
+	"PCOLLECTION":  true,
+	"NAMESPACE":    true,
+	"NAME":         true,
+	"TENANT":       true,
+	"WORKER_ID":    true,
+	"WINDOW_START": true,
+	"WINDOW_END":   true,
+	"SCALE":        true,
+}
+
+// metricTags are the static tags labeling every emitted metric, holding
+// a metrics.Tags. See SetMetricTags.
+var metricTags atomic.Value
+
+// SetMetricTags sets static tags, such as JOB_NAME or a version, that every
+// emitted metric is labeled with, so runs of different jobs can be
+// compared. Tags are part of the metrics' short id keys, so metrics with
+// different tags have distinct short ids.
+//
+// Tags are meant to be set once per process at startup, which bounds the
+// label cardinality they add: changing them later assigns every metric a
+// new short id. At most maxMetricTags tags may be set, and the labels the
+// harness sets itself, such as PTRANSFORM, can't be used as keys. A nil
+// or empty map removes the tags.
+func SetMetricTags(tags map[string]string) error {
+	if len(tags) > maxMetricTags {
+		return errors.Errorf("%d metric tags exceeds the maximum of %d", len(tags), maxMetricTags)
+	}
+	for k := range tags {
+		if k == "" {
+			return errors.New("metric tag keys must not be empty")
+		}
+		if reservedLabels[k] {
+			return errors.Errorf("metric tag %v is a reserved label", k)
+		}
+	}
+	ts, err := metrics.NewTags(tags)
+	if err != nil {
+		return errors.Wrap(err, "invalid metric tags")
+	}
+	metricTags.Store(ts)
+	return nil
+}
+
+// getMetricTags returns the tags set by SetMetricTags.
+func getMetricTags() metrics.Tags {
+	tags, _ := metricTags.Load().(metrics.Tags)
+	return tags
+}
+
+// heartbeat counts the calls to monitoring, and is reported as the worker
+// heartbeat metric. Runners may consider a worker whose heartbeat doesn't
+// advance between progress requests stalled. Accessed atomically.
+var heartbeat int64
+
+// processResourceUsage samples the CPU time and maximum resident set size
+// of the worker process. A variable so tests can substitute it.
+var processResourceUsage = syscallx.ProcessResourceUsage
+
+// gaugeStaleness is the age after which gauges are no longer reported,
+// or zero to report all gauges. Accessed atomically.
+var gaugeStaleness int64
+
+// now is the clock used to determine gauge staleness.
+var now = time.Now
+
+// SetGaugeStaleness sets monitoring to skip gauges that haven't been
+// updated within d, reducing noise from gauges that stopped updating.
+// A zero or negative d reports all gauges, which is the default.
+func SetGaugeStaleness(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	atomic.StoreInt64(&gaugeStaleness, int64(d))
+}
+
+// staleGaugeCutoff returns the time before which gauges are stale, and
+// whether stale gauges are skipped at all.
+func staleGaugeCutoff() (mtime.Time, bool) {
+	d := time.Duration(atomic.LoadInt64(&gaugeStaleness))
+	if d == 0 {
+		return mtime.ZeroTimestamp, false
+	}
+	return clampMtime(now()).Subtract(d), true
+}
+
+// onEmit is the hook set by SetOnEmit.
+var onEmit struct {
+	mu sync.RWMutex
+	f  func(*pipepb.MonitoringInfo)
+}
+
+// SetOnEmit sets a hook that monitoring calls for every MonitoringInfo it
+// emits, to log, sample or forward metrics without extracting them again.
+// The hook receives a copy, so changes to it don't affect the metrics sent
+// to the runner. The hook is called synchronously during extraction, so it
+// should be fast. A nil hook removes it.
+func SetOnEmit(f func(*pipepb.MonitoringInfo)) {
+	onEmit.mu.Lock()
+	onEmit.f = f
+	onEmit.mu.Unlock()
+}
+
+func emitHook() func(*pipepb.MonitoringInfo) {
+	onEmit.mu.RLock()
+	defer onEmit.mu.RUnlock()
+	return onEmit.f
+}
+
+// errPartialMonitoring indicates that metric extraction stopped early,
+// and only the metrics collected until then were returned.
+var errPartialMonitoring = errors.New("partial monitoring results")
+
+// emitStop is panicked with to stop metric extraction once emitting a
+// streamed MonitoringInfo fails with err.
+type emitStop struct {
+	err error
+}
+
+// recoverEmitStop recovers an emitStop panic, and sets err to the error
+// that stopped extraction. Other panics are propagated. Must be called
+// directly by defer.
+func recoverEmitStop(err *error) {
+	if e := recover(); e != nil {
+		s, ok := e.(emitStop)
+		if !ok {
+			panic(e)
+		}
+		*err = s.err
+	}
+}
+
+// recoverPartial recovers a panic during metric extraction, and sets
+// err to wrap errPartialMonitoring. Must be called directly by defer.
+func recoverPartial(err *error) {
+	if e := recover(); e != nil {
+		*err = errors.Wrapf(errPartialMonitoring, "metric extraction panicked: %v", e)
+	}
+}
+
+// monitoringLabels returns the MonitoringInfo labels for the given Labels,
+// depending on whether they're for a PCollection, PTransform, or user metric.
+func monitoringLabels(l metrics.Labels) map[string]string {
+	if l.Namespace() == "" && l.Name() == "" {
+		// Metrics may be attributed to a transform, a PCollection, both,
+		// or, for worker level metrics, neither.
+		ls := make(map[string]string, 2+scopeLen(l))
+		if l.Transform() != "" {
+			ls["PTRANSFORM"] = l.Transform()
+		}
+		if l.PCollection() != "" {
+			ls["PCOLLECTION"] = l.PCollection()
+		}
+		return withScope(l, ls)
+	}
+	return userLabels(l)
+}
+
+// withScope adds the TENANT and WORKER_ID labels to ls if the metric has a
+// tenant or worker, the WINDOW_START and WINDOW_END labels if it's scoped
+// to a window, and its tags.
+// Window bounds are in milliseconds since the epoch, as in mtime.Time.
+func withScope(l metrics.Labels, ls map[string]string) map[string]string {
+	if t := l.Tenant(); t != "" {
+		ls["TENANT"] = t
+	}
+	if w := l.Worker(); w != "" {
+		ls["WORKER_ID"] = w
+	}
+	l.Tags().Each(func(k, v string) {
+		ls[k] = v
+	})
+	if start, end, ok := l.Window(); ok {
+		ls["WINDOW_START"] = strconv.FormatInt(start.Milliseconds(), 10)
+		ls["WINDOW_END"] = strconv.FormatInt(end.Milliseconds(), 10)
+	}
+	return ls
+}
+
+// scopeLen returns the number of labels withScope adds for the metric, so
+// label maps can be allocated at their final size rather than grown.
+func scopeLen(l metrics.Labels) int {
+	n := l.Tags().Len()
+	if l.Tenant() != "" {
+		n++
+	}
+	if l.Worker() != "" {
+		n++
+	}
+	if _, _, ok := l.Window(); ok {
+		n += 2
+	}
+	return n
+}
+
+// userLabels returns the MonitoringInfo labels of a user metric. The map is
+// built once per short id and shared by the MonitoringInfos emitted for it,
+// so it must not be modified once returned.
+func userLabels(l metrics.Labels) map[string]string {
+	n := 3 + scopeLen(l)
+	if l.PCollection() != "" {
+		n++
+	}
+	if l.Scale() != 0 {
+		n++
+	}
+	ls := make(map[string]string, n)
+	ls["PTRANSFORM"] = l.Transform()
+	ls["NAMESPACE"] = l.Namespace()
+	ls["NAME"] = l.Name()
+	if l.PCollection() != "" {
+		ls["PCOLLECTION"] = l.PCollection()
+	}
+	if l.Scale() != 0 {
+		ls["SCALE"] = strconv.FormatInt(int64(l.Scale()), 10)
+	}
+	return withScope(l, ls)
+}
+
+// labelsFromInfo is the inverse of userLabels, reconstructing the
+// metrics.Labels of a user metric from its MonitoringInfo.
+// Returns an error if any of the user metric label keys are missing.
+func labelsFromInfo(mi *pipepb.MonitoringInfo) (metrics.Labels, error) {
+	ls := mi.GetLabels()
+	for _, k := range []string{"PTRANSFORM", "NAMESPACE", "NAME"} {
+		if _, ok := ls[k]; !ok {
+			return metrics.Labels{}, errors.Errorf("MonitoringInfo %v isn't a user metric: missing %v label", mi.GetUrn(), k)
+		}
+	}
+	l := metrics.UserLabels(ls["PTRANSFORM"], ls["NAMESPACE"], ls["NAME"]).WithPCollection(ls["PCOLLECTION"]).WithTenant(ls["TENANT"]).WithWorker(ls["WORKER_ID"])
+	if s, ok := ls["WINDOW_START"]; ok {
+		start, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return metrics.Labels{}, errors.Wrapf(err, "MonitoringInfo %v has an invalid WINDOW_START label", mi.GetUrn())
+		}
+		end, err := strconv.ParseInt(ls["WINDOW_END"], 10, 64)
+		if err != nil {
+			return metrics.Labels{}, errors.Wrapf(err, "MonitoringInfo %v has an invalid WINDOW_END label", mi.GetUrn())
+		}
+		l = l.WithWindow(mtime.Time(start), mtime.Time(end))
+	}
+	if s, ok := ls["SCALE"]; ok {
+		scale, err := strconv.ParseInt(s, 10, 32)
+		if err != nil {
+			return metrics.Labels{}, errors.Wrapf(err, "MonitoringInfo %v has an invalid SCALE label", mi.GetUrn())
+		}
+		l = l.WithScale(int32(scale))
+	}
+	// Labels with the keys of the metric tags are tags. Any other labels,
+	// such as those added by runners, are ignored.
+	var tags map[string]string
+	getMetricTags().Each(func(k, _ string) {
+		if v, ok := ls[k]; ok {
+			if tags == nil {
+				tags = make(map[string]string)
+			}
+			tags[k] = v
+		}
+	})
+	ts, err := metrics.NewTags(tags)
+	if err != nil {
+		return metrics.Labels{}, errors.Wrapf(err, "MonitoringInfo %v has invalid tag labels", mi.GetUrn())
+	}
+	return l.WithTags(ts), nil
+}
+
+// payloadPool holds scratch buffers for encoding payloads, since the
+// encoders are called for every metric on every extraction.
+var payloadPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+// encodePayload encodes a payload into a pooled buffer with enc, and
+// returns a copy of the result sized to fit.
+func encodePayload(enc func(buf *bytes.Buffer) error) ([]byte, error) {
+	buf := payloadPool.Get().(*bytes.Buffer)
+	defer payloadPool.Put(buf)
+	buf.Reset()
+	if err := enc(buf); err != nil {
 		return nil, err
 	}
-	if err := coder.EncodeVarInt(min, &buf); err != nil {
+	return append([]byte(nil), buf.Bytes()...), nil
+}
+
+// int64Counter returns the sum_int64 encoding of v. Counters are the most
+// common payloads, so rather than going through encodePayload, the varint
+// is encoded on the stack and copied into a pooled counterSlab.
+func int64Counter(v int64) ([]byte, error) {
+	// Beam's varint coder encodes the two's complement bits of v as a uvarint.
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], uint64(v))
+
+	s := counterSlabs.Get().(*counterSlab)
+	if cap(s.buf)-len(s.buf) < n {
+		s.buf = make([]byte, 0, counterSlabSize)
+	}
+	start := len(s.buf)
+	s.buf = append(s.buf, tmp[:n]...)
+	// Limit the capacity, so appending to the payload can't overwrite
+	// the payloads that follow it.
+	payload := s.buf[start:len(s.buf):len(s.buf)]
+	counterSlabs.Put(s)
+	return payload, nil
+}
+
+// counterSlabSize is the size of the backing arrays of counter payloads.
+const counterSlabSize = 4096
+
+// counterSlab is a backing array small counter payloads are carved from,
+// avoiding an allocation per payload. Payloads escape into responses, so
+// the space is never reused; a new array is allocated once it's full, and
+// old ones are collected once none of their payloads are referenced.
+type counterSlab struct {
+	buf []byte
+}
+
+// counterSlabs holds the slabs, so concurrent extractions carve payloads
+// from different slabs rather than contending on a shared one.
+var counterSlabs = sync.Pool{
+	New: func() interface{} {
+		return new(counterSlab)
+	},
+}
+
+// float64Counter returns the sum_double encoding of v.
+func float64Counter(v float64) ([]byte, error) {
+	return encodePayload(func(buf *bytes.Buffer) error {
+		return coder.EncodeDouble(v, buf)
+	})
+}
+
+// int64CounterInto appends the sum_int64 encoding of v to buf.
+func int64CounterInto(buf *bytes.Buffer, v int64) error {
+	return coder.EncodeVarInt(v, buf)
+}
+
+func int64Latest(t time.Time, v int64) ([]byte, error) {
+	return encodePayload(func(buf *bytes.Buffer) error {
+		return int64LatestInto(buf, t, v)
+	})
+}
+
+// int64LatestInto appends the latest_int64 encoding of t and v to buf.
+func int64LatestInto(buf *bytes.Buffer, t time.Time, v int64) error {
+	if err := coder.EncodeVarInt(gaugeMillis(t), buf); err != nil {
+		return err
+	}
+	return coder.EncodeVarInt(v, buf)
+}
+
+// gaugeSummary returns the gauge_summary_int64 encoding of the given
+// values: the latest_int64 encoding of t and last, followed by min and max
+// as varints.
+func gaugeSummary(t time.Time, min, max, last int64) ([]byte, error) {
+	return encodePayload(func(buf *bytes.Buffer) error {
+		if err := int64LatestInto(buf, t, last); err != nil {
+			return err
+		}
+		if err := coder.EncodeVarInt(min, buf); err != nil {
+			return err
+		}
+		return coder.EncodeVarInt(max, buf)
+	})
+}
+
+// gaugeMillis returns the gauge timestamp t in milliseconds since the
+// epoch, clamped to the range of Beam timestamps. Times outside the range
+// are logged, but still reported, rather than failing the gauge.
+func gaugeMillis(t time.Time) int64 {
+	m, err := toMtime(t)
+	if err != nil {
+		if t.Unix() > 0 {
+			warnClamped("after the maximum", t)
+			return mtime.MaxTimestamp.Milliseconds()
+		}
+		warnClamped("before the minimum", t)
+		return mtime.MinTimestamp.Milliseconds()
+	}
+	return m.Milliseconds()
+}
+
+// clampLog rate limits the warnings about clamped gauge timestamps to one
+// per dropLogInterval, since an out of range gauge is clamped again on
+// every extraction.
+var clampLog struct {
+	mu         sync.Mutex
+	next       time.Time // when the next warning may be logged
+	suppressed int64     // clamps not logged since the last warning
+}
+
+// clampWarnf logs a warning about a clamped gauge timestamp. A variable so
+// tests can observe the warnings.
+var clampWarnf = func(format string, args ...interface{}) {
+	log.Warnf(context.Background(), format, args...)
+}
+
+// warnClamped logs that the gauge timestamp t is beyond the Beam timestamp
+// range, unless a warning was logged within the last dropLogInterval.
+func warnClamped(bound string, t time.Time) {
+	at := now()
+	clampLog.mu.Lock()
+	if at.Before(clampLog.next) {
+		clampLog.suppressed++
+		clampLog.mu.Unlock()
+		return
+	}
+	n := clampLog.suppressed
+	clampLog.next = at.Add(dropLogInterval)
+	clampLog.suppressed = 0
+	clampLog.mu.Unlock()
+	clampWarnf("gauge timestamp %v is %v Beam timestamp, clamping it, and %d more since the last warning", t, bound, n)
+}
+
+func stringLatest(t time.Time, v string) ([]byte, error) {
+	return encodePayload(func(buf *bytes.Buffer) error {
+		return stringLatestInto(buf, t, v)
+	})
+}
+
+// stringLatestInto appends the latest_string encoding of t and v to buf.
+func stringLatestInto(buf *bytes.Buffer, t time.Time, v string) error {
+	if err := coder.EncodeVarInt(gaugeMillis(t), buf); err != nil {
+		return err
+	}
+	return coder.EncodeStringUTF8(v, buf)
+}
+
+func int64Distribution(count, sum, min, max int64) ([]byte, error) {
+	return encodePayload(func(buf *bytes.Buffer) error {
+		return int64DistributionInto(buf, count, sum, min, max)
+	})
+}
+
+// distributionStats returns the distribution_stats_int64 encoding of the
+// given values: the distribution_int64 fields followed by the sum of
+// squares, as varints.
+func distributionStats(count, sum, min, max, sumSq int64) ([]byte, error) {
+	return encodePayload(func(buf *bytes.Buffer) error {
+		if err := int64DistributionInto(buf, count, sum, min, max); err != nil {
+			return err
+		}
+		return coder.EncodeVarInt(sumSq, buf)
+	})
+}
+
+// gaugeHistory returns the gauge_history_int64 encoding of the samples:
+// a varint count, followed by the millisecond timestamp and value of each
+// sample as varints.
+func gaugeHistory(samples []metrics.GaugeSample) ([]byte, error) {
+	return encodePayload(func(buf *bytes.Buffer) error {
+		if err := coder.EncodeVarInt(int64(len(samples)), buf); err != nil {
+			return err
+		}
+		for _, s := range samples {
+			if err := coder.EncodeVarInt(gaugeMillis(s.Timestamp), buf); err != nil {
+				return err
+			}
+			if err := coder.EncodeVarInt(s.Value, buf); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// monitoringTableIntKeys returns the monitoring_table_int_keys encoding of
+// the rows: a varint count, followed by the key and value of each row as
+// varints, in increasing key order so equal tables encode identically.
+func monitoringTableIntKeys(rows map[int64]int64) ([]byte, error) {
+	keys := make([]int64, 0, len(rows))
+	for k := range rows {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return encodePayload(func(buf *bytes.Buffer) error {
+		if err := coder.EncodeVarInt(int64(len(keys)), buf); err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err := coder.EncodeVarInt(k, buf); err != nil {
+				return err
+			}
+			if err := coder.EncodeVarInt(rows[k], buf); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// monitoringTableStringKeys returns the monitoring_table_string_keys
+// encoding of the rows: a varint count, followed by the length prefixed key
+// and varint value of each row, in increasing key order so equal tables
+// always encode identically.
+func monitoringTableStringKeys(rows map[string]int64) ([]byte, error) {
+	keys := make([]string, 0, len(rows))
+	for k := range rows {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return encodePayload(func(buf *bytes.Buffer) error {
+		if err := coder.EncodeVarInt(int64(len(keys)), buf); err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err := coder.EncodeStringUTF8(k, buf); err != nil {
+				return err
+			}
+			if err := coder.EncodeVarInt(rows[k], buf); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// int64DistributionInto appends the distribution_int64 encoding of the
+// given values to buf.
+func int64DistributionInto(buf *bytes.Buffer, count, sum, min, max int64) error {
+	for _, v := range []int64{count, sum, min, max} {
+		if err := coder.EncodeVarInt(v, buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func minMaxInt64(min, max int64) ([]byte, error) {
+	return encodePayload(func(buf *bytes.Buffer) error {
+		return minMaxInt64Into(buf, min, max)
+	})
+}
+
+// fixedSum returns the sum_fixed encoding of the decimal value
+// mantissa * 10^-scale: the mantissa followed by the scale, as varints.
+func fixedSum(mantissa int64, scale int32) ([]byte, error) {
+	return encodePayload(func(buf *bytes.Buffer) error {
+		if err := coder.EncodeVarInt(mantissa, buf); err != nil {
+			return err
+		}
+		return coder.EncodeVarInt(int64(scale), buf)
+	})
+}
+
+// minMaxInt64Into appends the min_max_int64 encoding of min and max to buf.
+func minMaxInt64Into(buf *bytes.Buffer, min, max int64) error {
+	if err := coder.EncodeVarInt(min, buf); err != nil {
+		return err
+	}
+	return coder.EncodeVarInt(max, buf)
+}
+
+// progressScalar encodes the fraction of work completed as a progress
+// payload holding a single value. Fractions outside of [0,1] are clamped,
+// and NaN is an error.
+func progressScalar(fraction float64) ([]byte, error) {
+	if math.IsNaN(fraction) {
+		return nil, errors.New("invalid progress fraction: NaN")
+	}
+	fraction = math.Min(math.Max(fraction, 0), 1)
+	return encodePayload(func(buf *bytes.Buffer) error {
+		return progressInto(buf, fraction)
+	})
+}
+
+// progressInto appends the progress encoding of the values to buf,
+// as an iterable of doubles.
+func progressInto(buf *bytes.Buffer, vs ...float64) error {
+	if err := coder.EncodeInt32(int32(len(vs)), buf); err != nil {
+		return err
+	}
+	for _, v := range vs {
+		if err := coder.EncodeDouble(v, buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// topNInt64 returns the top_n_int64 encoding of the values: an iterable of
+// varints, largest first.
+func topNInt64(vs []int64) ([]byte, error) {
+	return rankedInt64(vs, true)
+}
+
+// bottomNInt64 returns the bottom_n_int64 encoding of the values: an
+// iterable of varints, smallest first.
+func bottomNInt64(vs []int64) ([]byte, error) {
+	return rankedInt64(vs, false)
+}
+
+// rankedInt64 encodes the values as an iterable of varints, in descending
+// or ascending order.
+func rankedInt64(vs []int64, descending bool) ([]byte, error) {
+	sorted := append([]int64(nil), vs...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if descending {
+			return sorted[i] > sorted[j]
+		}
+		return sorted[i] < sorted[j]
+	})
+	return encodePayload(func(buf *bytes.Buffer) error {
+		if err := coder.EncodeInt32(int32(len(sorted)), buf); err != nil {
+			return err
+		}
+		for _, v := range sorted {
+			if err := coder.EncodeVarInt(v, buf); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// TopNEntry is an entry of a decoded top_n_int64 or bottom_n_int64 payload.
+// Rank is the 1 based position of the value, with the largest value of a
+// top-N or the smallest of a bottom-N ranked 1. Equal values share the rank
+// of the first of them, so the ranks of 5, 3, 3, 1 are 1, 2, 2, 4.
+type TopNEntry struct {
+	Value int64
+	Rank  int
+}
+
+// rankEntries returns the values as TopNEntries in rank order.
+func rankEntries(vs []int64, descending bool) []TopNEntry {
+	if len(vs) == 0 {
+		return nil
+	}
+	sort.Slice(vs, func(i, j int) bool {
+		if descending {
+			return vs[i] > vs[j]
+		}
+		return vs[i] < vs[j]
+	})
+	entries := make([]TopNEntry, len(vs))
+	for i, v := range vs {
+		entries[i] = TopNEntry{Value: v, Rank: i + 1}
+		if i > 0 && v == vs[i-1] {
+			entries[i].Rank = entries[i-1].Rank
+		}
+	}
+	return entries
+}
+
+// decodeTopN decodes a top_n_int64 payload into its entries, in rank
+// order. Payloads from other SDKs needn't be in order, so entries are
+// sorted rather than trusting the encoded order.
+func decodeTopN(b []byte) ([]TopNEntry, error) {
+	v, err := decodePayload("beam:metrics:top_n_int64:v1", b)
+	if err != nil {
 		return nil, err
 	}
-	if err := coder.EncodeVarInt(max, &buf); err != nil {
+	return v.([]TopNEntry), nil
+}
+
+// decodeBottomN decodes a bottom_n_int64 payload into its entries, in
+// rank order, like decodeTopN.
+func decodeBottomN(b []byte) ([]TopNEntry, error) {
+	v, err := decodePayload("beam:metrics:bottom_n_int64:v1", b)
+	if err != nil {
 		return nil, err
 	}
-	return buf.Bytes(), nil
+	return v.([]TopNEntry), nil
+}
+
+// MinMaxData is the decoded value of a min_max_int64 payload.
+type MinMaxData struct {
+	Min, Max int64
+}
+
+// FixedData is the decoded value of a sum_fixed payload, the exact
+// decimal Mantissa * 10^-Scale.
+type FixedData struct {
+	Mantissa int64
+	Scale    int32
+}
+
+// IntTableRow is a row of a monitoring_table_int_keys payload.
+type IntTableRow struct {
+	Key, Value int64
+}
+
+// StringTableRow is a row of a monitoring_table_string_keys payload, such
+// as the count of a category.
+type StringTableRow struct {
+	Key   string
+	Value int64
+}
+
+// DistributionData is the decoded value of a distribution_int64 payload.
+type DistributionData struct {
+	count, sum, min, max int64
+}
+
+// Count returns the number of values in the distribution.
+func (d DistributionData) Count() int64 { return d.count }
+
+// Sum returns the sum of the values in the distribution.
+func (d DistributionData) Sum() int64 { return d.sum }
+
+// Min returns the smallest value in the distribution.
+func (d DistributionData) Min() int64 { return d.min }
+
+// Max returns the largest value in the distribution.
+func (d DistributionData) Max() int64 { return d.max }
+
+// Mean returns the mean of the values in the distribution,
+// or 0 if the distribution is empty.
+func (d DistributionData) Mean() float64 {
+	if d.count == 0 {
+		return 0
+	}
+	return float64(d.sum) / float64(d.count)
+}
+
+func (d DistributionData) String() string {
+	return fmt.Sprintf("count: %d sum: %d min: %d max: %d", d.count, d.sum, d.min, d.max)
+}
+
+// MarshalJSON encodes the distribution as a JSON object, including its mean.
+func (d DistributionData) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Count int64   `json:"count"`
+		Sum   int64   `json:"sum"`
+		Min   int64   `json:"min"`
+		Max   int64   `json:"max"`
+		Mean  float64 `json:"mean"`
+	}{d.count, d.sum, d.min, d.max, d.Mean()})
+}
+
+// DistributionStatsData is the decoded value of a distribution_stats_int64
+// payload, a distribution along with the sum of the squares of its values.
+type DistributionStatsData struct {
+	DistributionData
+	sumSq int64
+}
+
+// SumSq returns the sum of the squares of the values in the distribution.
+// It saturates at math.MaxInt64, in which case the variance isn't exact.
+func (d DistributionStatsData) SumSq() int64 { return d.sumSq }
+
+// Variance returns the population variance of the values in the
+// distribution, or 0 if the distribution is empty.
+func (d DistributionStatsData) Variance() float64 {
+	if d.count == 0 {
+		return 0
+	}
+	mean := d.Mean()
+	// Rounding may leave a tiny negative variance for constant values.
+	return math.Max(0, float64(d.sumSq)/float64(d.count)-mean*mean)
+}
+
+// StdDev returns the population standard deviation of the values in the
+// distribution, or 0 if the distribution is empty.
+func (d DistributionStatsData) StdDev() float64 {
+	return math.Sqrt(d.Variance())
+}
+
+func (d DistributionStatsData) String() string {
+	return fmt.Sprintf("%v sum_sq: %d", d.DistributionData, d.sumSq)
+}
+
+// MarshalJSON encodes the distribution as a JSON object, including its mean
+// and standard deviation.
+func (d DistributionStatsData) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Count  int64   `json:"count"`
+		Sum    int64   `json:"sum"`
+		Min    int64   `json:"min"`
+		Max    int64   `json:"max"`
+		SumSq  int64   `json:"sum_sq"`
+		Mean   float64 `json:"mean"`
+		StdDev float64 `json:"std_dev"`
+	}{d.count, d.sum, d.min, d.max, d.sumSq, d.Mean(), d.StdDev()})
+}
+
+// combineDistribution merges two distributions. Empty distributions are
+// identities, so sentinel min and max values they carry are ignored.
+func combineDistribution(a, b DistributionData) DistributionData {
+	switch {
+	case b.count == 0:
+		return a
+	case a.count == 0:
+		return b
+	}
+	if b.min < a.min {
+		a.min = b.min
+	}
+	if b.max > a.max {
+		a.max = b.max
+	}
+	a.count += b.count
+	a.sum += b.sum
+	return a
+}
+
+// GaugeData is the decoded value of a latest_int64 payload.
+type GaugeData struct {
+	Timestamp time.Time
+	Value     int64
+}
+
+// GaugeSummaryData is the decoded value of a gauge_summary_int64 payload:
+// the smallest, largest, and latest values of a gauge, and the time of
+// the latest.
+type GaugeSummaryData struct {
+	Timestamp      time.Time
+	Min, Max, Last int64
+}
+
+// StringGaugeData is the decoded value of a latest_string payload.
+type StringGaugeData struct {
+	Timestamp time.Time
+	Value     string
+}
+
+// DecodeMonitoringInfo decodes the payload of a MonitoringInfo, such as
+// one reported by a runner for a completed job, based on its type.
+// The value is an int64, float64, DistributionData, DistributionStatsData,
+// MinMaxData, FixedData, BundleSummaryData, GaugeData, GaugeSummaryData,
+// StringGaugeData, []GaugeData for gauge history, []IntTableRow or
+// []StringTableRow for tables, []TopNEntry for top and bottom N, or
+// []float64 for progress. Returns an error for unsupported types or
+// malformed payloads.
+func DecodeMonitoringInfo(mi *pipepb.MonitoringInfo) (interface{}, error) {
+	v, err := decodePayload(mi.GetType(), mi.GetPayload())
+	if err != nil {
+		return nil, errors.WithContextf(err, "decoding MonitoringInfo %v", mi.GetUrn())
+	}
+	return v, nil
+}
+
+// checkPayload cheaply verifies that an encoded payload has the layout of
+// its type, catching encoders that produce truncated or overlong payloads
+// before they're emitted. Varint fields are checked by finding their
+// terminating bytes rather than decoding them. Payloads of types without a
+// known layout aren't checked.
+func checkPayload(typ string, payload []byte) error {
+	var varints int
+	switch typ {
+	case "beam:metrics:sum_int64:v1":
+		varints = 1
+	case "beam:metrics:latest_int64:v1", "beam:metrics:min_max_int64:v1", "beam:metrics:sum_fixed:v1":
+		varints = 2
+	case "beam:metrics:distribution_int64:v1", "beam:go:metrics:gauge_summary_int64:v1":
+		varints = 4
+	case "beam:metrics:bundle_summary:v1":
+		varints = 3
+	case "beam:metrics:distribution_stats_int64:v1":
+		varints = 5
+	case "beam:metrics:gauge_history_int64:v1":
+		// A varint count, followed by a timestamp and value per sample.
+		n, m := binary.Uvarint(payload)
+		if m <= 0 {
+			return errors.Wrapf(ErrPayloadTooShort, "%v payload has no sample count", typ)
+		}
+		if n > uint64(len(payload)) {
+			return errors.Wrapf(ErrPayloadTooShort, "%v payload has %d bytes, fewer than its %d samples", typ, len(payload), n)
+		}
+		v := varintsLen(payload[m:], 2*int(n))
+		if v < 0 {
+			return errors.Wrapf(ErrPayloadTooShort, "%v payload has %d bytes, fewer than its %d samples", typ, len(payload), n)
+		}
+		return checkLength(typ, payload, m+v)
+	case "beam:go:metrics:monitoring_table_int_keys:v1":
+		// A varint count, followed by a key and value per row.
+		n, m := binary.Uvarint(payload)
+		if m <= 0 {
+			return errors.Wrapf(ErrPayloadTooShort, "%v payload has no row count", typ)
+		}
+		if n > uint64(len(payload)) {
+			return errors.Wrapf(ErrPayloadTooShort, "%v payload has %d bytes, fewer than its %d rows", typ, len(payload), n)
+		}
+		v := varintsLen(payload[m:], 2*int(n))
+		if v < 0 {
+			return errors.Wrapf(ErrPayloadTooShort, "%v payload has %d bytes, fewer than its %d rows", typ, len(payload), n)
+		}
+		return checkLength(typ, payload, m+v)
+	case "beam:go:metrics:monitoring_table_string_keys:v1":
+		// A varint count, followed by a length prefixed key and a varint
+		// value per row.
+		n, m := binary.Uvarint(payload)
+		if m <= 0 {
+			return errors.Wrapf(ErrPayloadTooShort, "%v payload has no row count", typ)
+		}
+		if n > uint64(len(payload)) {
+			return errors.Wrapf(ErrPayloadTooShort, "%v payload has %d bytes, fewer than its %d rows", typ, len(payload), n)
+		}
+		for i := uint64(0); i < n; i++ {
+			size, k := binary.Uvarint(payload[m:])
+			if k <= 0 || size > uint64(len(payload)-m-k) {
+				return errors.Wrapf(ErrPayloadTooShort, "%v payload has %d bytes, ending within row %d", typ, len(payload), i)
+			}
+			m += k + int(size)
+			v := varintsLen(payload[m:], 1)
+			if v < 0 {
+				return errors.Wrapf(ErrPayloadTooShort, "%v payload has %d bytes, ending within row %d", typ, len(payload), i)
+			}
+			m += v
+		}
+		return checkLength(typ, payload, m)
+	case "beam:metrics:sum_double:v1":
+		return checkLength(typ, payload, 8)
+	case "beam:metrics:progress:v1":
+		// A big endian int32 count, followed by that many doubles.
+		if len(payload) < 4 {
+			return errors.Wrapf(ErrPayloadTooShort, "%v payload has %d bytes, want at least 4", typ, len(payload))
+		}
+		return checkLength(typ, payload, 4+8*int(binary.BigEndian.Uint32(payload)))
+	case "beam:metrics:top_n_int64:v1", "beam:metrics:bottom_n_int64:v1":
+		// A big endian int32 count, followed by that many varints.
+		if len(payload) < 4 {
+			return errors.Wrapf(ErrPayloadTooShort, "%v payload has %d bytes, want at least 4", typ, len(payload))
+		}
+		n := varintsLen(payload[4:], int(binary.BigEndian.Uint32(payload)))
+		if n < 0 {
+			return errors.Wrapf(ErrPayloadTooShort, "%v payload has %d bytes, fewer than its %d values", typ, len(payload), binary.BigEndian.Uint32(payload))
+		}
+		return checkLength(typ, payload, 4+n)
+	case "beam:metrics:latest_string:v1":
+		// A varint timestamp, followed by a varint length prefixed string.
+		n := varintsLen(payload, 1)
+		if n < 0 {
+			return errors.Wrapf(ErrPayloadTooShort, "%v payload has no timestamp", typ)
+		}
+		size, m := binary.Uvarint(payload[n:])
+		if m <= 0 {
+			return errors.Wrapf(ErrPayloadTooShort, "%v payload has no string length", typ)
+		}
+		if size > uint64(len(payload)) {
+			return errors.Wrapf(ErrPayloadTooShort, "%v payload has %d bytes, fewer than its %d byte string", typ, len(payload), size)
+		}
+		return checkLength(typ, payload, n+m+int(size))
+	default:
+		return nil
+	}
+	n := varintsLen(payload, varints)
+	if n < 0 {
+		return errors.Wrapf(ErrPayloadTooShort, "%v payload has %d bytes, which is fewer than %d varints", typ, len(payload), varints)
+	}
+	return checkLength(typ, payload, n)
+}
+
+// checkLength verifies that the payload has the expected length, with a
+// negative length indicating a truncated payload.
+func checkLength(typ string, payload []byte, want int) error {
+	switch {
+	case want < 0 || len(payload) < want:
+		return errors.Wrapf(ErrPayloadTooShort, "%v payload has %d bytes, want %d", typ, len(payload), want)
+	case len(payload) > want:
+		return errors.Wrapf(ErrMalformedPayload, "%v payload has %d bytes, want %d", typ, len(payload), want)
+	}
+	return nil
+}
+
+// varintsLen returns the length in bytes of the first n varints in b, or
+// -1 if b holds fewer than n varints.
+func varintsLen(b []byte, n int) int {
+	if n == 0 {
+		return 0
+	}
+	for i, c := range b {
+		if c < 0x80 {
+			if n--; n == 0 {
+				return i + 1
+			}
+		}
+	}
+	return -1
+}
+
+// FilterInfosByURNPrefix returns the MonitoringInfos whose urn starts with
+// prefix, such as "beam:metric:user:" for user metrics, in their original
+// order.
+func FilterInfosByURNPrefix(infos []*pipepb.MonitoringInfo, prefix string) []*pipepb.MonitoringInfo {
+	var ret []*pipepb.MonitoringInfo
+	for _, mi := range infos {
+		if strings.HasPrefix(mi.GetUrn(), prefix) {
+			ret = append(ret, mi)
+		}
+	}
+	return ret
+}
+
+// decodePayload decodes a payload of the given monitoring type into an
+// int64, float64, DistributionData, DistributionStatsData, MinMaxData,
+// FixedData, BundleSummaryData, GaugeData, GaugeSummaryData,
+// StringGaugeData, []GaugeData gauge history, []IntTableRow or
+// []StringTableRow table, []TopNEntry top or bottom N, or []float64
+// progress value.
+// Returns an error wrapping ErrUnsupportedType for unsupported types,
+// ErrPayloadTooShort if the payload ends early, or ErrMalformedPayload if
+// it has invalid fields or isn't fully consumed.
+func decodePayload(typ string, payload []byte) (interface{}, error) {
+	d := &payloadDecoder{buf: bytes.NewBuffer(payload)}
+	var v interface{}
+	switch typ {
+	case "beam:metrics:sum_int64:v1":
+		v = d.varint("value")
+	case "beam:metrics:sum_double:v1":
+		v = d.double("value")
+	case "beam:metrics:distribution_int64:v1":
+		v = DistributionData{count: d.varint("count"), sum: d.varint("sum"), min: d.varint("min"), max: d.varint("max")}
+	case "beam:metrics:distribution_stats_int64:v1":
+		dist := DistributionData{count: d.varint("count"), sum: d.varint("sum"), min: d.varint("min"), max: d.varint("max")}
+		v = DistributionStatsData{DistributionData: dist, sumSq: d.varint("sum_sq")}
+	case "beam:metrics:min_max_int64:v1":
+		v = MinMaxData{Min: d.varint("min"), Max: d.varint("max")}
+	case "beam:metrics:bundle_summary:v1":
+		v = BundleSummaryData{Elements: d.varint("elements"), TotalMsecs: d.varint("total_msecs"), Errors: d.varint("errors")}
+	case "beam:metrics:sum_fixed:v1":
+		f := FixedData{Mantissa: d.varint("mantissa")}
+		scale := d.varint("scale")
+		if int64(int32(scale)) != scale {
+			d.invalid("scale", "scale %d out of range", scale)
+		}
+		f.Scale = int32(scale)
+		v = f
+	case "beam:metrics:latest_int64:v1":
+		v = GaugeData{Timestamp: msToTime(d.varint("timestamp")), Value: d.varint("value")}
+	case "beam:go:metrics:gauge_summary_int64:v1":
+		v = GaugeSummaryData{Timestamp: msToTime(d.varint("timestamp")), Last: d.varint("last"), Min: d.varint("min"), Max: d.varint("max")}
+	case "beam:metrics:latest_string:v1":
+		v = StringGaugeData{Timestamp: msToTime(d.varint("timestamp")), Value: d.string("value")}
+	case "beam:metrics:gauge_history_int64:v1":
+		n := d.varint("count")
+		if n < 0 || n > int64(d.buf.Len()) {
+			d.invalid("count", "invalid sample count %d", n)
+		}
+		var h []GaugeData
+		for i := int64(0); i < n && d.err == nil; i++ {
+			h = append(h, GaugeData{Timestamp: msToTime(d.varint("timestamp")), Value: d.varint("value")})
+		}
+		v = h
+	case "beam:go:metrics:monitoring_table_int_keys:v1":
+		n := d.varint("count")
+		if n < 0 || n > int64(d.buf.Len()) {
+			d.invalid("count", "invalid row count %d", n)
+		}
+		var rows []IntTableRow
+		for i := int64(0); i < n && d.err == nil; i++ {
+			r := IntTableRow{Key: d.varint("key"), Value: d.varint("value")}
+			if len(rows) > 0 && r.Key <= rows[len(rows)-1].Key {
+				d.invalid("key", "key %d out of order after %d", r.Key, rows[len(rows)-1].Key)
+			}
+			rows = append(rows, r)
+		}
+		v = rows
+	case "beam:go:metrics:monitoring_table_string_keys:v1":
+		n := d.varint("count")
+		if n < 0 || n > int64(d.buf.Len()) {
+			d.invalid("count", "invalid row count %d", n)
+		}
+		var rows []StringTableRow
+		for i := int64(0); i < n && d.err == nil; i++ {
+			r := StringTableRow{Key: d.string("key"), Value: d.varint("value")}
+			if len(rows) > 0 && r.Key <= rows[len(rows)-1].Key {
+				d.invalid("key", "key %q out of order after %q", r.Key, rows[len(rows)-1].Key)
+			}
+			rows = append(rows, r)
+		}
+		v = rows
+	case "beam:metrics:progress:v1":
+		n := d.int32("count")
+		if n < 0 {
+			d.invalid("count", "negative length %d", n)
+		}
+		var vs []float64
+		for i := int32(0); i < n && d.err == nil; i++ {
+			vs = append(vs, d.double("value"))
+		}
+		v = vs
+	case "beam:metrics:top_n_int64:v1", "beam:metrics:bottom_n_int64:v1":
+		n := d.int32("count")
+		if n < 0 || int64(n) > int64(d.buf.Len()) {
+			d.invalid("count", "invalid length %d", n)
+		}
+		var vs []int64
+		for i := int32(0); i < n && d.err == nil; i++ {
+			vs = append(vs, d.varint("value"))
+		}
+		v = rankEntries(vs, typ == "beam:metrics:top_n_int64:v1")
+	default:
+		return nil, errors.Wrapf(ErrUnsupportedType, "can't decode %v payload", typ)
+	}
+	if d.err != nil {
+		return nil, errors.WithContextf(d.err, "decoding %v payload", typ)
+	}
+	if d.buf.Len() != 0 {
+		return nil, errors.Wrapf(ErrMalformedPayload, "decoding %v payload: %d unread bytes", typ, d.buf.Len())
+	}
+	return v, nil
+}
+
+// payloadDecoder decodes the fields of a payload in order. Once a field
+// fails to decode, the remaining fields decode as zero values, and err
+// holds the failure along with the field it occurred in.
+type payloadDecoder struct {
+	buf *bytes.Buffer
+	err error
+}
+
+// fail records the error decoding the field, unless an earlier field failed.
+// Errors from running out of bytes are reported as ErrPayloadTooShort.
+func (d *payloadDecoder) fail(field string, err error) {
+	if d.err != nil {
+		return
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = ErrPayloadTooShort
+	}
+	d.err = errors.WithContextf(err, "decoding field %v", field)
+}
+
+// invalid records that the field has an invalid value, as a failure
+// wrapping ErrMalformedPayload.
+func (d *payloadDecoder) invalid(field, format string, args ...interface{}) {
+	d.fail(field, errors.Wrapf(ErrMalformedPayload, format, args...))
+}
+
+func (d *payloadDecoder) varint(field string) int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, err := coder.DecodeVarInt(d.buf)
+	if err != nil {
+		d.fail(field, err)
+	}
+	return v
+}
+
+func (d *payloadDecoder) int32(field string) int32 {
+	if d.err != nil {
+		return 0
+	}
+	v, err := coder.DecodeInt32(d.buf)
+	if err != nil {
+		d.fail(field, err)
+	}
+	return v
+}
+
+func (d *payloadDecoder) double(field string) float64 {
+	if d.err != nil {
+		return 0
+	}
+	v, err := coder.DecodeDouble(d.buf)
+	if err != nil {
+		d.fail(field, err)
+	}
+	return v
+}
+
+func (d *payloadDecoder) string(field string) string {
+	if d.err != nil {
+		return ""
+	}
+	v, err := coder.DecodeStringUTF8(d.buf)
+	if err != nil {
+		d.fail(field, err)
+	}
+	return v
+}
+
+// msToTime converts milliseconds since the Unix epoch to a UTC time.Time.
+func msToTime(ms int64) time.Time {
+	return time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond)).UTC()
 }
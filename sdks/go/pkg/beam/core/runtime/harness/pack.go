@@ -0,0 +1,154 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package harness
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sort"
+	"sync/atomic"
+
+	"github.com/apache/beam/sdks/go/pkg/beam/core/graph/coder"
+	"github.com/apache/beam/sdks/go/pkg/beam/internal/errors"
+)
+
+// PackedCountersKey is the capability runners advertise to accept packed
+// counters, and the key under which the packed counters are sent. Short
+// ids never contain colons, so it can't collide with one.
+const PackedCountersKey = "beam:protocol:monitoring_data_packed_counters:v1"
+
+// counterPacking is whether counters are packed in responses.
+// Accessed atomically.
+var counterPacking int32
+
+// SetCounterPacking sets whether the sum_int64 counters of progress and
+// bundle responses are packed into a single payload, rather than sent as a
+// payload each, reducing the map and proto overhead for counter heavy
+// jobs. Must only be enabled for runners advertising the PackedCountersKey
+// capability, as others won't unpack them. Disabled by default.
+func SetCounterPacking(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&counterPacking, v)
+}
+
+// packPayloads replaces the payloads of the sum_int64 metrics with a single
+// payload of packed counters under PackedCountersKey. Payloads of other
+// types, or that aren't in the short id cache, are kept as is.
+func packPayloads(payloads map[string][]byte) (map[string][]byte, error) {
+	counters := make(map[string]int64)
+	ret := make(map[string][]byte, len(payloads))
+	for id, payload := range payloads {
+		if info, ok := defaultShortIDCache.lookup(id); ok && info.GetType() == urnToType(urnUserSumInt64) {
+			r := bytes.NewReader(payload)
+			if v, err := coder.DecodeVarInt(r); err == nil && r.Len() == 0 {
+				counters[id] = v
+				continue
+			}
+		}
+		ret[id] = payload
+	}
+	if len(counters) == 0 {
+		return payloads, nil
+	}
+	packed, err := packCounters(counters)
+	if err != nil {
+		return nil, err
+	}
+	ret[PackedCountersKey] = packed
+	return ret, nil
+}
+
+// packCounters encodes the counters in short id order, each as a varint
+// length prefixed short id followed by its value in Beam's varint
+// encoding, as in sum_int64 payloads.
+func packCounters(payloads map[string]int64) ([]byte, error) {
+	ids := make([]string, 0, len(payloads))
+	for id := range payloads {
+		if id == "" {
+			return nil, errors.New("failed to pack counters: empty short id")
+		}
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var buf bytes.Buffer
+	var tmp [binary.MaxVarintLen64]byte
+	for _, id := range ids {
+		n := binary.PutUvarint(tmp[:], uint64(len(id)))
+		buf.Write(tmp[:n])
+		buf.WriteString(id)
+		n = binary.PutUvarint(tmp[:], uint64(payloads[id]))
+		buf.Write(tmp[:n])
+	}
+	return buf.Bytes(), nil
+}
+
+// unpackCounters decodes counters packed by packCounters.
+func unpackCounters(packed []byte) (map[string]int64, error) {
+	r := bytes.NewReader(packed)
+	ret := make(map[string]int64)
+	for r.Len() > 0 {
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to unpack counters")
+		}
+		if n > uint64(r.Len()) {
+			return nil, errors.Wrap(io.ErrUnexpectedEOF, "failed to unpack counters")
+		}
+		id := make([]byte, n)
+		r.Read(id)
+		v, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to unpack counter for short id %v", string(id))
+		}
+		ret[string(id)] = int64(v)
+	}
+	return ret, nil
+}
+
+// UnpackPayloads returns the short id keyed payloads of a response, with
+// packed counters expanded into a sum_int64 payload each. Payloads without
+// packed counters are returned as is. Compressed payloads must be
+// decompressed with DecompressPayloads first.
+func UnpackPayloads(payloads map[string][]byte) (map[string][]byte, error) {
+	packed, ok := payloads[PackedCountersKey]
+	if !ok {
+		return payloads, nil
+	}
+	counters, err := unpackCounters(packed)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string][]byte, len(payloads)-1+len(counters))
+	for id, payload := range payloads {
+		if id != PackedCountersKey {
+			ret[id] = payload
+		}
+	}
+	for id, v := range counters {
+		if _, ok := ret[id]; ok {
+			return nil, errors.Errorf("short id %v is both packed and sent as a payload", id)
+		}
+		if ret[id], err = int64Counter(v); err != nil {
+			return nil, errors.Wrapf(err, "failed to encode counter for short id %v", id)
+		}
+	}
+	return ret, nil
+}
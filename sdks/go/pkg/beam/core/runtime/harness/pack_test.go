@@ -0,0 +1,121 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package harness
+
+import (
+	"math"
+	"strconv"
+	"testing"
+
+	"github.com/apache/beam/sdks/go/pkg/beam/core/metrics"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPackCounters(t *testing.T) {
+	counters := make(map[string]int64)
+	for i := 0; i < 10000; i++ {
+		counters[strconv.FormatInt(int64(i), 36)] = int64(i*i) - 5000
+	}
+	counters["max"] = math.MaxInt64
+	counters["min"] = math.MinInt64
+	packed, err := packCounters(counters)
+	if err != nil {
+		t.Fatalf("packCounters failed: %v", err)
+	}
+	got, err := unpackCounters(packed)
+	if err != nil {
+		t.Fatalf("unpackCounters failed: %v", err)
+	}
+	if d := cmp.Diff(counters, got); d != "" {
+		t.Errorf("round tripped counters diff (-want, +got):\n%v", d)
+	}
+
+	if _, err := unpackCounters(packed[:len(packed)-1]); err == nil {
+		t.Errorf("unpackCounters of truncated counters succeeded, want error")
+	}
+	if _, err := packCounters(map[string]int64{"": 1}); err == nil {
+		t.Errorf("packCounters with an empty short id succeeded, want error")
+	}
+}
+
+func TestPackPayloads(t *testing.T) {
+	must := func(b []byte, err error) []byte {
+		if err != nil {
+			t.Fatalf("encoding failed: %v", err)
+		}
+		return b
+	}
+
+	payloads := make(map[string][]byte)
+	for i := 0; i < 100; i++ {
+		id := getShortIDForTest(metrics.UserLabels("pt", "pack", strconv.Itoa(i)), urnUserSumInt64)
+		payloads[id] = must(int64Counter(int64(i)))
+	}
+	dist := getShortIDForTest(metrics.UserLabels("pt", "pack", "dist"), urnUserDistInt64)
+	payloads[dist] = must(int64Distribution(2, 5, 1, 4))
+
+	packed, err := packPayloads(payloads)
+	if err != nil {
+		t.Fatalf("packPayloads failed: %v", err)
+	}
+	if got, want := len(packed), 2; got != want {
+		t.Errorf("packPayloads returned %d payloads, want %d: the distribution and the packed counters", got, want)
+	}
+	if got, orig := PayloadsSize(packed), PayloadsSize(payloads); got >= orig {
+		t.Errorf("packed payloads are %d bytes, want fewer than %d", got, orig)
+	}
+	got, err := UnpackPayloads(packed)
+	if err != nil {
+		t.Fatalf("UnpackPayloads failed: %v", err)
+	}
+	if d := cmp.Diff(payloads, got); d != "" {
+		t.Errorf("round tripped payloads diff (-want, +got):\n%v", d)
+	}
+}
+
+func TestResponsePayloads_PackedAndCompressed(t *testing.T) {
+	defer SetCounterPacking(false)
+	defer SetPayloadCompression(false)
+	SetCounterPacking(true)
+	SetPayloadCompression(true)
+
+	must := func(b []byte, err error) []byte {
+		if err != nil {
+			t.Fatalf("encoding failed: %v", err)
+		}
+		return b
+	}
+	payloads := make(map[string][]byte)
+	for i := 0; i < 1000; i++ {
+		id := getShortIDForTest(metrics.UserLabels("pt", "response", strconv.Itoa(i)), urnUserSumInt64)
+		payloads[id] = must(int64Counter(int64(i % 10)))
+	}
+	sent, err := responsePayloads(payloads)
+	if err != nil {
+		t.Fatalf("responsePayloads failed: %v", err)
+	}
+	decompressed, err := DecompressPayloads(sent)
+	if err != nil {
+		t.Fatalf("DecompressPayloads failed: %v", err)
+	}
+	got, err := UnpackPayloads(decompressed)
+	if err != nil {
+		t.Fatalf("UnpackPayloads failed: %v", err)
+	}
+	if d := cmp.Diff(payloads, got); d != "" {
+		t.Errorf("round tripped payloads diff (-want, +got):\n%v", d)
+	}
+}
@@ -0,0 +1,139 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package harness
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/apache/beam/sdks/go/pkg/beam/core/runtime/exec"
+	pipepb "github.com/apache/beam/sdks/go/pkg/beam/model/pipeline_v1"
+)
+
+// PrometheusHandler returns an http.Handler that serves the current metrics
+// of the plan in the Prometheus text exposition format.
+//
+// Metric names are the sanitized metric urns, and the MonitoringInfo labels
+// become lower cased Prometheus labels. Sums are exposed as counters, latest
+// values as gauges, and distributions as summaries without quantiles, with
+// additional _min and _max gauges. Metrics of other types are skipped.
+func PrometheusHandler(p *exec.Plan) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mons, err := peekMonitoring(p)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write(prometheusText(mons))
+	})
+}
+
+// promFamily groups the samples of a single Prometheus metric.
+type promFamily struct {
+	typ     string
+	samples []string
+}
+
+// prometheusText renders the MonitoringInfos in the Prometheus text
+// exposition format, sorted by metric name and then sample.
+func prometheusText(mons []*pipepb.MonitoringInfo) []byte {
+	families := make(map[string]*promFamily)
+	add := func(family, typ, sample, labels string, v int64) {
+		f, ok := families[family]
+		if !ok {
+			f = &promFamily{typ: typ}
+			families[family] = f
+		}
+		f.samples = append(f.samples, fmt.Sprintf("%s%s %d", sample, labels, v))
+	}
+	for _, mi := range mons {
+		v, err := decodePayload(mi.GetType(), mi.GetPayload())
+		if err != nil {
+			continue
+		}
+		name := promName(mi.GetUrn())
+		labels := promLabels(mi.GetLabels())
+		switch v := v.(type) {
+		case int64:
+			add(name, "counter", name, labels, v)
+		case GaugeData:
+			add(name, "gauge", name, labels, v.Value)
+		case DistributionData:
+			add(name, "summary", name+"_count", labels, v.Count())
+			add(name, "summary", name+"_sum", labels, v.Sum())
+			add(name+"_min", "gauge", name+"_min", labels, v.Min())
+			add(name+"_max", "gauge", name+"_max", labels, v.Max())
+		}
+	}
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	for _, name := range names {
+		f := families[name]
+		sort.Strings(f.samples)
+		fmt.Fprintf(&buf, "# TYPE %s %s\n", name, f.typ)
+		for _, s := range f.samples {
+			buf.WriteString(s)
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.Bytes()
+}
+
+// promName converts a string into a valid Prometheus metric or label name,
+// replacing invalid characters with underscores.
+func promName(s string) string {
+	var b strings.Builder
+	for i, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_':
+			b.WriteRune(r)
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				b.WriteByte('_')
+			}
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+// promLabels renders the labels as a sorted Prometheus label set, with
+// lower cased, sanitized names and escaped values.
+func promLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, promName(strings.ToLower(k))+`="`+promEscaper.Replace(v)+`"`)
+	}
+	sort.Strings(pairs)
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// promEscaper escapes label values for the Prometheus text format.
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
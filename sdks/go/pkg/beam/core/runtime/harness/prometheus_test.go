@@ -0,0 +1,109 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package harness
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apache/beam/sdks/go/pkg/beam/core/metrics"
+	pipepb "github.com/apache/beam/sdks/go/pkg/beam/model/pipeline_v1"
+)
+
+func TestPrometheusHandler(t *testing.T) {
+	plan, _ := executeTestPlan(t, 10)
+	rec := httptest.NewRecorder()
+	PrometheusHandler(plan).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	if got, want := rec.Header().Get("Content-Type"), "text/plain; version=0.0.4"; got != want {
+		t.Errorf("Content-Type = %q, want %q", got, want)
+	}
+	body, err := ioutil.ReadAll(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(string(body), "\n")
+	for _, want := range []string{
+		"# TYPE beam_metric_element_count_v1 counter",
+		`beam_metric_element_count_v1{pcollection="p1"} 10`,
+	} {
+		if !hasLine(lines, want) {
+			t.Errorf("output is missing line %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestPrometheusText(t *testing.T) {
+	mustEncode := func(b []byte, err error) []byte {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	labels := userLabels(metrics.UserLabels("my\"T", "my.namespace", "dist"))
+	mons := []*pipepb.MonitoringInfo{
+		{
+			Urn:     sUrns[urnUserDistInt64],
+			Type:    urnToType(urnUserDistInt64),
+			Labels:  labels,
+			Payload: mustEncode(int64Distribution(3, 6, 1, 3)),
+		}, {
+			Urn:     sUrns[urnUserLatestMsString],
+			Type:    urnToType(urnUserLatestMsString),
+			Labels:  labels,
+			Payload: mustEncode(stringLatest(time.Unix(0, 0), "skipped")),
+		},
+	}
+	got := string(prometheusText(mons))
+	want := `# TYPE beam_metric_user_distribution_int64_v1 summary
+beam_metric_user_distribution_int64_v1_count{name="dist",namespace="my.namespace",ptransform="my\"T"} 3
+beam_metric_user_distribution_int64_v1_sum{name="dist",namespace="my.namespace",ptransform="my\"T"} 6
+# TYPE beam_metric_user_distribution_int64_v1_max gauge
+beam_metric_user_distribution_int64_v1_max{name="dist",namespace="my.namespace",ptransform="my\"T"} 3
+# TYPE beam_metric_user_distribution_int64_v1_min gauge
+beam_metric_user_distribution_int64_v1_min{name="dist",namespace="my.namespace",ptransform="my\"T"} 1
+`
+	if got != want {
+		t.Errorf("prometheusText() =\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestPromName(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"beam:metric:user:sum_int64:v1", "beam_metric_user_sum_int64_v1"},
+		{"9lives", "_9lives"},
+		{"ok_name", "ok_name"},
+		{"spaces and-dashes", "spaces_and_dashes"},
+	}
+	for _, test := range tests {
+		if got := promName(test.in); got != test.want {
+			t.Errorf("promName(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func hasLine(lines []string, want string) bool {
+	for _, l := range lines {
+		if l == want {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,105 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package harness
+
+import (
+	"math"
+	"sync/atomic"
+
+	"github.com/apache/beam/sdks/go/pkg/beam/core/metrics"
+	"github.com/apache/beam/sdks/go/pkg/beam/internal/errors"
+)
+
+// userMetricSampling is the fraction of user metrics reported, as the bits
+// of a float64, or zero to report all of them. Accessed atomically.
+var userMetricSampling uint64
+
+// SetUserMetricSampling sets monitoring to report only the given fraction
+// of user metrics, for jobs with so many distinct labeled metrics that
+// reporting all of them is impractical. The reported values of sums and
+// distribution counts and sums are scaled by the inverse of the rate, to
+// estimate the totals across all metrics. Gauges and bounds are reported
+// as is.
+//
+// Metrics are sampled by a consistent hash of their labels, so the same
+// metrics are reported on every call, and by every worker. The rate must be
+// in (0, 1]. A rate of 1, the default, reports all user metrics.
+func SetUserMetricSampling(rate float64) error {
+	if !(rate > 0 && rate <= 1) {
+		return errors.Errorf("user metric sampling rate %v isn't in (0, 1]", rate)
+	}
+	if rate == 1 {
+		rate = 0
+	}
+	atomic.StoreUint64(&userMetricSampling, math.Float64bits(rate))
+	return nil
+}
+
+// metricSampler decides which user metrics are reported when sampling, and
+// scales their values. A nil sampler reports all metrics unscaled.
+type metricSampler struct {
+	threshold uint64  // Label sets whose hash is below it are sampled.
+	scale     float64 // The inverse of the sampling rate.
+}
+
+// getMetricSampler returns the sampler for the rate set by
+// SetUserMetricSampling, or nil if all metrics are reported.
+func getMetricSampler() *metricSampler {
+	rate := math.Float64frombits(atomic.LoadUint64(&userMetricSampling))
+	if rate == 0 {
+		return nil
+	}
+	s := &metricSampler{threshold: math.MaxUint64, scale: 1 / rate}
+	if t := rate * (1 << 64); t < 1<<64 {
+		s.threshold = uint64(t)
+	}
+	return s
+}
+
+// keep returns whether the metric with the labels is sampled.
+func (s *metricSampler) keep(l metrics.Labels) bool {
+	if s == nil {
+		return true
+	}
+	return mix64(labelsHash(l)) < s.threshold
+}
+
+// scaled returns v scaled by the inverse of the sampling rate, rounded and
+// saturated to the range of int64.
+func (s *metricSampler) scaled(v int64) int64 {
+	if s == nil {
+		return v
+	}
+	f := math.Round(float64(v) * s.scale)
+	switch {
+	case f >= math.MaxInt64:
+		return math.MaxInt64
+	case f <= math.MinInt64:
+		return math.MinInt64
+	}
+	return int64(f)
+}
+
+// mix64 is the splitmix64 finalizer, spreading the bits of h so that
+// sampling thresholds on similar label sets are evenly distributed.
+func mix64(h uint64) uint64 {
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
@@ -0,0 +1,107 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package harness
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"testing"
+
+	"github.com/apache/beam/sdks/go/pkg/beam/core/metrics"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSetUserMetricSampling_Invalid(t *testing.T) {
+	defer SetUserMetricSampling(1)
+	for _, rate := range []float64{0, -0.5, 1.5, math.NaN(), math.Inf(1)} {
+		if err := SetUserMetricSampling(rate); err == nil {
+			t.Errorf("SetUserMetricSampling(%v) succeeded, want error", rate)
+		}
+	}
+}
+
+func TestMonitoring_UserMetricSampling(t *testing.T) {
+	defer SetUserMetricSampling(1)
+	ctx := metrics.SetPTransformID(metrics.SetBundleID(context.Background(), "bundle"), "pt")
+	const n = 1000
+	for i := 0; i < n; i++ {
+		metrics.NewCounter("sampled", strconv.Itoa(i)).Inc(ctx, 3)
+	}
+	d := metrics.NewDistribution("sampled", "spread")
+	d.Update(ctx, 2)
+	d.Update(ctx, 6)
+	src := &fakeSource{store: metrics.GetStore(ctx)}
+
+	if err := SetUserMetricSampling(0.25); err != nil {
+		t.Fatalf("SetUserMetricSampling failed: %v", err)
+	}
+	// sampled returns the reported counters by name, failing on any
+	// counter that wasn't scaled. The distribution's labels are sampled.
+	sampled := func() map[string]bool {
+		var sawDist bool
+		defer func() {
+			if !sawDist {
+				t.Errorf("distribution wasn't sampled")
+			}
+		}()
+		mons, _, err := monitoring(src)
+		if err != nil {
+			t.Fatalf("monitoring failed: %v", err)
+		}
+		got := make(map[string]bool)
+		for _, mi := range mons {
+			if mi.GetLabels()["NAMESPACE"] != "sampled" {
+				continue
+			}
+			v, err := DecodeMonitoringInfo(mi)
+			if err != nil {
+				t.Fatalf("failed to decode %v: %v", mi, err)
+			}
+			switch v := v.(type) {
+			case int64:
+				if v != 12 {
+					t.Errorf("counter %v = %v, want 3 scaled to 12", mi.GetLabels()["NAME"], v)
+				}
+				got[mi.GetLabels()["NAME"]] = true
+			case DistributionData:
+				sawDist = true
+				if want := (DistributionData{8, 32, 2, 6}); v != want {
+					t.Errorf("distribution = %v, want count and sum scaled to %v", v, want)
+				}
+			}
+		}
+		return got
+	}
+	first := sampled()
+	if len(first) < n/8 || len(first) > n*3/8 {
+		t.Errorf("sampled %d of %d counters, want about %d", len(first), n, n/4)
+	}
+	if d := cmp.Diff(first, sampled()); d != "" {
+		t.Errorf("sampled counters changed between calls (-first, +second):\n%v", d)
+	}
+
+	if err := SetUserMetricSampling(1); err != nil {
+		t.Fatalf("SetUserMetricSampling failed: %v", err)
+	}
+	mons, _, err := monitoring(src)
+	if err != nil {
+		t.Fatalf("monitoring failed: %v", err)
+	}
+	if got := len(FilterInfosByURNPrefix(mons, sUrns[urnUserSumInt64])); got != n {
+		t.Errorf("reported %d counters without sampling, want %d", got, n)
+	}
+}
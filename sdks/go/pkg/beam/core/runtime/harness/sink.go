@@ -0,0 +1,118 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package harness
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+
+	"github.com/apache/beam/sdks/go/pkg/beam/core/runtime/exec"
+	"github.com/apache/beam/sdks/go/pkg/beam/internal/errors"
+	pipepb "github.com/apache/beam/sdks/go/pkg/beam/model/pipeline_v1"
+	"github.com/golang/protobuf/proto"
+)
+
+// MetricSink receives the metrics extracted from a plan, for pushing them
+// somewhere rather than returning them to the caller.
+type MetricSink interface {
+	// Report receives the extracted MonitoringInfos, and their payloads
+	// keyed by short id.
+	Report(infos []*pipepb.MonitoringInfo, payloads map[string][]byte) error
+}
+
+// monitoringTo extracts the metrics of the plan like monitoring, and
+// pushes them to the sink. If extraction fails part way, the metrics
+// collected so far are still reported, and the extraction error is
+// returned.
+func monitoringTo(p metricsSource, sink MetricSink) error {
+	infos, payloads, err := monitoring(p)
+	if infos == nil && payloads == nil && err != nil {
+		return err
+	}
+	if rerr := sink.Report(infos, payloads); rerr != nil {
+		return errors.Wrap(rerr, "failed to report metrics to sink")
+	}
+	return err
+}
+
+// FlushOnShutdown blocks until ctx is done, such as when the worker receives
+// SIGTERM, then extracts the plan's metrics a final time and reports them
+// to the sink before returning. This avoids losing the metrics of the last
+// reporting interval when the worker exits. Returns the error of the final
+// extraction or report, as monitoringTo does.
+func FlushOnShutdown(ctx context.Context, p *exec.Plan, sink MetricSink) error {
+	return flushOnShutdown(ctx, p, sink)
+}
+
+// flushOnShutdown implements FlushOnShutdown for any metricsSource.
+func flushOnShutdown(ctx context.Context, p metricsSource, sink MetricSink) error {
+	<-ctx.Done()
+	return monitoringTo(p, sink)
+}
+
+// collectSink is a MetricSink that collects the metrics in the structures
+// monitoring returns. Metrics from multiple reports are accumulated, with
+// later payloads replacing earlier ones for the same short id.
+type collectSink struct {
+	infos    []*pipepb.MonitoringInfo
+	payloads map[string][]byte
+}
+
+// Report collects the metrics.
+func (s *collectSink) Report(infos []*pipepb.MonitoringInfo, payloads map[string][]byte) error {
+	s.infos = append(s.infos, infos...)
+	if s.payloads == nil {
+		s.payloads = make(map[string][]byte, len(payloads))
+	}
+	for id, payload := range payloads {
+		s.payloads[id] = payload
+	}
+	return nil
+}
+
+// WriteMonitoring extracts the current metrics of the plan, and writes each
+// MonitoringInfo to w as it's produced, as a varint length prefixed proto,
+// rather than accumulating them. This suits forwarding the metrics of
+// bundles with very many metrics in constrained memory. The written
+// MonitoringInfos carry their full labels rather than short ids.
+//
+// Extraction stops at the first write error, which is returned. Like
+// monitoring, if extraction fails part way, the metrics written so far are
+// kept, and the extraction error is returned.
+func WriteMonitoring(w io.Writer, p *exec.Plan) error {
+	return writeMonitoring(w, p)
+}
+
+// writeMonitoring implements WriteMonitoring for any metricsSource.
+func writeMonitoring(w io.Writer, p metricsSource) error {
+	var prefix [binary.MaxVarintLen64]byte
+	_, _, err := filteredMonitoring(p, nil, func(mi *pipepb.MonitoringInfo) error {
+		b, err := proto.Marshal(mi)
+		if err != nil {
+			return errors.Wrapf(err, "failed to marshal MonitoringInfo %v", mi.GetUrn())
+		}
+		n := binary.PutUvarint(prefix[:], uint64(len(b)))
+		if _, err := w.Write(prefix[:n]); err != nil {
+			return errors.Wrap(err, "failed to write MonitoringInfo")
+		}
+		if _, err := w.Write(b); err != nil {
+			return errors.Wrap(err, "failed to write MonitoringInfo")
+		}
+		return nil
+	})
+	return err
+}
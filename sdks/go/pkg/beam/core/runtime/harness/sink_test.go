@@ -0,0 +1,206 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package harness
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/apache/beam/sdks/go/pkg/beam/core/metrics"
+	"github.com/apache/beam/sdks/go/pkg/beam/internal/errors"
+	pipepb "github.com/apache/beam/sdks/go/pkg/beam/model/pipeline_v1"
+	"github.com/golang/protobuf/proto"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+// recordingSink is a MetricSink that records each report.
+type recordingSink struct {
+	reports [][]*pipepb.MonitoringInfo
+	err     error
+}
+
+func (s *recordingSink) Report(infos []*pipepb.MonitoringInfo, payloads map[string][]byte) error {
+	s.reports = append(s.reports, infos)
+	return s.err
+}
+
+func TestMonitoringTo(t *testing.T) {
+	ctx := metrics.SetPTransformID(metrics.SetBundleID(context.Background(), "bundle"), "pt")
+	metrics.NewCounter("ns", "count").Inc(ctx, 1)
+	metrics.NewDistribution("ns", "dist").Update(ctx, 2)
+	src := &fakeSource{store: metrics.GetStore(ctx)}
+
+	sink := &recordingSink{}
+	if err := monitoringTo(src, sink); err != nil {
+		t.Fatalf("monitoringTo failed: %v", err)
+	}
+	if got, want := len(sink.reports), 1; got != want {
+		t.Fatalf("sink received %d reports, want %d", got, want)
+	}
+	urns := make(map[string]bool)
+	for _, mi := range sink.reports[0] {
+		urns[mi.GetUrn()] = true
+	}
+	for _, u := range []mUrn{urnUserSumInt64, urnUserDistInt64} {
+		if !urns[sUrns[u]] {
+			t.Errorf("sink didn't receive %v: %v", sUrns[u], sink.reports[0])
+		}
+	}
+
+	sink.err = errors.New("sink unavailable")
+	if err := monitoringTo(src, sink); !contains(err, sink.err) {
+		t.Errorf("monitoringTo with failing sink = %v, want %v", err, sink.err)
+	}
+}
+
+func TestFlushOnShutdown(t *testing.T) {
+	ctx := metrics.SetPTransformID(metrics.SetBundleID(context.Background(), "bundle"), "pt")
+	metrics.NewCounter("ns", "count").Inc(ctx, 1)
+	src := &fakeSource{store: metrics.GetStore(ctx)}
+
+	shutdown, cancel := context.WithCancel(context.Background())
+	sink := &recordingSink{}
+	done := make(chan error, 1)
+	go func() {
+		done <- flushOnShutdown(shutdown, src, sink)
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("flushOnShutdown returned before cancellation: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("flushOnShutdown failed: %v", err)
+	}
+	if got, want := len(sink.reports), 1; got != want {
+		t.Fatalf("sink received %d reports, want %d", got, want)
+	}
+	if len(FilterInfosByURNPrefix(sink.reports[0], sUrns[urnUserSumInt64])) == 0 {
+		t.Errorf("final report doesn't include the counter: %v", sink.reports[0])
+	}
+}
+
+func TestCollectSink(t *testing.T) {
+	ctx := metrics.SetPTransformID(metrics.SetBundleID(context.Background(), "bundle"), "pt")
+	metrics.NewCounter("ns", "count").Inc(ctx, 1)
+	src := &fakeSource{store: metrics.GetStore(ctx)}
+
+	var sink collectSink
+	if err := monitoringTo(src, &sink); err != nil {
+		t.Fatalf("monitoringTo failed: %v", err)
+	}
+	mons, payloads, err := monitoring(src)
+	if err != nil {
+		t.Fatalf("monitoring failed: %v", err)
+	}
+	// Worker level metrics, like the heartbeat, change between calls.
+	opts := []cmp.Option{cmpopts.EquateEmpty(), cmp.Comparer(func(a, b *pipepb.MonitoringInfo) bool {
+		return a.GetUrn() == b.GetUrn() && cmp.Equal(a.GetLabels(), b.GetLabels(), cmpopts.EquateEmpty())
+	})}
+	if d := cmp.Diff(withoutWorkerMetrics(mons), withoutWorkerMetrics(sink.infos), opts...); d != "" {
+		t.Errorf("collected infos diff (-want, +got):\n%v", d)
+	}
+	if got, want := len(sink.payloads), len(payloads); got != want {
+		t.Errorf("collected %d payloads, want %d", got, want)
+	}
+}
+
+func TestWriteMonitoring(t *testing.T) {
+	ctx := metrics.SetPTransformID(metrics.SetBundleID(context.Background(), "bundle"), "pt")
+	for i := 0; i < 50; i++ {
+		metrics.NewCounter("ns", fmt.Sprintf("count%d", i)).Inc(ctx, int64(i))
+	}
+	metrics.NewDistribution("ns", "dist").Update(ctx, 2)
+	src := &fakeSource{store: metrics.GetStore(ctx)}
+
+	var buf bytes.Buffer
+	if err := writeMonitoring(&buf, src); err != nil {
+		t.Fatalf("writeMonitoring failed: %v", err)
+	}
+	var got []*pipepb.MonitoringInfo
+	r := bufio.NewReader(&buf)
+	for {
+		n, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("failed to read length prefix: %v", err)
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			t.Fatalf("failed to read MonitoringInfo: %v", err)
+		}
+		var mi pipepb.MonitoringInfo
+		if err := proto.Unmarshal(b, &mi); err != nil {
+			t.Fatalf("failed to unmarshal MonitoringInfo: %v", err)
+		}
+		got = append(got, &mi)
+	}
+
+	want, _, err := monitoring(src)
+	if err != nil {
+		t.Fatalf("monitoring failed: %v", err)
+	}
+	// Worker level metrics, like the heartbeat, change between calls.
+	got, want = withoutWorkerMetrics(got), withoutWorkerMetrics(want)
+	// Metrics are extracted from the store in no particular order.
+	byKey := cmpopts.SortSlices(func(a, b *pipepb.MonitoringInfo) bool {
+		return a.GetUrn()+labelsKey(a) < b.GetUrn()+labelsKey(b)
+	})
+	if d := cmp.Diff(want, got, cmp.Comparer(proto.Equal), byKey); d != "" {
+		t.Errorf("streamed MonitoringInfos diff (-want, +got):\n%v", d)
+	}
+	if got, want := len(got), 51; got != want {
+		t.Errorf("streamed %d MonitoringInfos, want %d", got, want)
+	}
+}
+
+// failingWriter fails every write, counting the attempts.
+type failingWriter struct {
+	err    error
+	writes int
+}
+
+func (w *failingWriter) Write([]byte) (int, error) {
+	w.writes++
+	return 0, w.err
+}
+
+// TestWriteMonitoring_WriteError validates that extraction stops at the
+// first write error, which is returned.
+func TestWriteMonitoring_WriteError(t *testing.T) {
+	ctx := metrics.SetPTransformID(metrics.SetBundleID(context.Background(), "bundle"), "pt")
+	for i := 0; i < 10; i++ {
+		metrics.NewCounter("ns", fmt.Sprintf("count%d", i)).Inc(ctx, 1)
+	}
+	w := &failingWriter{err: errors.New("disk full")}
+	if err := writeMonitoring(w, &fakeSource{store: metrics.GetStore(ctx)}); !contains(err, w.err) {
+		t.Errorf("writeMonitoring with failing writer = %v, want %v", err, w.err)
+	}
+	if got, want := w.writes, 1; got != want {
+		t.Errorf("writeMonitoring attempted %d writes, want %d", got, want)
+	}
+}
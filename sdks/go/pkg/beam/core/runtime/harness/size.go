@@ -0,0 +1,158 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package harness
+
+import (
+	"sort"
+	"strings"
+
+	fnpb "github.com/apache/beam/sdks/go/pkg/beam/model/fnexecution_v1"
+	pipepb "github.com/apache/beam/sdks/go/pkg/beam/model/pipeline_v1"
+	"github.com/golang/protobuf/proto"
+)
+
+// PayloadsSize returns the serialized size in bytes of the short id keyed
+// payloads as the monitoring_data field of a response, including the
+// framing of each map entry.
+func PayloadsSize(payloads map[string][]byte) int {
+	if len(payloads) == 0 {
+		return 0
+	}
+	return proto.Size(&fnpb.ProcessBundleProgressResponse{MonitoringData: payloads})
+}
+
+// InfosSize returns the serialized size in bytes of the MonitoringInfos as
+// the monitoring_infos field of a response, including the framing of each
+// info.
+func InfosSize(infos []*pipepb.MonitoringInfo) int {
+	if len(infos) == 0 {
+		return 0
+	}
+	return proto.Size(&fnpb.ProcessBundleProgressResponse{MonitoringInfos: infos})
+}
+
+// ProgressResponseSize returns the serialized size in bytes of a
+// ProcessBundleProgressResponse holding the infos and payloads, so
+// reports can be checked against runner size limits before sending.
+func ProgressResponseSize(infos []*pipepb.MonitoringInfo, payloads map[string][]byte) int {
+	return InfosSize(infos) + PayloadsSize(payloads)
+}
+
+// MonitoringChunk is a batch of MonitoringInfos and short id keyed payloads
+// small enough to send in a single response.
+type MonitoringChunk struct {
+	Infos    []*pipepb.MonitoringInfo
+	Payloads map[string][]byte
+}
+
+// chunkItem is a metric's info and its payload under its short id, which
+// must be sent in the same chunk.
+type chunkItem struct {
+	info    *pipepb.MonitoringInfo
+	id      string
+	payload []byte
+	size    int
+}
+
+// ChunkMonitoring splits the output of monitoring into chunks whose
+// serialized size is at most maxBytes, keeping each metric's info and short
+// id payload together. Every metric appears in exactly one chunk. A metric
+// too large for the budget on its own is placed alone in its own chunk.
+func ChunkMonitoring(infos []*pipepb.MonitoringInfo, payloads map[string][]byte, maxBytes int) []MonitoringChunk {
+	ids := shortIDsByMetadata(payloads)
+	var items []chunkItem
+	used := make(map[string]bool, len(payloads))
+	for _, mi := range infos {
+		it := chunkItem{info: mi}
+		if id, ok := ids[metadataKey(mi)]; ok && !used[id] {
+			it.id, it.payload = id, payloads[id]
+			used[id] = true
+		}
+		items = append(items, it)
+	}
+	// Keep any payloads without a matching info, in a stable order.
+	var rest []string
+	for id := range payloads {
+		if !used[id] {
+			rest = append(rest, id)
+		}
+	}
+	sort.Strings(rest)
+	for _, id := range rest {
+		items = append(items, chunkItem{id: id, payload: payloads[id]})
+	}
+
+	var chunks []MonitoringChunk
+	var cur MonitoringChunk
+	curSize := 0
+	for _, it := range items {
+		if it.info != nil {
+			it.size += InfosSize([]*pipepb.MonitoringInfo{it.info})
+		}
+		if it.id != "" {
+			it.size += PayloadsSize(map[string][]byte{it.id: it.payload})
+		}
+		if curSize > 0 && curSize+it.size > maxBytes {
+			chunks = append(chunks, cur)
+			cur, curSize = MonitoringChunk{}, 0
+		}
+		if it.info != nil {
+			cur.Infos = append(cur.Infos, it.info)
+		}
+		if it.id != "" {
+			if cur.Payloads == nil {
+				cur.Payloads = make(map[string][]byte)
+			}
+			cur.Payloads[it.id] = it.payload
+		}
+		curSize += it.size
+	}
+	if curSize > 0 {
+		chunks = append(chunks, cur)
+	}
+	return chunks
+}
+
+// shortIDsByMetadata indexes the short ids of the payloads by the
+// metadata cached for them.
+func shortIDsByMetadata(payloads map[string][]byte) map[string]string {
+	ids := make(map[string]string, len(payloads))
+	for id := range payloads {
+		if info, ok := defaultShortIDCache.lookup(id); ok {
+			ids[metadataKey(info)] = id
+		}
+	}
+	return ids
+}
+
+// metadataKey identifies a MonitoringInfo by its urn and labels.
+func metadataKey(mi *pipepb.MonitoringInfo) string {
+	ls := mi.GetLabels()
+	keys := make([]string, 0, len(ls))
+	for k := range ls {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString(mi.GetUrn())
+	for _, k := range keys {
+		b.WriteByte(0)
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(ls[k])
+	}
+	return b.String()
+}
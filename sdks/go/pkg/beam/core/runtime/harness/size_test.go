@@ -0,0 +1,107 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package harness
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/apache/beam/sdks/go/pkg/beam/core/metrics"
+	fnpb "github.com/apache/beam/sdks/go/pkg/beam/model/fnexecution_v1"
+	pipepb "github.com/apache/beam/sdks/go/pkg/beam/model/pipeline_v1"
+	"github.com/golang/protobuf/proto"
+)
+
+func TestProgressResponseSize(t *testing.T) {
+	plan, _ := executeTestPlan(t, 10)
+	infos, payloads, err := monitoring(plan)
+	if err != nil {
+		t.Fatalf("monitoring failed: %v", err)
+	}
+	if len(infos) == 0 || len(payloads) == 0 {
+		t.Fatalf("monitoring returned no metrics: %v, %v", infos, payloads)
+	}
+
+	marshalledSize := func(resp *fnpb.ProcessBundleProgressResponse) int {
+		t.Helper()
+		b, err := proto.Marshal(resp)
+		if err != nil {
+			t.Fatalf("failed to marshal response: %v", err)
+		}
+		return len(b)
+	}
+	if got, want := InfosSize(infos), marshalledSize(&fnpb.ProcessBundleProgressResponse{MonitoringInfos: infos}); got != want {
+		t.Errorf("InfosSize() = %v, want %v", got, want)
+	}
+	if got, want := PayloadsSize(payloads), marshalledSize(&fnpb.ProcessBundleProgressResponse{MonitoringData: payloads}); got != want {
+		t.Errorf("PayloadsSize() = %v, want %v", got, want)
+	}
+	resp := &fnpb.ProcessBundleProgressResponse{MonitoringInfos: infos, MonitoringData: payloads}
+	if got, want := ProgressResponseSize(infos, payloads), marshalledSize(resp); got != want {
+		t.Errorf("ProgressResponseSize() = %v, want %v", got, want)
+	}
+	if got := ProgressResponseSize(nil, nil); got != 0 {
+		t.Errorf("ProgressResponseSize(nil, nil) = %v, want 0", got)
+	}
+}
+
+func TestChunkMonitoring(t *testing.T) {
+	ctx := metrics.SetPTransformID(metrics.SetBundleID(context.Background(), "bundle"), "pt")
+	for i := 0; i < 50; i++ {
+		metrics.NewCounter("chunk", fmt.Sprintf("counter%d", i)).Inc(ctx, int64(i))
+	}
+	infos, payloads, err := monitoring(&fakeSource{store: metrics.GetStore(ctx)})
+	if err != nil {
+		t.Fatalf("monitoring failed: %v", err)
+	}
+
+	const maxBytes = 256
+	chunks := ChunkMonitoring(infos, payloads, maxBytes)
+	if len(chunks) < 2 {
+		t.Fatalf("ChunkMonitoring(%d bytes, %d) returned %d chunks, want several", ProgressResponseSize(infos, payloads), maxBytes, len(chunks))
+	}
+	seenInfos := make(map[*pipepb.MonitoringInfo]int)
+	seenIDs := make(map[string]int)
+	for i, c := range chunks {
+		if got := ProgressResponseSize(c.Infos, c.Payloads); got > maxBytes {
+			t.Errorf("chunk %d size = %d, want at most %d", i, got, maxBytes)
+		}
+		if len(c.Infos) != len(c.Payloads) {
+			t.Errorf("chunk %d has %d infos but %d payloads", i, len(c.Infos), len(c.Payloads))
+		}
+		for _, mi := range c.Infos {
+			seenInfos[mi]++
+		}
+		for id, p := range c.Payloads {
+			seenIDs[id]++
+			if !bytes.Equal(p, payloads[id]) {
+				t.Errorf("chunk %d payload %v = %v, want %v", i, id, p, payloads[id])
+			}
+		}
+	}
+	for _, mi := range infos {
+		if n := seenInfos[mi]; n != 1 {
+			t.Errorf("info %v appeared %d times, want once", mi, n)
+		}
+	}
+	for id := range payloads {
+		if n := seenIDs[id]; n != 1 {
+			t.Errorf("payload %v appeared %d times, want once", id, n)
+		}
+	}
+}
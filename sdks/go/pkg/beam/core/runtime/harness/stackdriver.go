@@ -0,0 +1,108 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package harness
+
+import (
+	"math"
+	"math/bits"
+)
+
+// The exponential bucket layout of StackdriverDist. Bucket i, for
+// 1 <= i <= StackdriverNumFiniteBuckets, holds values in
+// [scale * growth^(i-1), scale * growth^i). Bucket 0 is the underflow
+// bucket, holding values below the scale, including all non-positive
+// values. With a scale of 1 and a growth factor of 2, every positive
+// int64 falls in a finite bucket.
+const (
+	StackdriverNumFiniteBuckets = 64
+	StackdriverGrowthFactor     = 2.0
+	StackdriverScale            = 1.0
+)
+
+// StackdriverDist is a distribution in the shape of a Stackdriver
+// distribution metric value with exponential buckets.
+type StackdriverDist struct {
+	Count                 int64
+	Mean                  float64
+	SumOfSquaredDeviation float64
+	Min, Max              int64
+
+	NumFiniteBuckets int32
+	GrowthFactor     float64
+	Scale            float64
+	// BucketCounts holds the counts of the underflow bucket, followed by
+	// the finite buckets. Trailing empty buckets are omitted, as
+	// Stackdriver permits.
+	BucketCounts []int64
+}
+
+// ToStackdriverDistribution converts the distribution into an approximate
+// bucketed representation for Stackdriver, which renders distributions
+// from exponential buckets.
+//
+// The harness only tracks the count, sum, min and max of distributions, so
+// the values in between are approximated: one value is placed at the min,
+// one at the max, and the remaining values at their mean, so the count,
+// sum, min and max are preserved. The sum of squared deviation is that of
+// the approximation, and so a lower bound.
+func ToStackdriverDistribution(d DistributionData) StackdriverDist {
+	sd := StackdriverDist{
+		Count:            d.Count(),
+		NumFiniteBuckets: StackdriverNumFiniteBuckets,
+		GrowthFactor:     StackdriverGrowthFactor,
+		Scale:            StackdriverScale,
+	}
+	if d.Count() <= 0 {
+		return sd
+	}
+	sd.Mean, sd.Min, sd.Max = d.Mean(), d.Min(), d.Max()
+
+	counts := make([]int64, StackdriverNumFiniteBuckets+1)
+	add := func(v float64, n int64) {
+		counts[stackdriverBucket(v)] += n
+		sd.SumOfSquaredDeviation += float64(n) * (v - sd.Mean) * (v - sd.Mean)
+	}
+	add(float64(d.Min()), 1)
+	if d.Count() > 1 {
+		add(float64(d.Max()), 1)
+	}
+	if rest := d.Count() - 2; rest > 0 {
+		// Clamp, since overflowed sums can leave the rest's mean outside
+		// the bounds.
+		m := (float64(d.Sum()) - float64(d.Min()) - float64(d.Max())) / float64(rest)
+		add(math.Min(math.Max(m, float64(d.Min())), float64(d.Max())), rest)
+	}
+
+	last := len(counts)
+	for last > 0 && counts[last-1] == 0 {
+		last--
+	}
+	sd.BucketCounts = counts[:last]
+	return sd
+}
+
+// stackdriverBucket returns the index of the bucket holding v.
+func stackdriverBucket(v float64) int {
+	if v < StackdriverScale {
+		return 0
+	}
+	// Bucket boundaries are powers of two, so the bucket of v is that of
+	// its integer part, whose bit length is the bucket index.
+	if v >= math.MaxInt64 {
+		return StackdriverNumFiniteBuckets
+	}
+	return bits.Len64(uint64(v))
+}
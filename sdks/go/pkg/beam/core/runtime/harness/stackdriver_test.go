@@ -0,0 +1,86 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package harness
+
+import (
+	"math"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestToStackdriverDistribution(t *testing.T) {
+	tests := []struct {
+		name string
+		d    DistributionData
+		want []int64
+	}{
+		{
+			name: "empty",
+			d:    DistributionData{},
+		}, {
+			name: "single",
+			d:    DistributionData{1, 5, 5, 5},
+			want: []int64{0, 0, 0, 1},
+		}, {
+			// The min lands in [1, 2), the max in [32, 64), and the other 8
+			// values at their mean of 7.375 in [4, 8).
+			name: "spread",
+			d:    DistributionData{10, 100, 1, 40},
+			want: []int64{0, 1, 0, 8, 0, 0, 1},
+		}, {
+			name: "nonPositive",
+			d:    DistributionData{3, -6, -10, 0},
+			want: []int64{3},
+		}, {
+			name: "largest",
+			d:    DistributionData{2, math.MaxInt64, 0, math.MaxInt64},
+			want: append(append([]int64{1}, make([]int64, 63)...), 1),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := ToStackdriverDistribution(test.d)
+			if got.Count != test.d.Count() || got.Min != test.d.Min() || got.Max != test.d.Max() {
+				t.Errorf("ToStackdriverDistribution(%v) = %+v, want count %d, min %d and max %d", test.d, got, test.d.Count(), test.d.Min(), test.d.Max())
+			}
+			if got.NumFiniteBuckets != StackdriverNumFiniteBuckets || got.GrowthFactor != StackdriverGrowthFactor || got.Scale != StackdriverScale {
+				t.Errorf("ToStackdriverDistribution(%v) has bucket options %+v", test.d, got)
+			}
+			if d := cmp.Diff(test.want, got.BucketCounts); d != "" {
+				t.Errorf("ToStackdriverDistribution(%v) bucket counts diff (-want, +got):\n%v", test.d, d)
+			}
+			var n int64
+			for _, c := range got.BucketCounts {
+				n += c
+			}
+			if n != test.d.Count() {
+				t.Errorf("ToStackdriverDistribution(%v) buckets hold %d values, want %d", test.d, n, test.d.Count())
+			}
+		})
+	}
+}
+
+func TestToStackdriverDistribution_Moments(t *testing.T) {
+	// The approximation of 1, 3 and 5 is exact.
+	got := ToStackdriverDistribution(DistributionData{3, 9, 1, 5})
+	if got.Mean != 3 {
+		t.Errorf("Mean = %v, want 3", got.Mean)
+	}
+	if got.SumOfSquaredDeviation != 8 {
+		t.Errorf("SumOfSquaredDeviation = %v, want 8", got.SumOfSquaredDeviation)
+	}
+}
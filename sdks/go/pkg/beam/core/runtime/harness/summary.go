@@ -0,0 +1,113 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package harness
+
+import (
+	"bytes"
+	"sync/atomic"
+	"time"
+
+	"github.com/apache/beam/sdks/go/pkg/beam/core/graph/coder"
+	"github.com/apache/beam/sdks/go/pkg/beam/core/metrics"
+	"github.com/apache/beam/sdks/go/pkg/beam/core/runtime/exec"
+	pipepb "github.com/apache/beam/sdks/go/pkg/beam/model/pipeline_v1"
+)
+
+// BundleSummaryData is the decoded value of a bundle_summary payload.
+type BundleSummaryData struct {
+	// Elements is the number of elements read by the bundle's source.
+	Elements int64
+	// TotalMsecs is the wall time spent processing the bundle's elements,
+	// in milliseconds.
+	TotalMsecs int64
+	// Errors is the number of errors the bundle's transforms failed with.
+	Errors int64
+}
+
+// bundleSummaryOnly is whether bundle responses carry only a bundle
+// summary. Accessed atomically.
+var bundleSummaryOnly int32
+
+// SetBundleSummaryOnly sets whether ProcessBundle and progress responses
+// carry a single bundle summary MonitoringInfo, rather than the full set of
+// metrics, for runners that only want low fidelity monitoring. Disabled by
+// default.
+func SetBundleSummaryOnly(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&bundleSummaryOnly, v)
+}
+
+// bundleMonitoring returns the metrics to respond with for the plan's
+// current bundle: its summary if SetBundleSummaryOnly is enabled, and every
+// metric otherwise. final is whether it's the bundle's final report.
+func bundleMonitoring(p *exec.Plan, final bool) ([]*pipepb.MonitoringInfo, map[string][]byte, error) {
+	if atomic.LoadInt32(&bundleSummaryOnly) == 0 {
+		if final {
+			return finalMonitoring(p)
+		}
+		return monitoring(p)
+	}
+	mi, err := bundleSummary(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	return []*pipepb.MonitoringInfo{mi}, nil, nil
+}
+
+// bundleSummary returns a single MonitoringInfo summarizing the plan's
+// current bundle.
+func bundleSummary(p *exec.Plan) (*pipepb.MonitoringInfo, error) {
+	return summarizeBundle(p)
+}
+
+// summarizeBundle implements bundleSummary for any metricsSource. Every
+// field covers the current bundle only, and agrees with the granular
+// metrics: Elements is the source's element count, TotalMsecs is the sum of
+// the transform wall times, since each transform's time excludes that of its
+// downstream transforms, and Errors is the sum of the transform error counts.
+func summarizeBundle(p metricsSource) (*pipepb.MonitoringInfo, error) {
+	var sum BundleSummaryData
+	if snapshot, ok := p.Progress(); ok {
+		sum.Elements = snapshot.Count
+	}
+	if timer, ok := p.(wallTimer); ok {
+		var total time.Duration
+		for _, d := range timer.WallTimes() {
+			total += d
+		}
+		sum.TotalMsecs = total.Milliseconds()
+	}
+	if counter, ok := p.(errorCounter); ok {
+		for _, n := range counter.ErrorCounts() {
+			sum.Errors += n
+		}
+	}
+	payload, err := encodePayload(func(buf *bytes.Buffer) error {
+		for _, v := range []int64{sum.Elements, sum.TotalMsecs, sum.Errors} {
+			if err := coder.EncodeVarInt(v, buf); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newMonitoringInfo(urnBundleSummary, monitoringLabels(metrics.Labels{}.WithWorker(getWorkerID()).WithTags(getMetricTags())), payload), nil
+}
@@ -0,0 +1,135 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package harness
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/apache/beam/sdks/go/pkg/beam/core/graph/coder"
+	"github.com/apache/beam/sdks/go/pkg/beam/core/metrics"
+	"github.com/apache/beam/sdks/go/pkg/beam/core/runtime/exec"
+)
+
+// summarySource is a fakeSource with every metric a bundle summary covers.
+type summarySource struct {
+	fakeSource
+	walls map[string]time.Duration
+	errs  map[string]int64
+}
+
+func (s *summarySource) WallTimes() map[string]time.Duration { return s.walls }
+
+func (s *summarySource) ErrorCounts() map[string]int64 { return s.errs }
+
+func TestSummarizeBundle(t *testing.T) {
+	src := &summarySource{
+		fakeSource: fakeSource{
+			store:    metrics.GetStore(metrics.SetBundleID(context.Background(), "bundle")),
+			progress: &exec.ProgressReportSnapshot{ID: "source", PID: "sourceP", Count: 42},
+		},
+		walls: map[string]time.Duration{"first": 1500 * time.Millisecond, "second": 700 * time.Millisecond},
+		errs:  map[string]int64{"first": 1, "second": 2},
+	}
+	mi, err := summarizeBundle(src)
+	if err != nil {
+		t.Fatalf("summarizeBundle failed: %v", err)
+	}
+	if got, want := mi.GetUrn(), sUrns[urnBundleSummary]; got != want {
+		t.Errorf("summary urn = %v, want %v", got, want)
+	}
+	v, err := DecodeMonitoringInfo(mi)
+	if err != nil {
+		t.Fatalf("failed to decode summary: %v", err)
+	}
+	got := v.(BundleSummaryData)
+
+	// Build the expected summary from the granular metrics.
+	mons, _, err := monitoring(src)
+	if err != nil {
+		t.Fatalf("monitoring failed: %v", err)
+	}
+	var want BundleSummaryData
+	for _, mi := range mons {
+		n, err := coder.DecodeVarInt(bytes.NewReader(mi.GetPayload()))
+		switch mi.GetUrn() {
+		case sUrns[urnElementCount]:
+			if mi.GetLabels()["PCOLLECTION"] == "sourceP" {
+				want.Elements = n
+			}
+		case sUrns[urnTransformWallTime]:
+			want.TotalMsecs += n
+		case sUrns[urnTransformErrorCount]:
+			want.Errors += n
+		default:
+			continue
+		}
+		if err != nil {
+			t.Fatalf("failed to decode %v payload: %v", mi.GetUrn(), err)
+		}
+	}
+	if want != (BundleSummaryData{Elements: 42, TotalMsecs: 2200, Errors: 3}) {
+		t.Fatalf("granular metrics summarize to %+v, missing metrics", want)
+	}
+	if got != want {
+		t.Errorf("summarizeBundle() = %+v, want %+v", got, want)
+	}
+}
+
+func TestBundleSummary(t *testing.T) {
+	plan, _ := executeTestPlan(t, 3)
+	mi, err := bundleSummary(plan)
+	if err != nil {
+		t.Fatalf("bundleSummary failed: %v", err)
+	}
+	v, err := DecodeMonitoringInfo(mi)
+	if err != nil {
+		t.Fatalf("failed to decode summary: %v", err)
+	}
+	if got, want := v.(BundleSummaryData).Elements, int64(3); got != want {
+		t.Errorf("bundle summary elements = %v, want %v", got, want)
+	}
+}
+
+func TestBundleMonitoring_SummaryOnly(t *testing.T) {
+	plan, _ := executeTestPlan(t, 3)
+	full, _, err := bundleMonitoring(plan, true)
+	if err != nil {
+		t.Fatalf("bundleMonitoring failed: %v", err)
+	}
+	if len(full) < 2 {
+		t.Fatalf("bundleMonitoring returned %d infos, want every metric", len(full))
+	}
+
+	SetBundleSummaryOnly(true)
+	defer SetBundleSummaryOnly(false)
+	mons, pylds, err := bundleMonitoring(plan, true)
+	if err != nil {
+		t.Fatalf("bundleMonitoring failed with summaries only: %v", err)
+	}
+	if len(mons) != 1 || mons[0].GetUrn() != sUrns[urnBundleSummary] || len(pylds) != 0 {
+		t.Fatalf("bundleMonitoring() = %v, %v with summaries only, want a single bundle summary", mons, pylds)
+	}
+	v, err := DecodeMonitoringInfo(mons[0])
+	if err != nil {
+		t.Fatalf("failed to decode summary: %v", err)
+	}
+	if got, want := v.(BundleSummaryData).Elements, int64(3); got != want {
+		t.Errorf("bundle summary elements = %v, want %v", got, want)
+	}
+}
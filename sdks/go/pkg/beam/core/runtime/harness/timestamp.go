@@ -0,0 +1,53 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package harness
+
+import (
+	"time"
+
+	"github.com/apache/beam/sdks/go/pkg/beam/core/graph/mtime"
+	"github.com/apache/beam/sdks/go/pkg/beam/internal/errors"
+)
+
+// Conversions between the time representations of the gauge path. Beam
+// timestamps span [mtime.MinTimestamp, mtime.MaxTimestamp] at millisecond
+// precision, which is wider than the range time.Time can express in
+// nanoseconds, so mtime.FromTime overflows for distant times. Conversions
+// go through seconds instead, and handle the boundaries here.
+
+// toMtime converts t to a Beam timestamp, truncated to milliseconds.
+// Returns an error if t is outside the range of Beam timestamps.
+func toMtime(t time.Time) (mtime.Time, error) {
+	// t.UnixNano overflows for times after 2262, so use seconds.
+	sec := t.Unix()
+	if sec > mtime.MaxTimestamp.Milliseconds()/1000 || sec < mtime.MinTimestamp.Milliseconds()/1000 {
+		return 0, errors.Errorf("time %v is outside the range of Beam timestamps", t)
+	}
+	return mtime.Normalize(mtime.Time(sec*1000 + int64(t.Nanosecond())/1e6)), nil
+}
+
+// clampMtime converts t to a Beam timestamp like toMtime, clamping times
+// outside the range of Beam timestamps to the nearest bound.
+func clampMtime(t time.Time) mtime.Time {
+	m, err := toMtime(t)
+	if err != nil {
+		if t.Unix() > 0 {
+			return mtime.MaxTimestamp
+		}
+		return mtime.MinTimestamp
+	}
+	return m
+}
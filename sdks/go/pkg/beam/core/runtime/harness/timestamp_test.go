@@ -0,0 +1,55 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package harness
+
+import (
+	"testing"
+	"time"
+
+	"github.com/apache/beam/sdks/go/pkg/beam/core/graph/mtime"
+)
+
+func TestToMtime(t *testing.T) {
+	got, err := toMtime(time.Unix(1600000000, 123456789))
+	if err != nil {
+		t.Fatalf("toMtime failed: %v", err)
+	}
+	if want := mtime.FromMilliseconds(1600000000123); got != want {
+		t.Errorf("toMtime() = %v, want %v", got, want)
+	}
+	far := time.Unix(mtime.MaxTimestamp.Milliseconds()/1000+1, 0)
+	if got, err := toMtime(far); err == nil {
+		t.Errorf("toMtime(%v) = %v, want error", far, got)
+	}
+}
+
+func TestClampMtime(t *testing.T) {
+	tests := []struct {
+		t    time.Time
+		want mtime.Time
+	}{
+		{time.Unix(1600000000, 123456789), mtime.FromMilliseconds(1600000000123)},
+		{time.Unix(mtime.MaxTimestamp.Milliseconds()/1000+1, 0), mtime.MaxTimestamp},
+		{time.Unix(mtime.MinTimestamp.Milliseconds()/1000-1, 0), mtime.MinTimestamp},
+		// Past 2262, where mtime.FromTime overflows.
+		{time.Date(3000, 1, 1, 0, 0, 0, 0, time.UTC), mtime.FromMilliseconds(32503680000000)},
+	}
+	for _, test := range tests {
+		if got := clampMtime(test.t); got != test.want {
+			t.Errorf("clampMtime(%v) = %v, want %v", test.t, got, test.want)
+		}
+	}
+}
@@ -17,6 +17,8 @@
 
 package syscallx
 
+import "time"
+
 // PhysicalMemorySize returns the total physical memory size.
 func PhysicalMemorySize() (uint64, error) {
 	return 0, ErrUnsupported
@@ -26,3 +28,9 @@ func PhysicalMemorySize() (uint64, error) {
 func FreeDiskSpace(path string) (uint64, error) {
 	return 0, ErrUnsupported
 }
+
+// ProcessResourceUsage returns the CPU time used by the process, and its
+// maximum resident set size in bytes.
+func ProcessResourceUsage() (time.Duration, uint64, error) {
+	return 0, 0, ErrUnsupported
+}
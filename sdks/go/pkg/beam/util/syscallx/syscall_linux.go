@@ -17,7 +17,10 @@
 
 package syscallx
 
-import "syscall"
+import (
+	"syscall"
+	"time"
+)
 
 // PhysicalMemorySize returns the total physical memory size.
 func PhysicalMemorySize() (uint64, error) {
@@ -36,3 +39,15 @@ func FreeDiskSpace(path string) (uint64, error) {
 	}
 	return stat.Bavail * uint64(stat.Bsize), nil
 }
+
+// ProcessResourceUsage returns the CPU time used by the process, and its
+// maximum resident set size in bytes.
+func ProcessResourceUsage() (time.Duration, uint64, error) {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return 0, 0, err
+	}
+	cpu := time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+	// Linux reports the maximum resident set size in kilobytes.
+	return cpu, uint64(usage.Maxrss) * 1024, nil
+}